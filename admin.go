@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// maxCacheEntries caps how many entries GET /cache returns.
+const maxCacheEntries = 1000
+
+// authorizeAdmin checks the request's bearer token against ADMIN_TOKEN,
+// writing an error response and returning false when it doesn't match.
+func (s *server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if s.cfg.AdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	got := []byte(r.Header.Get("Authorization"))
+	want := []byte("Bearer " + s.cfg.AdminToken)
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type cacheEntryJSON struct {
+	Street  string             `json:"street"`
+	City    string             `json:"city"`
+	State   string             `json:"state"`
+	Zip     string             `json:"zip"`
+	Quarter int                `json:"quarter"`
+	Year    int                `json:"year"`
+	Rates   map[string]float64 `json:"rates"`
+}
+
+// cacheHandler serves GET /cache, listing cached addresses and their rates
+// to help diagnose stale-rate issues. ?limit=N caps the entries returned.
+// Entries are ordered by every field of their key, so two listings of the
+// same cache are identical. DELETE /cache purges entries; see purgeCache.
+func (s *server) cacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.purgeCache(w, r)
+		return
+	}
+
+	limit := maxCacheEntries
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxCacheEntries)
+	}
+
+	snapshot := s.cache.snapshot()
+	keys := make([]rateKey, 0, len(snapshot))
+	for k := range snapshot {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Street != b.Street {
+			return a.Street < b.Street
+		}
+		if a.Zip != b.Zip {
+			return a.Zip < b.Zip
+		}
+		if a.City != b.City {
+			return a.City < b.City
+		}
+		if a.State != b.State {
+			return a.State < b.State
+		}
+		if a.Year != b.Year {
+			return a.Year < b.Year
+		}
+		return a.Quarter < b.Quarter
+	})
+
+	entries := []cacheEntryJSON{}
+	for _, k := range keys[:min(len(keys), limit)] {
+		rates := make(map[string]float64)
+		for _, rate := range snapshot[k] {
+			rates[rate.Name] = rate.Rate
+		}
+		entries = append(entries, cacheEntryJSON{
+			Street:  k.Street,
+			City:    k.City,
+			State:   k.State,
+			Zip:     k.Zip,
+			Quarter: k.Quarter,
+			Year:    k.Year,
+			Rates:   rates,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"size":      len(snapshot),
+		"truncated": len(keys) > limit,
+		"entries":   entries,
+	}); err != nil {
+		log.Printf("Error writing cache response: %v", err)
+	}
+}
+
+// purgeCache serves DELETE /cache, removing stale entries so their next
+// lookup goes upstream. The street, city, state and zip parameters narrow
+// the purge to entries matching each given value, compared the way cache
+// keys are normalized; with none, the whole cache is cleared.
+func (s *server) purgeCache(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := rateKey{Street: q.Get("street"), City: q.Get("city"), State: q.Get("state"), Zip: q.Get("zip")}.normalized()
+	n := s.cache.purge(func(k rateKey) bool {
+		return (filter.Street == "" || k.Street == filter.Street) &&
+			(filter.City == "" || k.City == filter.City) &&
+			(filter.State == "" || k.State == filter.State) &&
+			(filter.Zip == "" || k.Zip == filter.Zip)
+	})
+	log.Printf("Purged %d rate cache entries", n)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"purged": n}); err != nil {
+		log.Printf("Error writing cache purge response: %v", err)
+	}
+}
+
+// redacted stands in for a configured secret in GET /config.
+const redacted = "[redacted]"
+
+// configJSON is the effective configuration reported by GET /config.
+// Secrets are replaced by redacted, and data files by their entry counts.
+type configJSON struct {
+	Port               string   `json:"port"`
+	RoutePrefix        string   `json:"route_prefix"`
+	CORSAllowedOrigins []string `json:"cors_allowed_origins"`
+
+	TaxAPIBaseURL      string  `json:"tax_api_base_url"`
+	TaxAPIClientID     string  `json:"tax_api_client_id"`
+	TaxAPIClientSecret string  `json:"tax_api_client_secret"`
+	TaxAPITimeout      string  `json:"tax_api_timeout"`
+	TaxAPIRPS          float64 `json:"tax_api_rps"`
+	TaxAPIProxy        string  `json:"tax_api_proxy"`
+	TaxAPICustomCA     bool    `json:"tax_api_custom_ca"`
+	TaxAPIPins         int     `json:"tax_api_pins"`
+	ComplianceSigning  bool    `json:"compliance_signing"`
+	UpstreamMode       string  `json:"upstream_mode"`
+	TotalRateSource    string  `json:"total_rate_source"`
+
+	MaxConcurrency int    `json:"max_concurrency"`
+	OutputWorkers  int    `json:"output_workers"`
+	MaxAttempts    int    `json:"max_attempts"`
+	RetryBudget    int    `json:"retry_budget"`
+	RateCacheSize  int    `json:"rate_cache_size"`
+	RateCacheTTL   string `json:"rate_cache_ttl"`
+
+	AdminToken string `json:"admin_token"`
+
+	RateOverrides       int  `json:"rate_overrides"`
+	JurisdictionAliases int  `json:"jurisdiction_aliases"`
+	TaxableCaps         int  `json:"taxable_caps"`
+	TaxHolidays         int  `json:"tax_holidays"`
+	ClientChargeRanges  int  `json:"client_charge_ranges"`
+	FIPS                bool `json:"fips"`
+
+	BaseCurrency      string             `json:"base_currency"`
+	CurrencyRates     map[string]float64 `json:"currency_rates"`
+	ChargeColumns     []string           `json:"charge_columns"`
+	MaxCharge         float64            `json:"max_charge"`
+	MaxChargePolicy   string             `json:"max_charge_policy"`
+	BlankCityPolicy   string             `json:"blank_city_policy"`
+	BlankChargePolicy string             `json:"blank_charge_policy"`
+	EmptyClientPolicy string             `json:"empty_client_policy"`
+	MinTaxAmount      float64            `json:"min_tax_amount"`
+	MinTaxBucket      string             `json:"min_tax_bucket"`
+	OutlierFactor     float64            `json:"charge_outlier_factor"`
+	ExpectedState     string             `json:"expected_state"`
+	RatePrecision     int                `json:"rate_precision"`
+	TwoDigitYearPivot int                `json:"two_digit_year_pivot"`
+	MinYear           int                `json:"min_year"`
+	BusinessStart     string             `json:"business_start_date"`
+	FutureGraceDays   int                `json:"future_date_grace_days"`
+	EmptyResultStatus int                `json:"empty_result_status"`
+}
+
+// redact returns redacted for a configured secret, or "" when it is unset.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURL hides the password in raw and drops its query string, where
+// some APIs take a key. A URL that doesn't parse is redacted whole.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return u.Redacted()
+}
+
+func newConfigJSON(cfg Config) configJSON {
+	c := configJSON{
+		Port:               cfg.Port,
+		RoutePrefix:        cfg.RoutePrefix,
+		CORSAllowedOrigins: cfg.CORSAllowedOrigins,
+
+		TaxAPIBaseURL:      redactURL(cfg.TaxAPIBaseURL),
+		TaxAPIClientID:     redact(cfg.TaxAPIClientID),
+		TaxAPIClientSecret: redact(cfg.TaxAPIClientSecret),
+		TaxAPITimeout:      cfg.TaxAPITimeout.String(),
+		TaxAPIRPS:          cfg.TaxAPIRPS,
+		TaxAPICustomCA:     cfg.TaxAPIRootCAs != nil,
+		TaxAPIPins:         len(cfg.TaxAPIPins),
+		ComplianceSigning:  cfg.ComplianceKey != nil,
+		UpstreamMode:       cfg.UpstreamMode,
+		TotalRateSource:    cfg.TotalRateSource,
+
+		MaxConcurrency: cfg.MaxConcurrency,
+		OutputWorkers:  cfg.OutputWorkers,
+		MaxAttempts:    cfg.MaxAttempts,
+		RetryBudget:    cfg.RetryBudget,
+		RateCacheSize:  cfg.RateCacheSize,
+		RateCacheTTL:   cfg.RateCacheTTL.String(),
+
+		AdminToken: redact(cfg.AdminToken),
+
+		RateOverrides:       len(cfg.RateOverrides),
+		JurisdictionAliases: len(cfg.JurisdictionAliases),
+		TaxableCaps:         len(cfg.TaxableCaps),
+		TaxHolidays:         len(cfg.TaxHolidays),
+		ClientChargeRanges:  len(cfg.ClientChargeRanges),
+		FIPS:                cfg.FIPS != nil,
+
+		BaseCurrency:      cfg.BaseCurrency,
+		CurrencyRates:     cfg.CurrencyRates,
+		ChargeColumns:     chargeColumnNames(cfg.ChargeColumns),
+		MaxCharge:         cfg.MaxCharge,
+		MaxChargePolicy:   cfg.MaxChargePolicy,
+		BlankCityPolicy:   cfg.BlankCityPolicy,
+		BlankChargePolicy: cfg.BlankChargePolicy,
+		EmptyClientPolicy: cfg.EmptyClientPolicy,
+		MinTaxAmount:      cfg.MinTaxAmount,
+		MinTaxBucket:      cfg.MinTaxBucket,
+		OutlierFactor:     cfg.OutlierFactor,
+		ExpectedState:     cfg.ExpectedState,
+		RatePrecision:     cfg.RatePrecision,
+		TwoDigitYearPivot: cfg.TwoDigitYearPivot,
+		MinYear:           cfg.MinYear,
+		FutureGraceDays:   cfg.FutureGraceDays,
+		EmptyResultStatus: cfg.EmptyResultStatus,
+	}
+	if cfg.TaxAPIProxy != nil {
+		c.TaxAPIProxy = cfg.TaxAPIProxy.Redacted()
+	}
+	if !cfg.BusinessStart.IsZero() {
+		c.BusinessStart = cfg.BusinessStart.Format("2006-01-02")
+	}
+	return c
+}
+
+// configHandler serves GET /config, the configuration in effect, so
+// operators can check it without reading logs. Like /cache it requires the
+// admin token.
+func (s *server) configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newConfigJSON(s.cfg)); err != nil {
+		log.Printf("Error writing config response: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Limits on ZIP uploads, guarding against archive bombs. Sizes are
+// enforced on the bytes actually inflated, not on the sizes the archive
+// claims.
+const (
+	maxArchiveEntries   = 50
+	maxArchiveEntrySize = 10 << 20
+	maxArchiveTotalSize = 100 << 20
+)
+
+// csvInput is one CSV to process. Name is the entry name within an
+// uploaded archive, or empty for a plain CSV upload.
+type csvInput struct {
+	Name   string
+	Reader io.Reader
+}
+
+// isZipUpload reports whether the upload starts with the ZIP local file
+// header signature.
+func isZipUpload(file io.ReaderAt) bool {
+	magic := make([]byte, 4)
+	n, _ := file.ReadAt(magic, 0)
+	return n == 4 && bytes.Equal(magic, []byte("PK\x03\x04"))
+}
+
+// readUploadArchive extracts the CSV entries of an uploaded ZIP, in archive
+// order. Directories, non-CSV files and macOS resource forks are ignored.
+func readUploadArchive(file io.ReaderAt, size int64) ([]csvInput, error) {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ZIP upload: %v", err)
+	}
+
+	var inputs []csvInput
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || !strings.EqualFold(path.Ext(f.Name), ".csv") {
+			continue
+		}
+		if len(inputs) == maxArchiveEntries {
+			return nil, fmt.Errorf("ZIP upload has more than %d CSV files", maxArchiveEntries)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s in ZIP upload: %v", f.Name, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxArchiveEntrySize+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s in ZIP upload: %v", f.Name, err)
+		}
+		if len(data) > maxArchiveEntrySize {
+			return nil, fmt.Errorf("%s in ZIP upload exceeds %d bytes", f.Name, maxArchiveEntrySize)
+		}
+		total += int64(len(data))
+		if total > maxArchiveTotalSize {
+			return nil, fmt.Errorf("ZIP upload exceeds %d bytes uncompressed", maxArchiveTotalSize)
+		}
+		inputs = append(inputs, csvInput{Name: f.Name, Reader: bytes.NewReader(data)})
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("ZIP upload contains no CSV files")
+	}
+	return inputs, nil
+}
+
+// splitBySource groups records by the archive entry they came from, in
+// upload order, under a directory named after the entry's full path less
+// its extension, so a/x.csv and b/x.csv stay apart. Entries that still
+// collide, such as x.csv and x.CSV, get a numeric suffix.
+func splitBySource(records []TaxRecord) []recordGroup {
+	var groups []recordGroup
+	index := make(map[string]int)
+	used := make(map[string]bool)
+	for _, rec := range records {
+		i, ok := index[rec.Source]
+		if !ok {
+			i = len(groups)
+			index[rec.Source] = i
+			// Cleaning against the root drops any leading / or ../.
+			name := strings.TrimPrefix(path.Clean("/"+rec.Source), "/")
+			base := strings.TrimSuffix(name, path.Ext(name))
+			prefix := base + "/"
+			for n := 2; used[prefix]; n++ {
+				prefix = fmt.Sprintf("%s-%d/", base, n)
+			}
+			used[prefix] = true
+			groups = append(groups, recordGroup{prefix: prefix})
+		}
+		groups[i].records = append(groups[i].records, rec)
+	}
+	return groups
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// zipOf builds a ZIP archive holding files, in order, as name/content pairs.
+func zipOf(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		f, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPerFileKeepsSameNamedEntriesApart(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	data := zipOf(t,
+		"a/x.csv", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n",
+		"b/x.csv", testHeader+"Bolt,1/16/2024,200,2 Main St,Austin,TX,78701\n",
+	)
+	w := postUpload(t, s, "include=charge&archive_output=per_file", "upload.zip", data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+	want := []string{"a/x/due_by_charge.csv", "b/x/due_by_charge.csv"}
+	if got := fileNames(files); !slices.Equal(got, want) {
+		t.Fatalf("files = %v, want %v", got, want)
+	}
+	if rows := readCSV(t, files["b/x/due_by_charge.csv"]); len(rows) != 2 || rows[1][0] != "Bolt" {
+		t.Errorf("b/x/due_by_charge.csv = %v, want Bolt's row", rows)
+	}
+}
+
+func TestSplitBySourcePrefixes(t *testing.T) {
+	var records []TaxRecord
+	for _, source := range []string{"x.csv", "a/x.csv", "x.CSV", "x.csv", "../up.csv", "/abs/y.csv"} {
+		records = append(records, TaxRecord{Source: source})
+	}
+	var got []string
+	for _, g := range splitBySource(records) {
+		got = append(got, g.prefix)
+	}
+	want := []string{"x/", "a/x/", "x-2/", "up/", "abs/y/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("prefixes = %v, want %v", got, want)
+	}
+}
+
+func TestZipOfTwoCSVsIsCombined(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	data := zipOf(t,
+		"january.csv", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n",
+		"notes.txt", "not a CSV",
+		"__MACOSX/._january.csv", "resource fork",
+		"february.CSV", testHeader+"Acme,2/15/2024,100,1 Main St,Austin,TX,78701\nBolt,2/16/2024,200,2 Main St,Austin,TX,78701\n",
+	)
+	w := postUpload(t, s, "include=client,charge", "upload.zip", data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+	if rows := readCSV(t, files["due_by_charge.csv"]); len(rows) != 4 {
+		t.Errorf("due_by_charge.csv has %d rows, want 3 from both files", len(rows)-1)
+	}
+	want := [][]string{{"Acme", "14.50"}, {"Bolt", "14.50"}}
+	rows := readCSV(t, files["due_by_client.csv"])
+	for i, client := range want {
+		if i+1 >= len(rows) || rows[i+1][0] != client[0] || rows[i+1][len(rows[i+1])-1] != client[1] {
+			t.Errorf("due_by_client.csv = %v, want totals %v", rows, want)
+			break
+		}
+	}
+}
+
+func TestZipUploadLimits(t *testing.T) {
+	var many []string
+	for i := range maxArchiveEntries + 1 {
+		many = append(many, fmt.Sprintf("f%d.csv", i), testHeader)
+	}
+	for name, data := range map[string][]byte{
+		"too many entries": zipOf(t, many...),
+		"oversized entry":  zipOf(t, "big.csv", testHeader+strings.Repeat("x", maxArchiveEntrySize)),
+		"no CSV files":     zipOf(t, "readme.txt", "hello"),
+	} {
+		if _, err := readUploadArchive(bytes.NewReader(data), int64(len(data))); err == nil {
+			t.Errorf("%s: archive accepted", name)
+		}
+	}
+}
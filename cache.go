@@ -0,0 +1,93 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// rateCache memoizes rate schedules by address and period across jobs. It
+// holds at most size entries, evicting the least recently used, and drops
+// entries older than ttl so rates republished upstream are picked up. It
+// is safe for concurrent use so lookups can be shared across goroutines.
+type rateCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[rateKey]*list.Element
+}
+
+// cacheEntry is one cached rate schedule and when it was stored.
+type cacheEntry struct {
+	key    rateKey
+	rates  []jurisdictionRate
+	stored time.Time
+}
+
+func newRateCache(size int, ttl time.Duration) *rateCache {
+	return &rateCache{size: size, ttl: ttl, order: list.New(), entries: make(map[rateKey]*list.Element)}
+}
+
+func (c *rateCache) get(key rateKey) ([]jurisdictionRate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Since(entry.stored) > c.ttl {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.rates, true
+}
+
+func (c *rateCache) put(key rateKey, rates []jurisdictionRate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key, rates, time.Now()}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, rates, time.Now()})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// purge removes the entries whose key matches, returning how many.
+func (c *rateCache) purge(match func(rateKey) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if match(key) {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
+
+// remove drops el from the cache. c.mu must be held.
+func (c *rateCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+// snapshot returns a copy of the unexpired entries.
+func (c *rateCache) snapshot() map[rateKey][]jurisdictionRate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make(map[rateKey][]jurisdictionRate, len(c.entries))
+	for k, el := range c.entries {
+		if entry := el.Value.(*cacheEntry); time.Since(entry.stored) <= c.ttl {
+			entries[k] = entry.rates
+		}
+	}
+	return entries
+}
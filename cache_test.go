@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newRateCache(2, time.Hour)
+	a, b, d := rateKey{Zip: "1"}, rateKey{Zip: "2"}, rateKey{Zip: "3"}
+	c.put(a, testRates)
+	c.put(b, testRates)
+	c.get(a) // a is now more recently used than b
+	c.put(d, testRates)
+
+	if _, ok := c.get(b); ok {
+		t.Error("least recently used entry was not evicted")
+	}
+	for _, k := range []rateKey{a, d} {
+		if _, ok := c.get(k); !ok {
+			t.Errorf("entry %v was evicted", k)
+		}
+	}
+	if n := len(c.snapshot()); n != 2 {
+		t.Errorf("cache holds %d entries, want 2", n)
+	}
+}
+
+func TestRateCacheExpiresEntries(t *testing.T) {
+	c := newRateCache(10, 20*time.Millisecond)
+	key := rateKey{Zip: "78701"}
+	c.put(key, testRates)
+	if _, ok := c.get(key); !ok {
+		t.Fatal("fresh entry missing")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.get(key); ok {
+		t.Error("expired entry still served")
+	}
+	if n := len(c.snapshot()); n != 0 {
+		t.Errorf("snapshot lists %d expired entries", n)
+	}
+}
+
+func TestCachePurgeEndpoint(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"ADMIN_TOKEN": "secret"})
+	s.cache.put(rateKey{Street: "1 main st", Zip: "78701", Quarter: 1, Year: 2024}, testRates)
+	s.cache.put(rateKey{Street: "1 main st", Zip: "78701", Quarter: 2, Year: 2024}, testRates)
+	s.cache.put(rateKey{Street: "9 oak ave", Zip: "75001", Quarter: 1, Year: 2024}, testRates)
+
+	purge := func(query, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/cache?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.cacheHandler(w, req)
+		return w
+	}
+
+	if w := purge("", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("purge with a bad token: status %d, want 401", w.Code)
+	}
+	if n := len(s.cache.snapshot()); n != 3 {
+		t.Fatalf("unauthorized purge removed entries: %d left", n)
+	}
+
+	w := purge("street=1+Main++St&zip=78701", "secret")
+	var resp struct{ Purged int }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Purged != 2 {
+		t.Errorf("purge by address = %+v, %v; want 2 purged", resp, err)
+	}
+	if _, ok := s.cache.get(rateKey{Street: "9 oak ave", Zip: "75001", Quarter: 1, Year: 2024}); !ok {
+		t.Error("purge by address removed another address")
+	}
+
+	purge("", "secret")
+	if n := len(s.cache.snapshot()); n != 0 {
+		t.Errorf("purge of everything left %d entries", n)
+	}
+}
+
+// Run with -race: jobs share the cache, so every operation may happen
+// concurrently with every other.
+func TestRateCacheConcurrentAccess(t *testing.T) {
+	c := newRateCache(50, time.Hour)
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				key := rateKey{Zip: strconv.Itoa((g*7 + i) % 80)}
+				switch i % 10 {
+				case 0:
+					c.snapshot()
+				case 1:
+					c.purge(func(k rateKey) bool { return k == key })
+				case 2, 3, 4:
+					c.put(key, testRates)
+				default:
+					if rates, ok := c.get(key); ok && len(rates) != len(testRates) {
+						t.Errorf("get(%v) = %v", key, rates)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(c.snapshot()); n > 50 {
+		t.Errorf("cache holds %d entries, more than its size of 50", n)
+	}
+}
+
+// Concurrent uploads sharing a server resolve through the same cache.
+func TestConcurrentJobsShareCache(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, nil)
+	var body strings.Builder
+	body.WriteString(testHeader)
+	for i := range 20 {
+		fmt.Fprintf(&body, "C%d,1/15/2024,100,%d Main St,Austin,TX,78701\n", i, i)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := postCSV(t, s, "include=client", body.String()); w.Code != http.StatusOK {
+				t.Errorf("status = %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.cache.snapshot()); n != 20 {
+		t.Errorf("cache holds %d entries, want 20", n)
+	}
+	// Jobs racing on a cold cache may each look an address up, but no more.
+	if n := api.calls.Load(); n < 20 || n > 8*20 {
+		t.Errorf("rate API called %d times", n)
+	}
+}
+
+func TestLookupsSharedByNormalizedAddress(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[strings.ToLower(strings.Join(strings.Fields(r.URL.Query().Get("street")), " "))]++
+		mu.Unlock()
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, nil)
+	body := testHeader +
+		"Acme,1/15/2024,100,12 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,100,  12  MAIN st ,austin , tx,78701\n" +
+		"Cole,2/01/2024,100,12 main st,AUSTIN,TX, 78701\n" +
+		"Dove,1/17/2024,100,9 Oak Ave,Austin,TX,78701\n"
+	for range 2 {
+		if w := postCSV(t, s, "", body); w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	}
+	want := map[string]int{"12 main st": 1, "9 oak ave": 1}
+	if !maps.Equal(calls, want) {
+		t.Errorf("rate API calls by address = %v, want %v", calls, want)
+	}
+}
+
+func TestThreeAddressesThreeLookups(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"MAX_CONCURRENCY": "8"})
+	addresses := []string{"1 Main St,Austin,TX,78701", "9 Oak Ave,Austin,TX,78702", "400 Congress Ave,Austin,TX,78701"}
+	var body strings.Builder
+	body.WriteString(testHeader)
+	for i := range 300 {
+		fmt.Fprintf(&body, "C%d,2/%d/2024,%d,%s\n", i%17, 1+i%28, 10+i, addresses[(i*7)%3])
+	}
+	w := postCSV(t, s, "include=charge", body.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if n := api.calls.Load(); n != 3 {
+		t.Errorf("rate API called %d times for 3 addresses, want 3", n)
+	}
+	if rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"]); len(rows) != 301 {
+		t.Errorf("due_by_charge.csv has %d rows, want 300", len(rows)-1)
+	}
+
+	// Every row is parsed before any lookup, so an unreadable file costs
+	// no upstream calls at all.
+	api.calls.Store(0)
+	s = newTestServer(t, api, nil)
+	w = postCSV(t, s, "", body.String()+"Zed,2/1/2024,1,\"unterminated,Austin,TX,78701\nC0,2/1/2024,1,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusBadRequest || api.calls.Load() != 0 {
+		t.Errorf("malformed file: status %d after %d lookups, want 400 after none", w.Code, api.calls.Load())
+	}
+}
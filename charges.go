@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// chargeColumn is an additional taxable subtotal column (e.g. "goods" or
+// "services") that is taxed only by the listed jurisdiction types. An empty
+// Types list means every jurisdiction taxes it.
+type chargeColumn struct {
+	Name  string
+	Types []string
+}
+
+// parseChargeColumns parses CHARGE_COLUMNS, a semicolon-separated list of
+// name=types entries where types is "all" or a comma-separated list of
+// jurisdiction types, e.g. "goods=all;services=STATE,CITY".
+func parseChargeColumns(v string) ([]chargeColumn, error) {
+	var columns []chargeColumn
+	for _, entry := range strings.Split(v, ";") {
+		name, types, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid CHARGE_COLUMNS entry %q: expected name=types", entry)
+		}
+		if name == "charge" {
+			return nil, fmt.Errorf("invalid CHARGE_COLUMNS entry %q: charge is already the main charge column", entry)
+		}
+		col := chargeColumn{Name: name}
+		if types = strings.TrimSpace(types); types != "all" {
+			for _, t := range strings.Split(types, ",") {
+				col.Types = append(col.Types, strings.TrimSpace(t))
+			}
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// taxes reports whether a jurisdiction of type jurisType taxes the column.
+func (c chargeColumn) taxes(jurisType string) bool {
+	if len(c.Types) == 0 {
+		return true
+	}
+	for _, t := range c.Types {
+		if strings.EqualFold(t, jurisType) {
+			return true
+		}
+	}
+	return false
+}
+
+func chargeColumnNames(columns []chargeColumn) []string {
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.Name
+	}
+	return names
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseChargeColumns(t *testing.T) {
+	columns, err := parseChargeColumns(" goods = all ;services=STATE, city")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 2 || columns[0].Name != "goods" || columns[0].Types != nil ||
+		columns[1].Name != "services" || len(columns[1].Types) != 2 || columns[1].Types[1] != "city" {
+		t.Errorf("columns = %+v", columns)
+	}
+	for _, bad := range []string{"goods", "=all", "charge=all", "goods=all;"} {
+		if _, err := parseChargeColumns(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestChargeColumnsTaxedByTheirTypes(t *testing.T) {
+	columns, _ := parseChargeColumns("goods=all;services=state")
+	rec := newRecord(100, "2024-01-15")
+	rec.ColumnCharges = map[string]float64{"goods": 200, "services": 1000}
+	rec.ColumnTaxes = map[string]float64{}
+	computeTaxes(rec, testRates, Config{ChargeColumns: columns}, requestOptions{})
+
+	want := map[string]float64{
+		// 100 + 200 + 1000 at 6.25%; the city taxes only the charge and goods.
+		"TEXAS STATE": 81.25,
+		"AUSTIN":      3,
+	}
+	for juris, tax := range want {
+		if math.Abs(rec.Taxes[juris]-tax) > 1e-9 {
+			t.Errorf("%s tax = %v, want %v", juris, rec.Taxes[juris], tax)
+		}
+	}
+	if math.Abs(rec.ColumnTaxes["goods"]-14.5) > 1e-9 || math.Abs(rec.ColumnTaxes["services"]-62.5) > 1e-9 {
+		t.Errorf("column taxes = %v, want goods 14.50 and services 62.50", rec.ColumnTaxes)
+	}
+	if rec.Bases["AUSTIN"] != 300 || rec.Bases["TEXAS STATE"] != 1300 {
+		t.Errorf("bases = %v", rec.Bases)
+	}
+}
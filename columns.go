@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// optionalColumns are recognized in uploads in addition to requiredColumns.
+var optionalColumns = []string{"currency"}
+
+// errInvalidHeader is returned when an upload's header row doesn't have
+// the expected columns.
+var errInvalidHeader = errors.New("invalid CSV header")
+
+// columnIndex maps header names to their position in each row, so columns
+// may appear in any order.
+type columnIndex map[string]int
+
+// resolveColumns validates header and builds its column index. Every
+// required column must be present exactly once. Besides optionalColumns,
+// the names in extra are also recognized. Unrecognized columns are ignored,
+// or rejected when strict is set.
+func resolveColumns(header []string, strict bool, extra []string) (columnIndex, error) {
+	cols := make(columnIndex)
+	var unexpected []string
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if _, dup := cols[name]; dup {
+			return nil, fmt.Errorf("%w: duplicate column %q", errInvalidHeader, name)
+		}
+		if slices.Contains(requiredColumns, name) || slices.Contains(optionalColumns, name) || slices.Contains(extra, name) {
+			cols[name] = i
+		} else {
+			unexpected = append(unexpected, name)
+		}
+	}
+
+	var missing []string
+	for _, name := range requiredColumns {
+		if _, ok := cols[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: missing columns %v in %v, expected %v", errInvalidHeader, missing, header, requiredColumns)
+	}
+
+	if len(unexpected) > 0 {
+		if strict {
+			return nil, fmt.Errorf("%w: unexpected columns %v", errInvalidHeader, unexpected)
+		}
+		log.Printf("Ignoring unexpected columns: %v", unexpected)
+	}
+	return cols, nil
+}
+
+// has reports whether the upload includes the named column.
+func (cols columnIndex) has(name string) bool {
+	_, ok := cols[name]
+	return ok
+}
+
+// get returns the named field of row, or "" when the column is absent or
+// the row is too short to have it.
+func (cols columnIndex) get(row []string, name string) string {
+	i, ok := cols[name]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStrictColumnsRejectsUnknownColumns(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	upload := "client,date,charge,street address,city,State,zip code,invoice\n" +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701,INV-1\n"
+
+	if w := postCSV(t, s, "", upload); w.Code != http.StatusOK {
+		t.Errorf("lenient: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	w := postCSV(t, s, "strict_columns=true", upload)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unexpected columns [invoice]") {
+		t.Errorf("strict: got %d %q, want 400 naming the invoice column", w.Code, w.Body)
+	}
+	if w := postCSV(t, s, "strict_columns=true", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"); w.Code != http.StatusOK {
+		t.Errorf("strict with known columns only: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestColumnsMatchedByName(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=charge", "invoice, zip code ,State,city,street address,charge,date,client\n"+
+		"INV-7,78701,TX,Austin,1 Main St,100,1/15/2024,Acme\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	if got := strings.Join(rows[1][:7], ","); got != "Acme,1/15/2024,100.00,1 Main St,Austin,TX,78701" {
+		t.Errorf("due_by_charge.csv row = %s", got)
+	}
+
+	for header, want := range map[string]string{
+		"client,date,charge,street address,city,State":                     "missing columns [zip code]",
+		"client,date,charge,street address,city,State,zip code,charge":     `duplicate column "charge"`,
+		"client,date,charge,street address,city,state,zip code":            "missing columns [State]",
+		"client,date,charge,street address,city,State,zip code,currency,x": "",
+	} {
+		_, err := resolveColumns(strings.Split(header, ","), false, nil)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: err = %v, want %q", header, err, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// complianceReportName is the file include=compliance adds to the ZIP. With
+// a signing key configured it is accompanied by complianceReportName+".sig".
+const complianceReportName = "compliance_report.csv"
+
+// complianceRows documents what a filing was based on: every rate used for
+// every address and period, each row stamped with when the report was
+// generated, the API endpoint queried and the client ID it was queried as.
+// The client secret is never included.
+func (rp reporter) complianceRows(records []TaxRecord, generated time.Time) [][]string {
+	rows := [][]string{{"generated at", "api endpoint", "api client", "street address", "city", "State", "zip code", "quarter", "year", "jurisdiction", "type", "rate"}}
+	stamp := []string{rp.timestamp(generated), rp.cfg.TaxAPIBaseURL, rp.cfg.TaxAPIClientID}
+	seen := make(map[rateKey]bool)
+	for _, rec := range records {
+		key := rec.rateKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, rate := range rec.Rates {
+			rows = append(rows, append(append([]string{}, stamp...),
+				rec.Street,
+				rec.City,
+				rec.State,
+				rec.Zip,
+				strconv.Itoa(rec.Quarter),
+				strconv.Itoa(rec.Year),
+				rate.Name,
+				rate.Type,
+				strconv.FormatFloat(rate.Rate, 'f', -1, 64),
+			))
+		}
+	}
+	return rows
+}
+
+// complianceSignature returns the detached signature of an encoded
+// compliance report: its Ed25519 signature, base64-encoded. After decoding
+// it verifies with e.g. "openssl pkeyutl -verify -pubin -inkey pub.pem
+// -rawin -in compliance_report.csv -sigfile sig.bin".
+func complianceSignature(key ed25519.PrivateKey, report []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, report)) + "\n")
+}
+
+// loadSigningKey reads an Ed25519 private key in PKCS #8 PEM form, as
+// written by "openssl genpkey -algorithm ed25519".
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read COMPLIANCE_SIGNING_KEY_FILE: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid COMPLIANCE_SIGNING_KEY_FILE %q: no PEM block found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid COMPLIANCE_SIGNING_KEY_FILE %q: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid COMPLIANCE_SIGNING_KEY_FILE %q: expected an Ed25519 key, got %T", path, key)
+	}
+	return edKey, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSigningKey writes a new Ed25519 key as PKCS #8 PEM and returns its
+// path and public half.
+func writeSigningKey(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func TestComplianceReportIsSigned(t *testing.T) {
+	keyPath, pub := writeSigningKey(t)
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"COMPLIANCE_SIGNING_KEY_FILE": keyPath})
+	start := time.Now().Truncate(time.Second)
+	w := postCSV(t, s, "include=compliance", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,50,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+	report, sig := files[complianceReportName], files[complianceReportName+".sig"]
+
+	rows := readCSV(t, report)
+	if len(rows) != 3 {
+		t.Fatalf("%s = %v, want one row per jurisdiction at the one address", complianceReportName, rows)
+	}
+	for _, row := range rows[1:] {
+		generated, err := time.Parse(time.RFC3339, row[0])
+		if err != nil || generated.Before(start) || generated.After(time.Now()) {
+			t.Errorf("generated at = %q, want the time of the run", row[0])
+		}
+		if row[1] != s.cfg.TaxAPIBaseURL || row[2] != "test-id" {
+			t.Errorf("endpoint and client = %q, %q, want %q, test-id", row[1], row[2], s.cfg.TaxAPIBaseURL)
+		}
+	}
+	if strings.Contains(report, "test-secret") {
+		t.Error("report includes the client secret")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil {
+		t.Fatalf("signature %q: %v", sig, err)
+	}
+	if !ed25519.Verify(pub, []byte(report), signature) {
+		t.Error("signature does not verify against the report")
+	}
+	if ed25519.Verify(pub, []byte(strings.Replace(report, "0.0625", "0.0600", 1)), signature) {
+		t.Error("signature verifies against an altered report")
+	}
+}
+
+func TestComplianceReportUnsignedWithoutKey(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	files := unzip(t, postCSV(t, s, "include=compliance", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n").Body.Bytes())
+	if _, ok := files[complianceReportName]; !ok {
+		t.Errorf("no %s in %v", complianceReportName, fileNames(files))
+	}
+	if _, ok := files[complianceReportName+".sig"]; ok {
+		t.Error("report signed with no key configured")
+	}
+}
+
+func TestSigningKeyFileMustBePEM(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigWith(t, map[string]string{"COMPLIANCE_SIGNING_KEY_FILE": path}); err == nil {
+		t.Error("loadConfig accepted a file without a PEM block")
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTaxAPIBaseURL is the Texas Comptroller sales tax rate endpoint.
+const defaultTaxAPIBaseURL = "https://mulesoft.cpa.texas.gov:8088/api/cpa/gis/v1/salestaxrate/salestaxrate"
+
+// Config holds process-wide settings read from the environment at startup.
+type Config struct {
+	Port string
+
+	// RoutePrefix is prepended to every route, e.g. "/api/tax" to serve
+	// /api/tax/getTaxRates behind a gateway. It is empty by default.
+	RoutePrefix string
+
+	// CORSAllowedOrigins are the browser origins allowed to call the API,
+	// from the comma-separated CORS_ALLOWED_ORIGINS. "*" allows any origin
+	// and is meant for development.
+	CORSAllowedOrigins []string
+
+	// TaxAPIBaseURL is the rate lookup endpoint, and TaxAPIClientID and
+	// TaxAPIClientSecret the credentials sent with every lookup. The
+	// credentials have no default and must be set unless lookups are
+	// replayed from fixtures.
+	TaxAPIBaseURL      string
+	TaxAPIClientID     string
+	TaxAPIClientSecret string
+
+	// TaxAPITimeout bounds each call to the tax API, including reading
+	// the response.
+	TaxAPITimeout time.Duration
+
+	// TaxAPIRPS, when positive, caps the requests per second sent to the
+	// tax API by the whole process, from TAX_API_RPS. Calls beyond it wait
+	// their turn rather than fail.
+	TaxAPIRPS float64
+
+	// UpstreamMode is "record" to save every tax API response under
+	// FixturesDir, or "replay" to answer lookups from those recordings
+	// without the network. Empty means live lookups only.
+	UpstreamMode string
+	FixturesDir  string
+
+	// EmptyResultStatus is the status code returned when the upload is
+	// valid but contains no data rows: 200 (empty ZIP) or 204 (no content).
+	EmptyResultStatus int
+
+	// BaseCurrency is the currency taxes are computed in. Rows with a
+	// different value in the optional currency column are converted using
+	// CurrencyRates, which maps a currency code to its value in BaseCurrency.
+	BaseCurrency  string
+	CurrencyRates map[string]float64
+
+	// RateOverrides are loaded from the JSON file named by
+	// RATE_OVERRIDES_FILE and take precedence over upstream rates.
+	RateOverrides []rateOverride
+
+	// JurisdictionAliases maps canonical API jurisdiction names to the
+	// friendlier labels shown in output, loaded from the JSON object in
+	// JURISDICTION_ALIASES_FILE.
+	JurisdictionAliases map[string]string
+
+	// TaxableCaps maps jurisdiction names to the largest portion of a
+	// charge they tax, loaded from the JSON object in TAXABLE_CAPS_FILE.
+	TaxableCaps map[string]float64
+
+	// FIPS, when set, supplies the FIPS code of each jurisdiction for
+	// rate_schedule.csv. FIPS_CODES_FILE loads a fipsTable.
+	FIPS fipsResolver
+
+	// TaxHolidays are exempt date ranges loaded from TAX_HOLIDAYS_FILE.
+	TaxHolidays []taxHoliday
+
+	// MaxCharge, when positive, is the largest charge considered plausible.
+	// MaxChargePolicy decides what happens above it: "flag" adds a warning
+	// to the row, "reject" moves the row to errors.csv.
+	MaxCharge       float64
+	MaxChargePolicy string
+
+	// EmptyClientPolicy decides how rows with a blank client are handled:
+	// "allow" (default), "flag", "reject", which moves the row to
+	// errors.csv, or "placeholder", which replaces the blank with
+	// EmptyClientPlaceholder.
+	EmptyClientPolicy      string
+	EmptyClientPlaceholder string
+
+	// RatePrecision, when non-negative, rounds each parsed jurisdiction
+	// rate to that many decimal places before it is multiplied by the
+	// charge, matching the official calculators. -1 disables quantizing.
+	RatePrecision int
+
+	// TwoDigitYearPivot enables two-digit years in dates when non-negative:
+	// years below the pivot map to 20YY and the rest to 19YY (which the
+	// MinYear floor rejects unless lowered). -1 requires four-digit years.
+	TwoDigitYearPivot int
+
+	// MinYear is the earliest charge year accepted; older dates are
+	// rejected as invalid.
+	MinYear int
+
+	// BusinessStart, when set, rejects rows dated before the business
+	// existed. FutureGraceDays, when non-negative, rejects rows dated more
+	// than that many days after today. Both usually catch typos.
+	BusinessStart   time.Time
+	FutureGraceDays int
+
+	// MaxAttempts is how many times a single lookup is tried when the
+	// upstream API fails transiently.
+	MaxAttempts int
+
+	// RetryBudget is the number of upstream retries one job may spend in
+	// total across all of its rows.
+	RetryBudget int
+
+	// AdminToken guards the debugging endpoints such as GET /cache. They
+	// are disabled when it is empty.
+	AdminToken string
+
+	// BlankCityPolicy handles rows with a street but no city: "warn"
+	// (default) warns and looks the address up anyway, "zip" warns and
+	// looks up by ZIP code alone, and "error" moves the row to errors.csv.
+	BlankCityPolicy string
+
+	// BlankChargePolicy handles rows whose charge cell is empty: "error"
+	// (default) moves the row to errors.csv, "zero" warns and treats it as
+	// 0, and "skip" drops the row without reporting it.
+	BlankChargePolicy string
+
+	// TotalRateSource selects where each row's tax rate comes from:
+	// "jurisdictions" (default) itemizes the API's per-jurisdiction rates,
+	// while "api" taxes the charge once at the API's TOTALTAXRATE, reported
+	// as a single TOTAL column that matches the published combined rate
+	// exactly. Taxable caps and holidays, which name individual
+	// jurisdictions or types, then no longer apply.
+	TotalRateSource string
+
+	// MinTaxAmount, when positive, zeroes per-jurisdiction amounts below
+	// it. MinTaxBucket optionally names a column that collects them.
+	MinTaxAmount float64
+	MinTaxBucket string
+
+	// OutlierFactor, when greater than 1, warns on charges more than that
+	// many times larger or smaller than the file's median charge.
+	OutlierFactor float64
+
+	// ClientChargeRanges maps client names to their usual range of
+	// charges, loaded from the JSON object in CLIENT_CHARGE_RANGES_FILE;
+	// charges outside it are flagged.
+	ClientChargeRanges map[string]chargeRange
+
+	// ExpectedState, for single-state filers, warns on rows in any other
+	// state: a two-letter state code, or "auto" to expect whichever state
+	// most of the file's rows are in.
+	ExpectedState string
+
+	// RateCacheSize caps how many lookups the process-wide rate cache
+	// holds, and RateCacheTTL how long each is trusted before it is looked
+	// up again.
+	RateCacheSize int
+	RateCacheTTL  time.Duration
+
+	// MaxConcurrency is how many rows of a job have their rates looked up
+	// concurrently.
+	MaxConcurrency int
+
+	// OutputWorkers is how many report files are built concurrently before
+	// being written to the ZIP in order.
+	OutputWorkers int
+
+	// ChargeColumns are additional taxable subtotal columns accepted in
+	// uploads, each with its own taxability rule. See parseChargeColumns.
+	ChargeColumns []chargeColumn
+
+	// TaxAPIProxy, when set, is the proxy every upstream call goes
+	// through instead of the one named by HTTP_PROXY/HTTPS_PROXY.
+	TaxAPIProxy *url.URL
+
+	// TaxAPIRootCAs, loaded from TAX_API_CA_FILE, replaces the system
+	// roots when verifying the tax API's certificate. TaxAPIPins, from
+	// TAX_API_PINS, optionally restricts it to specific public keys.
+	TaxAPIRootCAs *x509.CertPool
+	TaxAPIPins    [][]byte
+
+	// ComplianceKey, loaded from COMPLIANCE_SIGNING_KEY_FILE, signs the
+	// compliance report when one is requested.
+	ComplianceKey ed25519.PrivateKey
+}
+
+func loadConfig() (Config, error) {
+	cfg := Config{
+		Port:              os.Getenv("PORT"),
+		AdminToken:        os.Getenv("ADMIN_TOKEN"),
+		MinTaxBucket:      os.Getenv("MIN_TAX_BUCKET"),
+		EmptyResultStatus: http.StatusOK,
+		BaseCurrency:      "USD",
+		CurrencyRates:     map[string]float64{},
+		MaxChargePolicy:   "flag",
+
+		EmptyClientPolicy:      "allow",
+		EmptyClientPlaceholder: "UNKNOWN",
+
+		RatePrecision:     -1,
+		TwoDigitYearPivot: -1,
+		MinYear:           2000,
+		FutureGraceDays:   -1,
+		TaxAPITimeout:     15 * time.Second,
+		MaxAttempts:       4,
+		RetryBudget:       20,
+		BlankCityPolicy:   "warn",
+		BlankChargePolicy: "error",
+		TotalRateSource:   "jurisdictions",
+		MaxConcurrency:    8,
+		RateCacheSize:     10000,
+		RateCacheTTL:      24 * time.Hour,
+		OutputWorkers:     4,
+
+		CORSAllowedOrigins: []string{"https://skeen0711.github.io"},
+	}
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+
+	if v := os.Getenv("ROUTE_PREFIX"); v != "" {
+		prefix := strings.TrimSuffix(v, "/")
+		if prefix != "" && (!strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, " ?#")) {
+			return cfg, fmt.Errorf("invalid ROUTE_PREFIX %q: expected a path such as /api/tax", v)
+		}
+		cfg.RoutePrefix = prefix
+	}
+
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		cfg.CORSAllowedOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+			u, err := url.Parse(origin)
+			if origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+				return cfg, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry %q: expected an origin such as http://localhost:3000, or *", origin)
+			}
+			cfg.CORSAllowedOrigins = append(cfg.CORSAllowedOrigins, origin)
+		}
+	}
+
+	cfg.TaxAPIBaseURL = defaultTaxAPIBaseURL
+	if v := os.Getenv("TAX_API_BASE_URL"); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("invalid TAX_API_BASE_URL %q: expected an http or https URL", v)
+		}
+		cfg.TaxAPIBaseURL = v
+	}
+	cfg.TaxAPIClientID = os.Getenv("TAX_API_CLIENT_ID")
+	cfg.TaxAPIClientSecret = os.Getenv("TAX_API_CLIENT_SECRET")
+	if (cfg.TaxAPIClientID == "" || cfg.TaxAPIClientSecret == "") && os.Getenv("UPSTREAM_MODE") != "replay" {
+		return cfg, fmt.Errorf("missing tax API credentials: set TAX_API_CLIENT_ID and TAX_API_CLIENT_SECRET")
+	}
+
+	if v := os.Getenv("EMPTY_RESULT_STATUS"); v != "" {
+		code, err := strconv.Atoi(v)
+		if err != nil || (code != http.StatusOK && code != http.StatusNoContent) {
+			return cfg, fmt.Errorf("invalid EMPTY_RESULT_STATUS %q: expected 200 or 204", v)
+		}
+		cfg.EmptyResultStatus = code
+	}
+
+	if v := os.Getenv("BASE_CURRENCY"); v != "" {
+		cfg.BaseCurrency = strings.ToUpper(strings.TrimSpace(v))
+	}
+	cfg.CurrencyRates[cfg.BaseCurrency] = 1
+
+	// CURRENCY_RATES is a comma-separated list of CODE:RATE pairs, e.g.
+	// "EUR:1.08,CAD:0.74".
+	if v := os.Getenv("CURRENCY_RATES"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			code, rate, ok := strings.Cut(pair, ":")
+			if !ok {
+				return cfg, fmt.Errorf("invalid CURRENCY_RATES entry %q: expected CODE:RATE", pair)
+			}
+			r, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+			if err != nil || r <= 0 {
+				return cfg, fmt.Errorf("invalid CURRENCY_RATES rate for %s: %q", code, rate)
+			}
+			cfg.CurrencyRates[strings.ToUpper(strings.TrimSpace(code))] = r
+		}
+	}
+
+	if path := os.Getenv("RATE_OVERRIDES_FILE"); path != "" {
+		overrides, err := loadRateOverrides(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.RateOverrides = overrides
+	}
+
+	if path := os.Getenv("JURISDICTION_ALIASES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read jurisdiction aliases: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg.JurisdictionAliases); err != nil {
+			return cfg, fmt.Errorf("failed to parse jurisdiction aliases: %v", err)
+		}
+		// Two jurisdictions under one label would give due_by_charge.csv
+		// duplicate columns and due_by_jurisdiction.csv duplicate rows.
+		names := make([]string, 0, len(cfg.JurisdictionAliases))
+		for name := range cfg.JurisdictionAliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		byLabel := make(map[string]string)
+		for _, name := range names {
+			label := cfg.JurisdictionAliases[name]
+			if other, ok := byLabel[label]; ok {
+				return cfg, fmt.Errorf("invalid jurisdiction aliases: %s and %s are both labeled %q", other, name, label)
+			}
+			byLabel[label] = name
+		}
+	}
+
+	if path := os.Getenv("FIPS_CODES_FILE"); path != "" {
+		table, err := loadFIPSTable(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.FIPS = table
+	}
+
+	if path := os.Getenv("TAXABLE_CAPS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read taxable caps: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg.TaxableCaps); err != nil {
+			return cfg, fmt.Errorf("failed to parse taxable caps: %v", err)
+		}
+		for juris, limit := range cfg.TaxableCaps {
+			if limit < 0 {
+				return cfg, fmt.Errorf("invalid taxable cap for %s: %.2f is negative", juris, limit)
+			}
+		}
+	}
+
+	if path := os.Getenv("TAX_HOLIDAYS_FILE"); path != "" {
+		holidays, err := loadTaxHolidays(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TaxHolidays = holidays
+	}
+
+	if v := os.Getenv("MAX_CHARGE"); v != "" {
+		max, err := strconv.ParseFloat(v, 64)
+		if err != nil || max <= 0 {
+			return cfg, fmt.Errorf("invalid MAX_CHARGE %q: expected a positive amount", v)
+		}
+		cfg.MaxCharge = max
+	}
+	if v := os.Getenv("MAX_CHARGE_POLICY"); v != "" {
+		if v != "flag" && v != "reject" {
+			return cfg, fmt.Errorf("invalid MAX_CHARGE_POLICY %q: expected flag or reject", v)
+		}
+		cfg.MaxChargePolicy = v
+	}
+
+	if v := os.Getenv("EMPTY_CLIENT_POLICY"); v != "" {
+		switch v {
+		case "allow", "flag", "reject", "placeholder":
+			cfg.EmptyClientPolicy = v
+		default:
+			return cfg, fmt.Errorf("invalid EMPTY_CLIENT_POLICY %q: expected allow, flag, reject or placeholder", v)
+		}
+	}
+	if v := os.Getenv("EMPTY_CLIENT_PLACEHOLDER"); v != "" {
+		cfg.EmptyClientPlaceholder = v
+	}
+
+	if v := os.Getenv("RATE_PRECISION"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 0 || p > 12 {
+			return cfg, fmt.Errorf("invalid RATE_PRECISION %q: expected 0-12 decimal places", v)
+		}
+		cfg.RatePrecision = p
+	}
+
+	if v := os.Getenv("TWO_DIGIT_YEAR_PIVOT"); v != "" {
+		pivot, err := strconv.Atoi(v)
+		if err != nil || pivot < 0 || pivot > 100 {
+			return cfg, fmt.Errorf("invalid TWO_DIGIT_YEAR_PIVOT %q: expected 0-100", v)
+		}
+		cfg.TwoDigitYearPivot = pivot
+	}
+
+	if v := os.Getenv("MIN_YEAR"); v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil || year < 1900 || year > time.Now().Year() {
+			return cfg, fmt.Errorf("invalid MIN_YEAR %q: expected a year from 1900 to the current year", v)
+		}
+		cfg.MinYear = year
+	}
+
+	if v := os.Getenv("BUSINESS_START_DATE"); v != "" {
+		start, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid BUSINESS_START_DATE %q: expected YYYY-MM-DD", v)
+		}
+		cfg.BusinessStart = start
+	}
+
+	if v := os.Getenv("FUTURE_DATE_GRACE_DAYS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid FUTURE_DATE_GRACE_DAYS %q: expected a non-negative number of days", v)
+		}
+		cfg.FutureGraceDays = n
+	}
+
+	if v := os.Getenv("TAX_API_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid TAX_API_TIMEOUT %q: expected a positive duration such as 15s", v)
+		}
+		cfg.TaxAPITimeout = d
+	}
+
+	if v := os.Getenv("TAX_API_RPS"); v != "" {
+		rps, err := strconv.ParseFloat(v, 64)
+		if err != nil || rps <= 0 {
+			return cfg, fmt.Errorf("invalid TAX_API_RPS %q: expected a positive number of requests per second", v)
+		}
+		cfg.TaxAPIRPS = rps
+	}
+
+	if v := os.Getenv("UPSTREAM_MODE"); v != "" {
+		switch v {
+		case "record", "replay":
+			cfg.UpstreamMode = v
+		default:
+			return cfg, fmt.Errorf("invalid UPSTREAM_MODE %q: expected record or replay", v)
+		}
+		cfg.FixturesDir = os.Getenv("UPSTREAM_FIXTURES_DIR")
+		if cfg.FixturesDir == "" {
+			return cfg, fmt.Errorf("UPSTREAM_MODE=%s requires UPSTREAM_FIXTURES_DIR", v)
+		}
+		if err := os.MkdirAll(cfg.FixturesDir, 0o755); err != nil {
+			return cfg, fmt.Errorf("failed to create UPSTREAM_FIXTURES_DIR: %v", err)
+		}
+	}
+
+	if v := os.Getenv("MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid MAX_ATTEMPTS %q: expected a positive count", v)
+		}
+		cfg.MaxAttempts = n
+	}
+
+	if v := os.Getenv("RETRY_BUDGET"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid RETRY_BUDGET %q: expected a non-negative count", v)
+		}
+		cfg.RetryBudget = n
+	}
+
+	if v := os.Getenv("BLANK_CITY_POLICY"); v != "" {
+		switch v {
+		case "warn", "zip", "error":
+			cfg.BlankCityPolicy = v
+		default:
+			return cfg, fmt.Errorf("invalid BLANK_CITY_POLICY %q: expected warn, zip or error", v)
+		}
+	}
+
+	if v := os.Getenv("BLANK_CHARGE_POLICY"); v != "" {
+		switch v {
+		case "error", "zero", "skip":
+			cfg.BlankChargePolicy = v
+		default:
+			return cfg, fmt.Errorf("invalid BLANK_CHARGE_POLICY %q: expected error, zero or skip", v)
+		}
+	}
+
+	if v := os.Getenv("TOTAL_RATE_SOURCE"); v != "" {
+		switch v {
+		case "jurisdictions", "api":
+			cfg.TotalRateSource = v
+		default:
+			return cfg, fmt.Errorf("invalid TOTAL_RATE_SOURCE %q: expected jurisdictions or api", v)
+		}
+	}
+
+	if v := os.Getenv("MIN_TAX_AMOUNT"); v != "" {
+		min, err := strconv.ParseFloat(v, 64)
+		if err != nil || min < 0 {
+			return cfg, fmt.Errorf("invalid MIN_TAX_AMOUNT %q: expected a non-negative amount", v)
+		}
+		cfg.MinTaxAmount = min
+	}
+
+	if v := os.Getenv("CHARGE_OUTLIER_FACTOR"); v != "" {
+		factor, err := strconv.ParseFloat(v, 64)
+		if err != nil || factor <= 1 {
+			return cfg, fmt.Errorf("invalid CHARGE_OUTLIER_FACTOR %q: expected a number greater than 1", v)
+		}
+		cfg.OutlierFactor = factor
+	}
+
+	if path := os.Getenv("CLIENT_CHARGE_RANGES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to read client charge ranges: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg.ClientChargeRanges); err != nil {
+			return cfg, fmt.Errorf("failed to parse client charge ranges: %v", err)
+		}
+		for client, r := range cfg.ClientChargeRanges {
+			if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+				return cfg, fmt.Errorf("invalid charge range for client %s: min %.2f exceeds max %.2f", client, *r.Min, *r.Max)
+			}
+		}
+	}
+
+	if v := os.Getenv("EXPECTED_STATE"); v != "" {
+		if v != "auto" && (len(v) != 2 || strings.ToUpper(v) != v) {
+			return cfg, fmt.Errorf("invalid EXPECTED_STATE %q: expected a two-letter state code such as TX, or auto", v)
+		}
+		cfg.ExpectedState = v
+	}
+
+	if v := os.Getenv("MAX_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid MAX_CONCURRENCY %q: expected a positive count", v)
+		}
+		cfg.MaxConcurrency = n
+	}
+
+	if v := os.Getenv("RATE_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid RATE_CACHE_SIZE %q: expected a positive count", v)
+		}
+		cfg.RateCacheSize = n
+	}
+
+	if v := os.Getenv("RATE_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid RATE_CACHE_TTL %q: expected a positive duration such as 24h", v)
+		}
+		cfg.RateCacheTTL = d
+	}
+
+	if v := os.Getenv("OUTPUT_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid OUTPUT_WORKERS %q: expected a positive count", v)
+		}
+		cfg.OutputWorkers = n
+	}
+
+	if v := os.Getenv("CHARGE_COLUMNS"); v != "" {
+		columns, err := parseChargeColumns(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ChargeColumns = columns
+	}
+
+	if v := os.Getenv("TAX_API_PROXY"); v != "" {
+		proxy, ok := parseProxyURL(v)
+		if !ok {
+			return cfg, fmt.Errorf("invalid TAX_API_PROXY %q: expected an http or https URL", v)
+		}
+		cfg.TaxAPIProxy = proxy
+	}
+
+	if path := os.Getenv("COMPLIANCE_SIGNING_KEY_FILE"); path != "" {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ComplianceKey = key
+	}
+
+	if path := os.Getenv("TAX_API_CA_FILE"); path != "" {
+		pool, err := loadCAFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TaxAPIRootCAs = pool
+	}
+
+	if v := os.Getenv("TAX_API_PINS"); v != "" {
+		pins, err := parsePins(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TaxAPIPins = pins
+	}
+
+	return cfg, nil
+}
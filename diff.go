@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// chargeReportColumns are the non-jurisdiction columns due_by_charge.csv
+// may contain besides requiredColumns and the configured charge columns.
+var chargeReportColumns = []string{"period", "currency", "original charge", "net charge", "exemption", "warnings", "lookup ms"}
+
+// chargeReport is a previously produced due_by_charge.csv reduced to the
+// totals the delta report compares.
+type chargeReport struct {
+	clients       map[string]float64
+	jurisdictions map[string]float64
+}
+
+// readChargeReport parses a due_by_charge.csv. Every column that isn't a
+// known report column is treated as a jurisdiction; a client's total is the
+// sum of its jurisdiction amounts over all of its rows. Amounts must be
+// plain numbers, as written with the default number format.
+func readChargeReport(r io.Reader, cfg Config) (chargeReport, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return chargeReport{}, fmt.Errorf("error reading header: %v", err)
+	}
+	// Reports written with excel_bom=true start with a byte order mark.
+	header[0] = strings.TrimPrefix(header[0], utf8BOM)
+
+	known := append(append([]string{}, requiredColumns...), chargeReportColumns...)
+	for _, col := range cfg.ChargeColumns {
+		known = append(known, col.Name, col.Name+" tax", "original "+col.Name)
+	}
+	clientCol := slices.Index(header, "client")
+	if clientCol < 0 {
+		return chargeReport{}, errors.New(`missing "client" column: expected a due_by_charge.csv report`)
+	}
+	var jurisCols []int
+	for i, name := range header {
+		if slices.Contains(known, name) {
+			continue
+		}
+		// include_rates pairs each jurisdiction with a rate column.
+		if juris, ok := strings.CutSuffix(name, " rate"); ok && slices.Contains(header, juris) {
+			continue
+		}
+		jurisCols = append(jurisCols, i)
+	}
+
+	report := chargeReport{
+		clients:       make(map[string]float64),
+		jurisdictions: make(map[string]float64),
+	}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return chargeReport{}, err
+		}
+		client := row[clientCol]
+		if _, ok := report.clients[client]; !ok {
+			report.clients[client] = 0
+		}
+		for _, i := range jurisCols {
+			if row[i] == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(row[i], 64)
+			if err != nil {
+				return chargeReport{}, fmt.Errorf("invalid %s amount for client %s: %q", header[i], client, row[i])
+			}
+			report.clients[client] += v
+			report.jurisdictions[header[i]] += v
+		}
+	}
+	return report, nil
+}
+
+// deltaRows compares two charge reports, listing new and removed clients,
+// clients whose total changed, and jurisdictions that no longer appear.
+func (rp reporter) deltaRows(prev, cur chargeReport) [][]string {
+	rows := [][]string{{"change", "name", "previous", "current", "difference"}}
+
+	clients := make([]string, 0, len(prev.clients)+len(cur.clients))
+	for client := range prev.clients {
+		clients = append(clients, client)
+	}
+	for client := range cur.clients {
+		if _, ok := prev.clients[client]; !ok {
+			clients = append(clients, client)
+		}
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		before, hadBefore := prev.clients[client]
+		after, hasNow := cur.clients[client]
+		switch {
+		case !hadBefore:
+			rows = append(rows, []string{"new client", client, "", rp.amount(after), rp.amount(after)})
+		case !hasNow:
+			rows = append(rows, []string{"removed client", client, rp.amount(before), "", rp.amount(-before)})
+		case rp.amount(before) != rp.amount(after):
+			rows = append(rows, []string{"changed total", client, rp.amount(before), rp.amount(after), rp.amount(after - before)})
+		}
+	}
+
+	var gone []string
+	for juris := range prev.jurisdictions {
+		if _, ok := cur.jurisdictions[juris]; !ok {
+			gone = append(gone, juris)
+		}
+	}
+	sort.Strings(gone)
+	for _, juris := range gone {
+		before := prev.jurisdictions[juris]
+		rows = append(rows, []string{"removed jurisdiction", juris, rp.amount(before), "", rp.amount(-before)})
+	}
+	return rows
+}
+
+// diffHandler serves POST /diff, comparing two due_by_charge.csv reports
+// uploaded as "previous" and "current" and returning delta.csv.
+func (s *server) diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	opts, err := parseRequestOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var reports [2]chargeReport
+	for i, field := range []string{"previous", "current"} {
+		file, _, err := r.FormFile(field)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Missing file: upload a due_by_charge.csv in a multipart form field named %q", field), http.StatusBadRequest)
+			return
+		}
+		reports[i], err = readChargeReport(file, s.cfg)
+		file.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading %s: %v", field, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rp := reporter{cfg: s.cfg, opts: opts}
+	data, err := rp.encodeCSV(rp.deltaRows(reports[0], reports[1]))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error writing delta.csv: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"delta.csv\"")
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing delta.csv to response: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A report downloaded with excel_bom=true must still be accepted by /diff.
+func TestReadChargeReportWithBOM(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=charge&excel_bom=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	data := unzip(t, w.Body.Bytes())["due_by_charge.csv"]
+	if !strings.HasPrefix(data, utf8BOM) {
+		t.Fatalf("due_by_charge.csv doesn't start with a BOM: %q", data)
+	}
+
+	report, err := readChargeReport(strings.NewReader(data), s.cfg)
+	if err != nil {
+		t.Fatalf("readChargeReport: %v", err)
+	}
+	if got := report.clients["Acme"]; got != 7.25 {
+		t.Errorf("Acme total = %v, want 7.25", got)
+	}
+	if got := report.jurisdictions["TEXAS STATE"]; got != 6.25 {
+		t.Errorf("TEXAS STATE total = %v, want 6.25", got)
+	}
+}
+
+func TestDiffReportsChanges(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	previous := "client,date,charge,street address,city,State,zip code,AUSTIN,HARRIS CO,TEXAS STATE\n" +
+		"Acme,1/15/2024,100.00,1 Main St,Austin,TX,78701,1.00,,6.25\n" +
+		"Bolt,1/16/2024,100.00,2 Main St,Austin,TX,78701,1.00,0.50,6.25\n" +
+		"Cole,1/17/2024,100.00,3 Main St,Austin,TX,78701,1.00,,6.25\n"
+	current := "client,date,charge,street address,city,State,zip code,warnings,AUSTIN,AUSTIN rate,TEXAS STATE\n" +
+		"Acme,1/15/2024,100.00,1 Main St,Austin,TX,78701,,1.00,0.01,6.25\n" +
+		"Bolt,1/16/2024,200.00,2 Main St,Austin,TX,78701,,2.00,0.01,12.50\n" +
+		"Dove,1/18/2024,10.00,4 Main St,Austin,TX,78701,,0.10,0.01,0.63\n"
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for field, data := range map[string]string{"previous": previous, "current": current} {
+		part, _ := mw.CreateFormFile(field, field+".csv")
+		part.Write([]byte(data))
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/diff", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.diffHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	want := [][]string{
+		{"change", "name", "previous", "current", "difference"},
+		{"changed total", "Bolt", "7.75", "14.50", "6.75"},
+		{"removed client", "Cole", "7.25", "", "-7.25"},
+		{"new client", "Dove", "", "0.73", "0.73"},
+		{"removed jurisdiction", "HARRIS CO", "0.50", "", "-0.50"},
+	}
+	if rows := readCSV(t, w.Body.String()); !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("delta.csv = %v, want %v", rows, want)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// fipsResolver supplies FIPS codes for the jurisdictions the tax API
+// returns, which its responses don't include. Implementations may key on
+// the jurisdiction alone or on the address it was returned for.
+type fipsResolver interface {
+	// fipsCode returns the FIPS code of rate's jurisdiction at addr, or ""
+	// when it isn't known.
+	fipsCode(addr rateKey, rate jurisdictionRate) string
+}
+
+// fipsTable resolves FIPS codes by jurisdiction name.
+type fipsTable map[string]string
+
+func (t fipsTable) fipsCode(_ rateKey, rate jurisdictionRate) string {
+	return t[rate.Name]
+}
+
+// loadFIPSTable reads a JSON object mapping jurisdiction names, as
+// returned by the API, to FIPS codes.
+func loadFIPSTable(path string) (fipsTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FIPS codes: %v", err)
+	}
+	var table fipsTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("failed to parse FIPS codes: %v", err)
+	}
+	return table, nil
+}
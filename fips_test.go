@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// zipFIPS resolves city FIPS codes by ZIP code, as a resolver backed by an
+// address service might.
+type zipFIPS map[string]string
+
+func (z zipFIPS) fipsCode(addr rateKey, rate jurisdictionRate) string {
+	if rate.Type != "CITY" {
+		return "48"
+	}
+	return z[addr.Zip]
+}
+
+func TestRateScheduleUsesFIPSResolver(t *testing.T) {
+	rp := reporter{cfg: Config{FIPS: zipFIPS{"78701": "4805000"}}}
+	rates := []jurisdictionRate{{"TEXAS STATE", "STATE", 0.0625}, {"AUSTIN", "CITY", 0.01}}
+	records := []TaxRecord{
+		{Street: "1 Main St", City: "Austin", State: "TX", Zip: "78701", Quarter: 1, Year: 2024, Rates: rates},
+		{Street: "9 Elm St", City: "Austin", State: "TX", Zip: "78799", Quarter: 1, Year: 2024, Rates: rates},
+	}
+	rows := rp.rateScheduleRows(records)
+	if rows[0][len(rows[0])-1] != "fips" {
+		t.Fatalf("header = %v, want a trailing fips column", rows[0])
+	}
+	var got []string
+	for _, row := range rows[1:] {
+		got = append(got, row[6]+"="+row[len(row)-1])
+	}
+	want := []string{"TEXAS STATE=48", "AUSTIN=4805000", "TEXAS STATE=48", "AUSTIN="}
+	if !slices.Equal(got, want) {
+		t.Errorf("fips by jurisdiction = %v, want %v", got, want)
+	}
+}
+
+func TestFIPSCodesFileAddsColumn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fips.json")
+	if err := os.WriteFile(path, []byte(`{"TEXAS STATE": "48", "AUSTIN": "4805000"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"FIPS_CODES_FILE": path})
+	w := postCSV(t, s, "include=charge&rate_schedule=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["rate_schedule.csv"])
+	want := [][]string{
+		{"street address", "city", "State", "zip code", "quarter", "year", "jurisdiction", "type", "rate", "fips"},
+		{"1 Main St", "Austin", "TX", "78701", "1", "2024", "TEXAS STATE", "STATE", "0.0625", "48"},
+		{"1 Main St", "Austin", "TX", "78701", "1", "2024", "AUSTIN", "CITY", "0.01", "4805000"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("rate_schedule.csv = %v, want %v", rows, want)
+	}
+}
+
+func TestLoadFIPSTableRejectsMalformedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fips.json")
+	if err := os.WriteFile(path, []byte(`["48"]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFIPSTable(path); err == nil {
+		t.Error("loadFIPSTable accepted a JSON array")
+	}
+	if _, err := loadFIPSTable(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadFIPSTable accepted a missing file")
+	}
+}
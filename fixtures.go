@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fixture is a recorded upstream response.
+type fixture struct {
+	Query      string `json:"query"`
+	StatusCode int    `json:"status"`
+	Body       string `json:"body"`
+}
+
+// errFixtureMissing is returned in replay mode for a lookup that was never
+// recorded. Replaying again can't find it, so it is not retried.
+var errFixtureMissing = errors.New("no recorded response")
+
+// fixtureTransport records upstream responses to dir (mode "record") or
+// serves them from dir without touching the network (mode "replay").
+// Fixtures are keyed by the lookup's query string, i.e. the address and
+// period; credentials are sent as headers and never stored. When recording,
+// requests other than GET (the health check's HEAD) pass through unrecorded.
+type fixtureTransport struct {
+	mode string
+	dir  string
+	next http.RoundTripper
+}
+
+// fixturePath names the fixture for a lookup by a hash of its query.
+func (t *fixtureTransport) fixturePath(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.URL.Query().Encode()))
+	return filepath.Join(t.dir, hex.EncodeToString(sum[:16])+".json")
+}
+
+func (t *fixtureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.mode == "record" && req.Method != http.MethodGet {
+		return t.next.RoundTrip(req)
+	}
+	path := t.fixturePath(req)
+	if t.mode == "replay" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %v", errFixtureMissing, req.URL.RawQuery, err)
+		}
+		var f fixture
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", f.StatusCode, http.StatusText(f.StatusCode)),
+			StatusCode:    f.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        make(http.Header),
+			Body:          io.NopCloser(strings.NewReader(f.Body)),
+			ContentLength: int64(len(f.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	data, err := json.MarshalIndent(fixture{Query: req.URL.Query().Encode(), StatusCode: resp.StatusCode, Body: string(body)}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to record fixture %s: %v", path, err)
+	}
+	return resp, nil
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames
+// it into place, so a failure partway leaves no truncated file behind for a
+// later replay to trip over.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordThenReplayOffline(t *testing.T) {
+	dir := t.TempDir()
+	upload := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,4/02/2024,250,9 Oak Ave,Austin,TX,78702\n"
+
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"UPSTREAM_MODE": "record", "UPSTREAM_FIXTURES_DIR": dir})
+	recorded := unzip(t, postCSV(t, s, "include=client,charge", upload).Body.Bytes())
+	if n := api.calls.Load(); n != 2 {
+		t.Fatalf("recording made %d lookups, want 2", n)
+	}
+	fixtures, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(fixtures) != 2 {
+		t.Fatalf("recorded %d fixtures, want one per address: %v", len(fixtures), fixtures)
+	}
+	for _, path := range fixtures {
+		data, _ := os.ReadFile(path)
+		if strings.Contains(string(data), "test-secret") {
+			t.Errorf("fixture %s stores the client secret", filepath.Base(path))
+		}
+	}
+
+	offline := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("replay reached the network: %s", r.URL)
+	})
+	s = newTestServer(t, offline, map[string]string{
+		"UPSTREAM_MODE":         "replay",
+		"UPSTREAM_FIXTURES_DIR": dir,
+		"TAX_API_CLIENT_SECRET": "",
+	})
+	replayed := unzip(t, postCSV(t, s, "include=client,charge", upload).Body.Bytes())
+	for _, name := range []string{"due_by_charge.csv", "due_by_client.csv"} {
+		if replayed[name] != recorded[name] || recorded[name] == "" {
+			t.Errorf("%s replayed as %q, recorded as %q", name, replayed[name], recorded[name])
+		}
+	}
+
+	// An address that was never recorded fails rather than going online.
+	files := unzip(t, postCSV(t, s, "", testHeader+"Cole,1/15/2024,100,5 Elm St,Austin,TX,78703\n").Body.Bytes())
+	if !strings.Contains(files["errors.csv"], "no recorded response") {
+		t.Errorf("errors.csv = %q, want the missing fixture reported", files["errors.csv"])
+	}
+}
+
+func TestReplayMissIsNotRetried(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{
+		"UPSTREAM_MODE":         "replay",
+		"UPSTREAM_FIXTURES_DIR": t.TempDir(),
+		"MAX_ATTEMPTS":          "4",
+	})
+	w := postCSV(t, s, "", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	var summary jobSummary
+	if err := json.Unmarshal([]byte(w.Header().Get("X-Tax-Summary")), &summary); err != nil {
+		t.Fatalf("X-Tax-Summary: %v", err)
+	}
+	if summary.APICalls != 1 || summary.Skipped != 1 {
+		t.Errorf("summary = %+v, want the miss skipped after one attempt", summary)
+	}
+	// http.Client wraps the transport's error in a *url.Error.
+	if isTransient(fmt.Errorf("failed to fetch tax rates: %w", &url.Error{Op: "Get", Err: errFixtureMissing})) {
+		t.Error("a missing fixture is treated as transient")
+	}
+}
+
+func TestWriteFileAtomicLeavesNoPartialFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fixture.json")
+	if err := writeFileAtomic(path, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("fixture = %q, want it replaced", data)
+	}
+
+	// A non-empty directory in the way makes the final rename fail after
+	// the data has been written out.
+	blocked := filepath.Join(dir, "blocked.json")
+	if err := os.MkdirAll(filepath.Join(blocked, "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(blocked, []byte("partial")); err == nil {
+		t.Fatal("write over a directory succeeded")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+	if info, err := os.Stat(blocked); err != nil || !info.IsDir() {
+		t.Errorf("failed write disturbed %s", blocked)
+	}
+}
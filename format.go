@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/message"
+)
+
+// formatAmount renders a monetary value for output according to the
+// request's number format. In "trim" mode whole amounts lose their ".00"
+// suffix, but any non-zero cents are always kept as two digits.
+func formatAmount(v float64, opts requestOptions) string {
+	s := fmt.Sprintf("%.2f", v)
+	if opts.NumberFormat == "trim" {
+		s = strings.TrimSuffix(s, ".00")
+		if s == "-0" {
+			s = "0"
+		}
+	}
+	return s
+}
+
+// formatLocalized renders a monetary value with the grouping, decimal
+// separator and currency symbol conventions of the request's locale, e.g.
+// "$ 1,234.50" for en-US or "$ 1.234,50" for de-DE.
+func formatLocalized(v float64, opts requestOptions, currencyCode string) string {
+	p := message.NewPrinter(*opts.Locale)
+	unit, err := currency.ParseISO(currencyCode)
+	if err != nil {
+		return p.Sprintf("%.2f", v)
+	}
+	return p.Sprint(currency.Symbol(unit.Amount(v)))
+}
+
+// currencySymbol returns the narrow symbol of the ISO currency code, such
+// as "$" for USD or "€" for EUR, or "" for an unknown code.
+func currencySymbol(code string) string {
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprint(currency.NarrowSymbol(unit))
+}
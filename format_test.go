@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestFormatAmountTrim(t *testing.T) {
+	tests := []struct {
+		v     float64
+		fixed string
+		trim  string
+	}{
+		{12, "12.00", "12"},
+		{12.5, "12.50", "12.50"},
+		{0.07, "0.07", "0.07"},
+		{-3, "-3.00", "-3"},
+		{-0.001, "-0.00", "0"},
+	}
+	for _, tt := range tests {
+		if got := formatAmount(tt.v, requestOptions{NumberFormat: "fixed"}); got != tt.fixed {
+			t.Errorf("fixed %v = %q, want %q", tt.v, got, tt.fixed)
+		}
+		if got := formatAmount(tt.v, requestOptions{NumberFormat: "trim"}); got != tt.trim {
+			t.Errorf("trim %v = %q, want %q", tt.v, got, tt.trim)
+		}
+	}
+}
+
+func TestFormatLocalized(t *testing.T) {
+	tests := []struct {
+		locale, currency string
+		v                float64
+		want             string
+	}{
+		{"en-US", "USD", 1234.5, "$ 1,234.50"},
+		{"de-DE", "USD", 1234.5, "$ 1.234,50"},
+		{"de-DE", "EUR", -1234.5, "€ -1.234,50"},
+		{"en-US", "XXX-not-a-code", 1234.5, "1,234.50"},
+	}
+	for _, tt := range tests {
+		tag := language.MustParse(tt.locale)
+		if got := formatLocalized(tt.v, requestOptions{Locale: &tag}, tt.currency); got != tt.want {
+			t.Errorf("%s %s %v = %q, want %q", tt.locale, tt.currency, tt.v, got, tt.want)
+		}
+	}
+}
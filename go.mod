@@ -2,7 +2,10 @@ module taxParser
 
 go 1.24
 
-require github.com/PuerkitoBio/goquery v1.10.2
+require (
+	github.com/PuerkitoBio/goquery v1.10.2
+	golang.org/x/text v0.22.0
+)
 
 require (
 	github.com/andybalholm/cascadia v1.3.3 // indirect
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipSkipsCompressedTypes(t *testing.T) {
+	for _, contentType := range []string{"text/csv", "application/json", "application/zip", xlsxContentType} {
+		h := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Write([]byte("payload"))
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		gzipped := w.Header().Get("Content-Encoding") == "gzip"
+		wantGzip := contentType == "text/csv" || contentType == "application/json"
+		if gzipped != wantGzip {
+			t.Errorf("%s: gzipped = %v, want %v", contentType, gzipped, wantGzip)
+		}
+		if !gzipped && w.Body.String() != "payload" {
+			t.Errorf("%s: body = %q, want it unchanged", contentType, w.Body)
+		}
+	}
+}
+
+func TestGzipResponseDecodes(t *testing.T) {
+	payload := strings.Repeat("client,date,charge\n", 200)
+	ts := httptest.NewServer(gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, payload)
+	})))
+	defer ts.Close()
+	// Without DisableCompression the transport would decompress for us and
+	// hide the Content-Encoding header.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	for _, accept := range []string{"gzip", "deflate", "gzip;q=0", ""} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = resp.Body
+		wantGzip := accept == "gzip"
+		if gzipped := resp.Header.Get("Content-Encoding") == "gzip"; gzipped != wantGzip {
+			t.Errorf("Accept-Encoding %q: gzipped = %v, want %v", accept, gzipped, wantGzip)
+		} else if gzipped {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("Accept-Encoding %q: %v", accept, err)
+			}
+		}
+		data, err := io.ReadAll(body)
+		resp.Body.Close()
+		if err != nil || string(data) != payload {
+			t.Errorf("Accept-Encoding %q: body of %d bytes (%v), want the %d byte payload", accept, len(data), err, len(payload))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds the upstream connectivity probe, so a hung API
+// fails the probe well before a load balancer's own timeout.
+const healthCheckTimeout = 3 * time.Second
+
+// healthCheckTTL is how long a successful upstream probe is trusted, so
+// frequent probes don't each reach the tax API.
+const healthCheckTTL = 30 * time.Second
+
+// healthHandler serves GET /healthz. It reports 200 while the process is
+// up; with ?upstream=1 it also checks that the tax API answers a HEAD
+// request, reporting 503 when it can't be reached. Any HTTP response counts
+// as reachable: the probe tests connectivity, not credentials.
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := struct {
+		Status   string `json:"status"`
+		Upstream string `json:"upstream,omitempty"`
+	}{Status: "ok"}
+	status := http.StatusOK
+	if r.URL.Query().Get("upstream") == "1" {
+		if err := s.checkUpstream(r.Context()); err != nil {
+			log.Printf("Health check: tax API unreachable: %v", err)
+			resp.Status, resp.Upstream = "unavailable", err.Error()
+			status = http.StatusServiceUnavailable
+		} else {
+			resp.Upstream = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error writing health response: %v", err)
+	}
+}
+
+// checkUpstream probes TAX_API_BASE_URL unless a probe succeeded within
+// healthCheckTTL. With UPSTREAM_MODE=replay the API is never called, so
+// there is nothing to check.
+func (s *server) checkUpstream(ctx context.Context) error {
+	if s.cfg.UpstreamMode == "replay" {
+		return nil
+	}
+	if last := s.upstreamOK.Load(); last != 0 && time.Since(time.Unix(0, last)) < healthCheckTTL {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.cfg.TaxAPIBaseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.upstream.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	s.upstreamOK.Store(time.Now().UnixNano())
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	var probes atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("probe sent a %s request", r.Method)
+		}
+		probes.Add(1)
+		w.WriteHeader(http.StatusMethodNotAllowed) // any answer means reachable
+	})
+	s := newTestServer(t, api, nil)
+	check := func(query string) (int, map[string]string) {
+		w := httptest.NewRecorder()
+		s.healthHandler(w, httptest.NewRequest(http.MethodGet, "/healthz"+query, nil))
+		var body map[string]string
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	if code, body := check(""); code != http.StatusOK || body["status"] != "ok" || probes.Load() != 0 {
+		t.Errorf("liveness: %d %v after %d probes, want 200 ok without probing", code, body, probes.Load())
+	}
+	for range 3 {
+		if code, body := check("?upstream=1"); code != http.StatusOK || body["upstream"] != "ok" {
+			t.Errorf("healthy upstream: %d %v", code, body)
+		}
+	}
+	if n := probes.Load(); n != 1 {
+		t.Errorf("upstream probed %d times, want 1 while the last success is fresh", n)
+	}
+
+	// A server whose API has gone away.
+	down := httptest.NewServer(api)
+	down.Close()
+	s.cfg.TaxAPIBaseURL = down.URL
+	s.upstreamOK.Store(0)
+	if code, body := check("?upstream=1"); code != http.StatusServiceUnavailable || body["status"] != "unavailable" || body["upstream"] == "" {
+		t.Errorf("unreachable upstream: %d %v, want 503 with the error", code, body)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var usageTemplate = template.Must(template.New("usage").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Texas sales tax calculator</title></head>
+<body>
+<h1>Texas sales tax calculator</h1>
+<p>This endpoint computes Texas sales tax for a CSV of charges. Send a
+<code>POST</code> with a <code>multipart/form-data</code> body containing the
+file in a field named <code>csvFile</code>; the response is a ZIP of CSV
+reports.</p>
+<p>The CSV header must include these columns, in any order:</p>
+<pre>{{.Columns}}</pre>
+<p>These optional columns are also recognized:</p>
+<pre>{{.Optional}}</pre>
+<p>Any other column is ignored, or rejected with <code>strict_columns=true</code>.</p>
+<p>Example:</p>
+<pre>curl -F csvFile=@charges.csv -o tax_results.zip {{.URL}}</pre>
+</body>
+</html>
+`))
+
+// writeUsage serves a short HTML page explaining how to call the endpoint,
+// for people who open it in a browser.
+func (s *server) writeUsage(w http.ResponseWriter, r *http.Request) {
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	data := struct {
+		Columns  string
+		Optional string
+		URL      string
+	}{
+		Columns:  strings.Join(requiredColumns, ","),
+		Optional: strings.Join(append(slices.Clone(optionalColumns), chargeColumnNames(s.cfg.ChargeColumns)...), ","),
+		URL:      scheme + "://" + r.Host + r.URL.Path,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := usageTemplate.Execute(w, data); err != nil {
+		log.Printf("Error writing usage page: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUsagePageListsColumns(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"CHARGE_COLUMNS": "goods=all;services=STATE"})
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, httptest.NewRequest(http.MethodGet, "/getTaxRates", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	page := w.Body.String()
+	for _, want := range []string{"in any order", strings.Join(requiredColumns, ","), "currency,goods,services", "strict_columns"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("usage page lacks %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "in order:") {
+		t.Error("usage page still says the columns must be in order")
+	}
+}
+
+func TestUsagePageExampleURL(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	req := httptest.NewRequest(http.MethodGet, "https://tax.example.com/api/getTaxRates?x=<b>", nil)
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if page := w.Body.String(); !strings.Contains(page, "-o tax_results.zip https://tax.example.com/api/getTaxRates</pre>") {
+		t.Errorf("usage page lacks the example URL:\n%s", page)
+	}
+
+	w = httptest.NewRecorder()
+	s.taxRatesHandler(w, httptest.NewRequest(http.MethodPut, "/getTaxRates", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: status = %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// taxHoliday is a date range during which charges are exempt from tax in
+// the listed jurisdiction types (e.g. "STATE", "CITY"). An empty Types list
+// exempts every jurisdiction.
+type taxHoliday struct {
+	Name  string   `json:"name"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Types []string `json:"types"`
+
+	start, end time.Time
+}
+
+// loadTaxHolidays reads the JSON holiday list at path. Start and End are
+// inclusive dates in YYYY-MM-DD form.
+func loadTaxHolidays(path string) ([]taxHoliday, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tax holidays: %v", err)
+	}
+	var holidays []taxHoliday
+	if err := json.Unmarshal(data, &holidays); err != nil {
+		return nil, fmt.Errorf("failed to parse tax holidays: %v", err)
+	}
+	for i := range holidays {
+		h := &holidays[i]
+		if h.start, err = time.Parse("2006-01-02", h.Start); err != nil {
+			return nil, fmt.Errorf("invalid start date for tax holiday %q: %v", h.Name, err)
+		}
+		if h.end, err = time.Parse("2006-01-02", h.End); err != nil {
+			return nil, fmt.Errorf("invalid end date for tax holiday %q: %v", h.Name, err)
+		}
+		if h.end.Before(h.start) {
+			return nil, fmt.Errorf("tax holiday %q ends before it starts", h.Name)
+		}
+	}
+	return holidays, nil
+}
+
+// applies reports whether the holiday exempts a jurisdiction of the given
+// type on date.
+func (h taxHoliday) applies(date time.Time, jurisType string) bool {
+	if date.Before(h.start) || date.After(h.end) {
+		return false
+	}
+	if len(h.Types) == 0 {
+		return true
+	}
+	for _, t := range h.Types {
+		if strings.EqualFold(t, jurisType) {
+			return true
+		}
+	}
+	return false
+}
+
+// holidayFor returns the first configured holiday exempting jurisdiction
+// type jurisType on date, or nil.
+func holidayFor(holidays []taxHoliday, date time.Time, jurisType string) *taxHoliday {
+	for i := range holidays {
+		if holidays[i].applies(date, jurisType) {
+			return &holidays[i]
+		}
+	}
+	return nil
+}
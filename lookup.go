@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type lookupRateJSON struct {
+	Name string  `json:"name"`
+	Type string  `json:"type"`
+	Rate float64 `json:"rate"`
+}
+
+// lookupHandler serves GET /lookup, returning the jurisdiction rates for a
+// single address and period as JSON. It resolves through the same cache,
+// overrides and retries as CSV rows.
+func (s *server) lookupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	rec := TaxRecord{
+		Street: strings.TrimSpace(q.Get("street")),
+		City:   strings.TrimSpace(q.Get("city")),
+		State:  strings.TrimSpace(q.Get("state")),
+		Zip:    strings.TrimSpace(q.Get("zip")),
+	}
+	var missing []string
+	for _, p := range []struct{ name, value string }{{"state", rec.State}, {"zip", rec.Zip}, {"quarter", q.Get("quarter")}, {"year", q.Get("year")}} {
+		if p.value == "" {
+			missing = append(missing, p.name)
+		}
+	}
+	if len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("Missing parameters: %s (usage: /lookup?street=...&city=...&state=...&zip=...&quarter=1-4&year=YYYY)", strings.Join(missing, ", ")), http.StatusBadRequest)
+		return
+	}
+	quarter, err := strconv.Atoi(q.Get("quarter"))
+	if err != nil || quarter < 1 || quarter > 4 {
+		http.Error(w, fmt.Sprintf("invalid quarter %q: expected 1-4", q.Get("quarter")), http.StatusBadRequest)
+		return
+	}
+	year, err := strconv.Atoi(q.Get("year"))
+	if err != nil || year < s.cfg.MinYear {
+		http.Error(w, fmt.Sprintf("invalid year %q: expected %d or later", q.Get("year"), s.cfg.MinYear), http.StatusBadRequest)
+		return
+	}
+	rec.Quarter, rec.Year = quarter, year
+
+	rates, err := s.newResolver(requestOptions{}).resolve(r.Context(), &rec)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errAddressNotGeocoded) {
+			status = http.StatusUnprocessableEntity
+		}
+		http.Error(w, fmt.Sprintf("Error looking up tax rates: %v", err), status)
+		return
+	}
+
+	resp := struct {
+		Rates []lookupRateJSON `json:"rates"`
+		Total float64          `json:"total"`
+	}{Rates: []lookupRateJSON{}}
+	for _, rate := range rates {
+		resp.Rates = append(resp.Rates, lookupRateJSON(rate))
+		resp.Total += rate.Rate
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Error writing lookup response: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupEndpoint(t *testing.T) {
+	var got http.Header
+	var query string
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, query = r.Header, r.URL.RawQuery
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, nil)
+	lookup := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.lookupHandler(w, httptest.NewRequest(method, "/lookup?"+query, nil))
+		return w
+	}
+
+	w := lookup(http.MethodGet, "street=1+Main+St&city=Austin&state=TX&zip=78701&quarter=2&year=2024")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Rates []lookupRateJSON
+		Total float64
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rates) != 2 || resp.Rates[0].Name != "TEXAS STATE" || math.Abs(resp.Total-0.0725) > 1e-12 {
+		t.Errorf("response = %+v, want the stub's rates totalling 0.0725", resp)
+	}
+	if !strings.Contains(query, "quarter=2") || got.Get("client_id") != "test-id" {
+		t.Errorf("upstream got %q with client_id %q, want the CSV flow's request", query, got.Get("client_id"))
+	}
+
+	for _, tt := range []struct {
+		query, want string
+	}{
+		{"street=1+Main+St&city=Austin", "Missing parameters: state, zip, quarter, year"},
+		{"state=TX&zip=78701&quarter=5&year=2024", "invalid quarter"},
+		{"state=TX&zip=78701&quarter=Q1&year=2024", "invalid quarter"},
+		{"state=TX&zip=78701&quarter=1&year=1999", "invalid year"},
+	} {
+		w := lookup(http.MethodGet, tt.query)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: %d %q, want 400 with %q", tt.query, w.Code, w.Body, tt.want)
+		}
+	}
+	if w := lookup(http.MethodPost, ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", w.Code)
+	}
+}
@@ -1,20 +1,60 @@
 package main
 
 import (
-	"archive/zip"
 	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// errIncompleteUpload is returned when the uploaded file ends mid-record,
+// which usually means the client connection dropped during the upload.
+var errIncompleteUpload = errors.New("upload appears incomplete")
+
+// errNoTaxRates is returned when the tax API responds without any rates,
+// e.g. for a quarter that has not been published yet.
+var errNoTaxRates = errors.New("no tax rates found")
+
+// errAddressNotGeocoded is returned when the tax API answers with a
+// nonzero GISRETURNCODE and no rates: it could not place the address, so
+// the address needs fixing rather than the lookup retrying.
+var errAddressNotGeocoded = errors.New("address could not be geocoded; check the street, city and zip code")
+
+// errControlTotal is returned when the charges don't add up to the
+// request's expected_total.
+var errControlTotal = errors.New("control total mismatch")
+
+// errSkipRow is returned by parseRow for a row that policy says to drop
+// silently rather than report.
+var errSkipRow = errors.New("row skipped")
+
+// errEmptyUpstreamResponse is returned when the tax API answers 200 with
+// no body. It is treated as transient and is eligible for retry.
+var errEmptyUpstreamResponse = errors.New("upstream returned empty response")
+
+// combinedRateName is the jurisdiction name and type of the single rate
+// used with TOTAL_RATE_SOURCE=api.
+const combinedRateName = "TOTAL"
+
+// requiredColumns is the header every uploaded CSV must start with.
+var requiredColumns = []string{"client", "date", "charge", "street address", "city", "State", "zip code"}
+
 type TaxRecord struct {
 	Client string
 	Date   string
@@ -24,6 +64,112 @@ type TaxRecord struct {
 	State  string
 	Zip    string
 	Taxes  map[string]float64
+
+	// Line is the row's line number in the uploaded CSV, and Source the
+	// CSV's name within an uploaded ZIP.
+	Line   int
+	Source string
+
+	// Bases is the taxable amount each non-exempt jurisdiction's tax was
+	// computed on, and RateBases the same amounts by jurisdiction and rate,
+	// which rounding=aggregate recomputes the tax from. A jurisdiction
+	// zeroed by MIN_TAX_AMOUNT has no RateBases.
+	Bases     map[string]float64
+	RateBases map[aggregateKey]float64
+
+	// ColumnCharges holds the additional charge columns configured with
+	// CHARGE_COLUMNS, and ColumnTaxes the total tax computed on each.
+	ColumnCharges map[string]float64
+	ColumnTaxes   map[string]float64
+
+	// Currency, OriginalCharge and OriginalColumnCharges are set when the
+	// input has a currency column; Charge and ColumnCharges then hold the
+	// amounts converted to the base currency.
+	Currency              string
+	OriginalCharge        float64
+	OriginalColumnCharges map[string]float64
+
+	// Quarter and Year are the reporting period derived from Date, and
+	// Rates is the jurisdiction schedule the taxes were computed from.
+	Quarter int
+	Year    int
+	Rates   []jurisdictionRate
+
+	// ChargeDate is the parsed Date. Exemption names the tax holiday that
+	// zeroed some or all of this row's jurisdictions, if any.
+	ChargeDate time.Time
+	Exemption  string
+
+	// NetCharge is the pre-tax amount taxes were computed on. It equals
+	// Charge on the net basis and excludes the tax on the gross basis.
+	NetCharge float64
+
+	// ZipOnlyLookup drops the street from the upstream lookup, used when
+	// the city is blank and BLANK_CITY_POLICY is "zip".
+	ZipOnlyLookup bool
+
+	// FallbackPeriod is set, e.g. to "2024Q3", when the row's own quarter
+	// had no published rates and an earlier quarter's rates were used.
+	FallbackPeriod string
+
+	// LookupDuration is how long resolving the row's rates took; near
+	// zero when they came from the cache, and zero for every row after the
+	// first that shares an address and period with another.
+	LookupDuration time.Duration
+
+	// Warnings are non-fatal data-quality notes about the row.
+	Warnings []string
+}
+
+// jurisdictionRate is a single entry of the upstream rate schedule.
+type jurisdictionRate struct {
+	Name string
+	Type string
+	Rate float64
+}
+
+// rateKey identifies a single upstream lookup: an address in a period.
+type rateKey struct {
+	Street, City, State, Zip string
+	Quarter, Year            int
+}
+
+// warn records a data-quality warning on the row and logs it.
+func (rec *TaxRecord) warn(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Warning: client %s, date %s: %s", rec.Client, rec.Date, msg)
+	rec.Warnings = append(rec.Warnings, msg)
+}
+
+// useFallbackPeriod flags the row as taxed at an earlier period's rates.
+// The row's own Quarter and Year are left unchanged for reporting.
+func (rec *TaxRecord) useFallbackPeriod(quarter, year int) {
+	rec.FallbackPeriod = fmt.Sprintf("%dQ%d", year, quarter)
+	rec.warn("no rates published for %dQ%d; used %s rates", rec.Year, rec.Quarter, rec.FallbackPeriod)
+}
+
+// rateKey returns the upstream lookup for the row. Rows flagged for a
+// ZIP-only lookup omit the street.
+func (rec TaxRecord) rateKey() rateKey {
+	street := rec.Street
+	if rec.ZipOnlyLookup {
+		street = ""
+	}
+	return rateKey{street, rec.City, rec.State, rec.Zip, rec.Quarter, rec.Year}
+}
+
+// normalized returns the key under which the lookup is cached, so spelling
+// variants of one address ("12  Main St " vs "12 main st") share an entry.
+// The original key is still what is sent upstream.
+func (k rateKey) normalized() rateKey {
+	fold := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	k.Street = fold(k.Street)
+	k.City = fold(k.City)
+	k.State = strings.ToUpper(strings.TrimSpace(k.State))
+	k.Zip = strings.TrimSpace(k.Zip)
+	return k
 }
 
 type TaxRateResponse struct {
@@ -39,25 +185,64 @@ type TaxRateResponse struct {
 	GisReturnCode string `json:"GISRETURNCODE"`
 }
 
+type server struct {
+	cfg Config
+
+	// cache holds rate schedules looked up by any job, so addresses
+	// repeated across uploads are resolved once until their entry expires
+	// or is evicted.
+	cache *rateCache
+
+	// upstream is the HTTP client shared by all calls to the tax rate API.
+	upstream *http.Client
+
+	// upstreamOK is when the health check last reached the tax API, in
+	// Unix nanoseconds, or zero if it never has.
+	upstreamOK atomic.Int64
+}
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
 	log.SetOutput(os.Stdout)
 
-	handler := http.HandlerFunc(taxRatesHandler)
-	http.Handle("/getTaxRates", corsMiddleware(handler))
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	s := &server{cfg: cfg, cache: newRateCache(cfg.RateCacheSize, cfg.RateCacheTTL), upstream: newUpstreamClient(cfg)}
+
+	log.Printf("Starting server on :%s%s", cfg.Port, cfg.RoutePrefix)
+	log.Fatal(http.ListenAndServe(":"+cfg.Port, s.routes()))
+}
 
-	log.Printf("Starting server on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+// routes registers every endpoint under cfg.RoutePrefix.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	prefix := s.cfg.RoutePrefix
+	origins := s.cfg.CORSAllowedOrigins
+	mux.Handle(prefix+"/getTaxRates", gzipMiddleware(corsMiddleware(origins, http.HandlerFunc(s.taxRatesHandler))))
+	mux.Handle(prefix+"/cache", gzipMiddleware(http.HandlerFunc(s.cacheHandler)))
+	mux.Handle(prefix+"/config", gzipMiddleware(http.HandlerFunc(s.configHandler)))
+	mux.Handle(prefix+"/diff", gzipMiddleware(http.HandlerFunc(s.diffHandler)))
+	mux.Handle(prefix+"/lookup", gzipMiddleware(corsMiddleware(origins, http.HandlerFunc(s.lookupHandler))))
+	mux.Handle(prefix+"/healthz", http.HandlerFunc(s.healthHandler))
+	return mux
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
+// corsMiddleware lets browsers on the allowed origins call next. A request's
+// Origin is echoed back only when it is in allowed; with "*" any origin is
+// allowed and "*" is sent instead, which browsers refuse to combine with
+// credentials, so none are ever allowed.
+func corsMiddleware(allowed []string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "https://skeen0711.github.io")
+		w.Header().Add("Vary", "Origin")
+		if slices.Contains(allowed, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(allowed, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Tax-Summary")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -67,145 +252,264 @@ func corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func taxRatesHandler(w http.ResponseWriter, r *http.Request) {
+func (s *server) taxRatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.writeUsage(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	err := r.ParseMultipartForm(10 << 20)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		http.Error(w, "Error parsing form: upload appears incomplete, please retry", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
 
-	file, _, err := r.FormFile("csvFile")
+	opts, err := parseRequestOptions(r)
 	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	records, err := processCSV(file)
+	file, fileHeader, err := r.FormFile("csvFile")
+	if errors.Is(err, http.ErrMissingFile) {
+		http.Error(w, fmt.Sprintf("Missing file: upload the CSV in a multipart form field named \"csvFile\" with columns %s (GET %s for details)", strings.Join(requiredColumns, ","), r.URL.Path), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error processing CSV: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Error retrieving file", http.StatusBadRequest)
 		return
 	}
-
-	// Create a buffer for the ZIP file
-	buf := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(buf)
-
-	// Write due_by_charge.csv
-	dueByChargeBuf := new(bytes.Buffer)
-	dueByChargeWriter := csv.NewWriter(dueByChargeBuf)
-	jurisNames := getAllJurisNames(records)
-	headers := []string{"client", "date", "charge", "street address", "city", "State", "zip code"}
-	headers = append(headers, jurisNames...)
-	if err := dueByChargeWriter.Write(headers); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing due_by_charge headers: %v", err), http.StatusInternalServerError)
+	defer file.Close()
+	if fileHeader.Size == 0 {
+		http.Error(w, "Empty file: csvFile was uploaded but contains no data; it must include at least the header row", http.StatusBadRequest)
 		return
 	}
 
-	for _, rec := range records {
-		row := []string{
-			rec.Client,
-			rec.Date,
-			fmt.Sprintf("%.2f", rec.Charge),
-			rec.Street,
-			rec.City,
-			rec.State,
-			rec.Zip,
-		}
-		for _, juris := range jurisNames {
-			tax := rec.Taxes[juris]
-			row = append(row, fmt.Sprintf("%.2f", tax))
-		}
-		if err := dueByChargeWriter.Write(row); err != nil {
-			http.Error(w, fmt.Sprintf("Error writing due_by_charge row: %v", err), http.StatusInternalServerError)
+	inputs := []csvInput{{Reader: file}}
+	if isZipUpload(file) {
+		if opts.Stream {
+			http.Error(w, "stream=true is not supported for ZIP uploads", http.StatusBadRequest)
+			return
+		}
+		inputs, err = readUploadArchive(file, fileHeader.Size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
-	dueByChargeWriter.Flush()
-	if err := dueByChargeWriter.Error(); err != nil {
-		http.Error(w, fmt.Sprintf("Error flushing due_by_charge writer: %v", err), http.StatusInternalServerError)
+
+	if opts.Stream {
+		s.streamResults(r.Context(), w, file, opts)
 		return
 	}
 
-	log.Printf("due_by_charge.csv content length: %d bytes", dueByChargeBuf.Len())
-	f1, err := zipWriter.Create("due_by_charge.csv")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating due_by_charge.zip entry: %v", err), http.StatusInternalServerError)
+	result, err := s.computeResults(r.Context(), inputs, opts)
+	if errors.Is(err, errControlTotal) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	n1, err := io.Copy(f1, dueByChargeBuf)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error writing due_by_charge.csv to ZIP: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error processing CSV: %v", err), processingErrorStatus(err))
 		return
 	}
-	log.Printf("due_by_charge.csv written to ZIP: %d bytes", n1)
+	records, rowErrors := result.Records, result.RowErrors
 
-	// Calculate totals per jurisdiction and write due_by_jurisdiction.csv
-	jurisTotals := make(map[string]float64)
-	for _, rec := range records {
-		for juris, tax := range rec.Taxes {
-			jurisTotals[juris] += tax
-		}
+	summary, _ := json.Marshal(result.Summary)
+	log.Printf("Job summary: %s", summary)
+	w.Header().Set("X-Tax-Summary", string(summary))
+
+	if opts.Estimate {
+		writeEstimate(w, records)
+		return
 	}
 
-	dueByJurisBuf := new(bytes.Buffer)
-	dueByJurisWriter := csv.NewWriter(dueByJurisBuf)
-	if err := dueByJurisWriter.Write([]string{"Jurisdiction", "total"}); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing due_by_jurisdiction headers: %v", err), http.StatusInternalServerError)
+	if len(records) == 0 && len(rowErrors) == 0 && s.cfg.EmptyResultStatus == http.StatusNoContent {
+		log.Printf("No data rows in upload, responding with 204")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	for juris, total := range jurisTotals {
-		if err := dueByJurisWriter.Write([]string{juris, fmt.Sprintf("%.2f", total)}); err != nil {
-			http.Error(w, fmt.Sprintf("Error writing due_by_jurisdiction row: %v", err), http.StatusInternalServerError)
-			return
-		}
+
+	rp := reporter{cfg: s.cfg, opts: opts, rowErrors: rowErrors}
+	if opts.MergeSimilar {
+		rp.merges = mergeSimilarJurisdictions(records)
 	}
-	dueByJurisWriter.Flush()
-	if err := dueByJurisWriter.Error(); err != nil {
-		http.Error(w, fmt.Sprintf("Error flushing due_by_jurisdiction writer: %v", err), http.StatusInternalServerError)
+	rp.shortNames = rp.shortenNames(recordJurisNames(records))
+
+	if opts.Preview > 0 {
+		rp.writePreview(w, records)
 		return
 	}
 
-	log.Printf("due_by_jurisdiction.csv content length: %d bytes", dueByJurisBuf.Len())
-	f2, err := zipWriter.Create("due_by_jurisdiction.csv")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating due_by_jurisdiction.zip entry: %v", err), http.StatusInternalServerError)
+	if acceptsJSON(r) {
+		rp.writeJSONResults(w, result)
 		return
 	}
-	n2, err := io.Copy(f2, dueByJurisBuf)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error writing due_by_jurisdiction.csv to ZIP: %v", err), http.StatusInternalServerError)
+
+	if opts.Format == "xlsx" {
+		rp.writeXLSX(w, records)
 		return
 	}
-	log.Printf("due_by_jurisdiction.csv written to ZIP: %d bytes", n2)
 
-	// Explicitly close the ZIP writer before sending
-	if err := zipWriter.Close(); err != nil {
-		http.Error(w, fmt.Sprintf("Error closing ZIP writer: %v", err), http.StatusInternalServerError)
+	files := rp.outputFiles(records)
+	if opts.Format == "json-envelope" {
+		buf := new(bytes.Buffer)
+		if err := rp.writeZip(buf, files); err != nil {
+			http.Error(w, fmt.Sprintf("Error building results: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Final ZIP file size: %d bytes", buf.Len())
+		writeEnvelope(w, "tax_results.zip", "application/zip", buf.Bytes())
 		return
 	}
 
-	log.Printf("Final ZIP file size: %d bytes", buf.Len())
-
-	// Set response headers
+	// The ZIP is written straight to the response, each file as soon as it
+	// is built, without a Content-Length, so errors from here on can only be
+	// logged; the client sees a truncated archive.
 	w.Header().Set("Content-Type", "application/zip")
 	w.Header().Set("Content-Disposition", "attachment; filename=\"tax_results.zip\"")
-	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
-
-	// Write the ZIP buffer to the response
-	n, err := w.Write(buf.Bytes())
-	if err != nil {
-		log.Printf("Error writing ZIP to response: %v", err)
+	if err := rp.writeZip(w, files); err != nil {
+		log.Printf("Error streaming ZIP to response: %v", err)
 		return
 	}
-	log.Printf("Wrote %d bytes to HTTP response", n)
+	log.Printf("Streamed ZIP with %d files to HTTP response", len(files))
+}
+
+// taxResult is the outcome of processing an upload, shared by the ZIP and
+// JSON encoders.
+type taxResult struct {
+	Records   []TaxRecord
+	RowErrors []RowError
+	Summary   jobSummary
+}
+
+// jobSummary counts what became of an upload's rows, so rows left out of
+// the results can't go unnoticed. It is logged when the job completes and
+// sent as JSON in the X-Tax-Summary response header. Rows dropped by a
+// skip policy aren't counted.
+type jobSummary struct {
+	Rows      int `json:"rows"`
+	Succeeded int `json:"succeeded"`
+	Skipped   int `json:"skipped"`
+
+	// Addresses counts the unique lookups not served from the cache, and
+	// APICalls the upstream requests they took, including retries.
+	Addresses int   `json:"unique_addresses"`
+	APICalls  int64 `json:"api_calls"`
+}
+
+// computeResults processes the uploaded CSVs, combining their records, and
+// applies the job-level checks: outlier flagging and the expected_total
+// control total, whose failure is reported as errControlTotal. With
+// estimate=true the records are returned unpriced and unchecked.
+func (s *server) computeResults(ctx context.Context, inputs []csvInput, opts requestOptions) (taxResult, error) {
+	rv := s.newResolver(opts)
+	result := taxResult{Records: []TaxRecord{}}
+	for _, in := range inputs {
+		records, rowErrors, err := processCSV(ctx, in.Reader, rv, opts)
+		if err != nil && in.Name != "" {
+			return taxResult{}, fmt.Errorf("%s: %w", in.Name, err)
+		}
+		if err != nil {
+			return taxResult{}, err
+		}
+		for i := range records {
+			records[i].Source = in.Name
+		}
+		for i := range rowErrors {
+			rowErrors[i].File = in.Name
+		}
+		result.Records = append(result.Records, records...)
+		result.RowErrors = append(result.RowErrors, rowErrors...)
+	}
+	records := result.Records
+	result.Summary = jobSummary{
+		Rows:      len(records) + len(result.RowErrors),
+		Succeeded: len(records),
+		Skipped:   len(result.RowErrors),
+		Addresses: rv.lookupCount(),
+		APICalls:  rv.calls.Load(),
+	}
+	if opts.Estimate {
+		return result, nil
+	}
+
+	if s.cfg.OutlierFactor > 0 {
+		flagChargeOutliers(records, s.cfg.OutlierFactor)
+	}
+	if s.cfg.ExpectedState != "" {
+		flagUnexpectedStates(records, s.cfg.ExpectedState)
+	}
+	if len(s.cfg.ClientChargeRanges) > 0 {
+		flagClientChargeRanges(records, s.cfg.ClientChargeRanges)
+	}
+
+	if opts.ExpectedTotal != nil {
+		if err := checkControlTotal(records, *opts.ExpectedTotal); err != nil {
+			return taxResult{}, err
+		}
+	}
+	return result, nil
+}
+
+// acceptsJSON reports whether the client asked for a JSON document rather
+// than the default ZIP via its Accept header.
+func acceptsJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(v, ";")
+		if strings.TrimSpace(mediaType) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// controlTotalTolerance is how far the sum of parsed charges may drift from
+// expected_total before the upload is rejected.
+const controlTotalTolerance = 0.005
+
+// checkControlTotal verifies that the parsed charges add up to the total
+// the client expects, catching rows that were dropped or duplicated.
+func checkControlTotal(records []TaxRecord, expected float64) error {
+	sum := 0.0
+	for _, rec := range records {
+		sum += rec.Charge
+	}
+	return checkChargeSum(sum, len(records), expected)
 }
 
+// checkChargeSum compares the sum of the charges in rows rows with the
+// expected control total.
+func checkChargeSum(sum float64, rows int, expected float64) error {
+	if math.Abs(sum-expected) > controlTotalTolerance {
+		return fmt.Errorf("%w: charges in %d rows sum to %.2f, expected %.2f (difference %.2f)", errControlTotal, rows, sum, expected, sum-expected)
+	}
+	return nil
+}
+
+// processingErrorStatus maps an error from reading the upload to the HTTP
+// status reported to the client. A truncated upload, malformed CSV, bad
+// header or invalid row is the client's to fix.
+func processingErrorStatus(err error) int {
+	var parseErr *csv.ParseError
+	var lineErr *lineError
+	if errors.Is(err, errIncompleteUpload) || errors.Is(err, errInvalidHeader) ||
+		errors.As(err, &parseErr) || errors.As(err, &lineErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// getAllJurisNames returns every jurisdiction taxed in records, sorted by
+// name so due_by_charge.csv columns come out in the same order as the rows
+// of due_by_jurisdiction.csv on every run.
 func getAllJurisNames(records []TaxRecord) []string {
 	jurisSet := make(map[string]bool)
 	for _, rec := range records {
@@ -217,86 +521,450 @@ func getAllJurisNames(records []TaxRecord) []string {
 	for juris := range jurisSet {
 		jurisNames = append(jurisNames, juris)
 	}
+	sort.Strings(jurisNames)
 	return jurisNames
 }
 
-func processCSV(file io.Reader) ([]TaxRecord, error) {
-	reader := csv.NewReader(file)
+// RowError describes a data row left out of the results, identified by its
+// line in the uploaded CSV.
+type RowError struct {
+	File   string
+	Line   int
+	Client string
+	Reason string
+}
+
+// processCSV parses and prices every row of the CSV in file. Rows that are
+// invalid or whose rates can't be looked up are skipped and reported as
+// RowErrors rather than failing the whole upload; the returned error is
+// reserved for problems with the upload itself.
+func processCSV(ctx context.Context, file io.Reader, rv *resolver, opts requestOptions) ([]TaxRecord, []RowError, error) {
 	records := []TaxRecord{}
+	var rowErrors []RowError
+	err := parseRecords(file, rv.cfg, opts, func(rec TaxRecord) error {
+		records = append(records, rec)
+		return nil
+	}, func(rowErr RowError) {
+		rowErrors = append(rowErrors, rowErr)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Estimate {
+		return records, rowErrors, nil
+	}
+
+	priceErrs, err := rv.priceAll(ctx, records, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	priced := records[:0]
+	for i, rec := range records {
+		if priceErrs[i] != nil {
+			rowErrors = append(rowErrors, RowError{Line: rec.Line, Client: rec.Client, Reason: priceErrs[i].Error()})
+			continue
+		}
+		priced = append(priced, rec)
+	}
+	// Parse and lookup errors are merged by line; a line appears at most
+	// once, and the stable sort keeps the order reproducible regardless.
+	sort.SliceStable(rowErrors, func(i, j int) bool { return rowErrors[i].Line < rowErrors[j].Line })
+	return priced, rowErrors, nil
+}
+
+// forEachRecord parses and validates each data row of the CSV in file,
+// resolves its rates through rv and computes its taxes, then hands the
+// record to fn. Rows are priced one at a time, in order. It stops at the
+// first error, from parsing, pricing or fn.
+func forEachRecord(ctx context.Context, file io.Reader, cfg Config, opts requestOptions, rv *resolver, fn func(TaxRecord) error) error {
+	return parseRecords(file, cfg, opts, func(rec TaxRecord) error {
+		if !opts.Estimate {
+			if err := rv.price(ctx, &rec, opts); err != nil {
+				return err
+			}
+		}
+		return fn(rec)
+	}, nil)
+}
+
+// parseRecords parses and validates each data row of the CSV in file and
+// hands the unpriced record to fn. Rows that fail validation, including
+// rows with the wrong number of fields, are passed to skip and parsing
+// continues; with a nil skip the first invalid row stops parsing instead,
+// with its line number prefixed to the error. Other errors reading the CSV
+// itself, or from fn, always stop it.
+func parseRecords(file io.Reader, cfg Config, opts requestOptions, fn func(TaxRecord) error, skip func(RowError)) error {
+	reader := csv.NewReader(file)
+	count := 0
 
 	header, err := reader.Read()
 	if err != nil {
-		return nil, err
+		return truncationError(reader, err)
 	}
-	expected := []string{"client", "date", "charge", "street address", "city", "State", "zip code"}
-	if !equal(header, expected) {
-		return nil, fmt.Errorf("invalid CSV header: got %v, expected %v", header, expected)
+	cols, err := resolveColumns(header, opts.StrictColumns, chargeColumnNames(cfg.ChargeColumns))
+	if err != nil {
+		return err
 	}
 
+	// next holds a row read ahead of its turn while checking whether a row
+	// with the wrong number of fields was the last one.
+	var next *csvRead
 	for {
-		row, err := reader.Read()
+		if opts.Preview > 0 && count >= opts.Preview {
+			break
+		}
+		var row []string
+		if next != nil {
+			row, err, next = next.row, next.err, nil
+		} else {
+			row, err = reader.Read()
+		}
 		if err == io.EOF {
 			break
 		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+			// A mismatched last row is most likely a cut-off upload;
+			// anywhere else it is one bad row.
+			peeked, peekErr := reader.Read()
+			if peekErr == io.EOF {
+				return fmt.Errorf("%w: %v", errIncompleteUpload, err)
+			}
+			if skip == nil {
+				return err
+			}
+			next = &csvRead{peeked, peekErr}
+			reason := fmt.Sprintf("wrong number of fields: expected %d, found %d", len(header), len(row))
+			skip(RowError{Line: parseErr.StartLine, Client: strings.TrimSpace(cols.get(row, "client")), Reason: reason})
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return truncationError(reader, err)
 		}
 
-		for i := range row {
-			row[i] = strings.TrimSpace(row[i])
+		line, _ := reader.FieldPos(0)
+		rec, err := parseRow(row, cols, cfg)
+		if errors.Is(err, errSkipRow) {
+			continue
+		}
+		if err != nil {
+			if skip == nil {
+				return &lineError{Line: line, Err: err}
+			}
+			skip(RowError{Line: line, Client: cols.get(row, "client"), Reason: err.Error()})
+			continue
 		}
+		rec.Line = line
 
-		dateParts := strings.Split(row[1], "/")
-		if len(dateParts) != 3 {
-			return nil, fmt.Errorf("invalid date format for client %s: %s", row[0], row[1])
+		if err := fn(rec); err != nil {
+			return err
 		}
-		month, err := strconv.Atoi(dateParts[0])
-		if err != nil || month < 1 || month > 12 {
-			return nil, fmt.Errorf("invalid month in date for client %s: %s", row[0], row[1])
+		count++
+	}
+
+	return nil
+}
+
+// lineError is a data row that failed validation when invalid rows stop
+// parsing rather than being skipped.
+type lineError struct {
+	Line int
+	Err  error
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *lineError) Unwrap() error {
+	return e.Err
+}
+
+// parseRow validates one data row and builds its unpriced record.
+func parseRow(row []string, cols columnIndex, cfg Config) (TaxRecord, error) {
+	for i := range row {
+		row[i] = strings.TrimSpace(row[i])
+	}
+	client := cols.get(row, "client")
+	date := cols.get(row, "date")
+
+	chargeDate, err := parseChargeDate(date, cfg)
+	if errors.Is(err, errDayOutOfRange) {
+		return TaxRecord{}, fmt.Errorf("invalid day in date for client %s: %s (%v)", client, date, err)
+	}
+	if err != nil {
+		return TaxRecord{}, fmt.Errorf("invalid date for client %s: %s", client, date)
+	}
+	if chargeDate.Year() < cfg.MinYear {
+		return TaxRecord{}, fmt.Errorf("invalid year in date for client %s: %s", client, date)
+	}
+	year := chargeDate.Year()
+	quarter := (int(chargeDate.Month())-1)/3 + 1
+
+	var charge float64
+	blankCharge := cols.get(row, "charge") == ""
+	if blankCharge {
+		switch cfg.BlankChargePolicy {
+		case "error":
+			return TaxRecord{}, fmt.Errorf("blank charge for client %s dated %s", client, date)
+		case "skip":
+			log.Printf("Skipping row with blank charge for client %s dated %s", client, date)
+			return TaxRecord{}, errSkipRow
 		}
-		day, err := strconv.Atoi(dateParts[1])
-		if err != nil || day < 1 || day > 31 {
-			return nil, fmt.Errorf("invalid day in date for client %s: %s", row[0], row[1])
+	} else {
+		charge, err = parseAmount(cols.get(row, "charge"), currencySymbol(cfg.BaseCurrency))
+		if err != nil {
+			return TaxRecord{}, fmt.Errorf("invalid charge for client %s: %v", client, err)
 		}
-		year, err := strconv.Atoi(dateParts[2])
-		if err != nil || year < 2000 {
-			return nil, fmt.Errorf("invalid year in date for client %s: %s", row[0], row[1])
+	}
+
+	rec := TaxRecord{
+		Client: client,
+		Date:   date,
+		Charge: charge,
+		Street: cols.get(row, "street address"),
+		City:   cols.get(row, "city"),
+		State:  cols.get(row, "State"),
+		Zip:    cols.get(row, "zip code"),
+		Taxes:  make(map[string]float64),
+		Bases:  make(map[string]float64),
+
+		ColumnCharges: make(map[string]float64),
+		ColumnTaxes:   make(map[string]float64),
+
+		Quarter: quarter,
+		Year:    year,
+
+		ChargeDate: chargeDate,
+	}
+
+	if !cfg.BusinessStart.IsZero() && rec.ChargeDate.Before(cfg.BusinessStart) {
+		return TaxRecord{}, fmt.Errorf("date for client %s is before the business start date %s: %s", client, cfg.BusinessStart.Format("2006-01-02"), date)
+	}
+	if cfg.FutureGraceDays >= 0 {
+		latest := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, cfg.FutureGraceDays)
+		if rec.ChargeDate.After(latest) {
+			return TaxRecord{}, fmt.Errorf("date for client %s is more than %d days in the future: %s", client, cfg.FutureGraceDays, date)
 		}
+	}
 
-		quarter := (month-1)/3 + 1
+	if blankCharge {
+		rec.warn("charge is blank; treated as 0")
+	}
+	if subCent(charge) {
+		rec.warn("charge %s is more precise than a cent; output amounts are rounded", cols.get(row, "charge"))
+	}
 
-		charge, err := strconv.ParseFloat(row[2], 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid charge for client %s: %v", row[0], err)
+	for _, field := range []string{"client", "street address", "city"} {
+		if strings.ContainsRune(cols.get(row, field), utf8.RuneError) {
+			rec.warn("%s contains U+FFFD replacement characters; the file may not be UTF-8 and the value may be corrupted", field)
 		}
+	}
 
-		rec := TaxRecord{
-			Client: row[0],
-			Date:   row[1],
-			Charge: charge,
-			Street: row[3],
-			City:   row[4],
-			State:  row[5],
-			Zip:    row[6],
-			Taxes:  make(map[string]float64),
+	if rec.Street != "" && rec.City == "" {
+		switch cfg.BlankCityPolicy {
+		case "error":
+			return TaxRecord{}, fmt.Errorf("blank city for client %s at %s", rec.Client, rec.Street)
+		case "warn":
+			rec.warn("city is blank; rates may not match the address")
+		case "zip":
+			rec.warn("city is blank; rates looked up by ZIP code only")
+			rec.ZipOnlyLookup = true
 		}
+	}
 
-		taxRates, err := scrapeTaxRates(rec.Street, rec.City, rec.State, rec.Zip, quarter, year)
+	if rec.Client == "" {
+		switch cfg.EmptyClientPolicy {
+		case "reject":
+			return TaxRecord{}, fmt.Errorf("empty client name for charge dated %s at %s", rec.Date, rec.Street)
+		case "flag":
+			rec.warn("client name is empty")
+		case "placeholder":
+			rec.Client = cfg.EmptyClientPlaceholder
+		}
+	}
+
+	for _, col := range cfg.ChargeColumns {
+		if !cols.has(col.Name) {
+			continue
+		}
+		v := cols.get(row, col.Name)
+		if v == "" {
+			continue
+		}
+		amount, err := parseAmount(v, currencySymbol(cfg.BaseCurrency))
 		if err != nil {
-			return nil, fmt.Errorf("error scraping tax rates for %s: %v", rec.Client, err)
+			return TaxRecord{}, fmt.Errorf("invalid %s for client %s: %v", col.Name, client, err)
+		}
+		if subCent(amount) {
+			rec.warn("%s %s is more precise than a cent; output amounts are rounded", col.Name, v)
 		}
+		rec.ColumnCharges[col.Name] = amount
+	}
 
-		for juris, rate := range taxRates {
-			rec.Taxes[juris] = charge * rate
+	if cols.has("currency") {
+		currency := strings.ToUpper(cols.get(row, "currency"))
+		if currency == "" {
+			currency = cfg.BaseCurrency
+		}
+		rate, ok := cfg.CurrencyRates[currency]
+		if !ok {
+			return TaxRecord{}, fmt.Errorf("unknown currency for client %s: %s", client, currency)
 		}
+		rec.Currency = currency
+		rec.OriginalCharge = charge
+		charge *= rate
+		rec.Charge = charge
+		rec.OriginalColumnCharges = make(map[string]float64, len(rec.ColumnCharges))
+		for name, amount := range rec.ColumnCharges {
+			rec.OriginalColumnCharges[name] = amount
+			rec.ColumnCharges[name] = amount * rate
+		}
+	}
 
-		records = append(records, rec)
+	if cfg.MaxCharge > 0 && math.Abs(charge) > cfg.MaxCharge {
+		if cfg.MaxChargePolicy == "reject" {
+			return TaxRecord{}, fmt.Errorf("charge for client %s exceeds maximum of %.2f: %.2f", rec.Client, cfg.MaxCharge, charge)
+		}
+		rec.warn("charge %.2f exceeds maximum of %.2f", charge, cfg.MaxCharge)
 	}
+	return rec, nil
+}
 
-	return records, nil
+// parseAmount parses a monetary amount as pasted from an invoice: a
+// leading symbol (the base currency's, e.g. "$"), comma thousands
+// separators and surrounding whitespace are ignored, and a parenthesized
+// amount such as "(50.00)" is a refund, i.e. negative. Commas must group
+// digits in threes. Anything but plain decimal digits is rejected, so
+// exponents, NaN and Inf never reach the totals.
+func parseAmount(v, symbol string) (float64, error) {
+	s := strings.TrimSpace(v)
+	negative := false
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s, negative = strings.TrimSpace(s[1:len(s)-1]), true
+	}
+	sign := ""
+	if strings.HasPrefix(s, "-") && !negative {
+		sign, s = "-", s[1:]
+	}
+	if rest, ok := strings.CutPrefix(s, symbol); ok {
+		s = strings.TrimLeft(rest, " ")
+	}
+	if whole, frac, ok := strings.Cut(s, "."); strings.Contains(whole, ",") {
+		groups := strings.Split(whole, ",")
+		for i, g := range groups {
+			if len(g) > 3 || len(g) == 0 || (i > 0 && len(g) != 3) {
+				return 0, fmt.Errorf("invalid amount %q: misplaced thousands separator", v)
+			}
+		}
+		s = strings.Join(groups, "")
+		if ok {
+			s += "." + frac
+		}
+	}
+	digits := strings.ContainsFunc(s, unicode.IsDigit) && !strings.ContainsFunc(s, func(r rune) bool {
+		return r != '.' && (r < '0' || r > '9')
+	})
+	amount, err := strconv.ParseFloat(sign+s, 64)
+	if !digits || err != nil {
+		return 0, fmt.Errorf("invalid amount %q: expected a number such as 1234.56 or %s1,234.56", v, symbol)
+	}
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
 }
 
-func scrapeTaxRates(street, city, state, zip string, quarter, year int) (map[string]float64, error) {
+// subCent reports whether amount has a fraction of a cent, which can't be
+// charged and is lost when taxes are rounded.
+func subCent(amount float64) bool {
+	s := strconv.FormatFloat(amount, 'f', -1, 64)
+	_, frac, _ := strings.Cut(s, ".")
+	return len(frac) > 2
+}
+
+// dateLayouts are the accepted formats of the date column: M/D/YYYY (with
+// or without leading zeros), ISO YYYY-MM-DD and MM-DD-YYYY.
+var dateLayouts = []string{"1/2/2006", "2006-01-02", "01-02-2006"}
+
+// parseChargeDate parses a date column value in any of dateLayouts, or as
+// M/D/YY when cfg.TwoDigitYearPivot allows two-digit years. Impossible
+// dates such as 2/30 are rejected.
+func parseChargeDate(date string, cfg Config) (time.Time, error) {
+	dayOutOfRange := false
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, date)
+		if err == nil {
+			return t, nil
+		}
+		dayOutOfRange = dayOutOfRange || strings.HasSuffix(err.Error(), "day out of range")
+	}
+	if cfg.TwoDigitYearPivot >= 0 {
+		t, err := time.Parse("1/2/06", date)
+		if err == nil {
+			year := expandTwoDigitYear(t.Year()%100, cfg.TwoDigitYearPivot)
+			expanded := time.Date(year, t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			if expanded.Day() == t.Day() {
+				return expanded, nil
+			}
+			// Feb 29 in a year that is only a leap year in the other century.
+			err = errDayOutOfRange
+		}
+		dayOutOfRange = dayOutOfRange || errors.Is(err, errDayOutOfRange) || strings.HasSuffix(err.Error(), "day out of range")
+	}
+	if dayOutOfRange {
+		return time.Time{}, errDayOutOfRange
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", date)
+}
+
+// errDayOutOfRange reports a well-formed date whose day doesn't exist in
+// its month and year, such as 4/31 or 2/29 outside a leap year.
+var errDayOutOfRange = errors.New("day out of range for the month")
+
+// expandTwoDigitYear maps a two-digit year onto a century using pivot:
+// values below the pivot are 20YY, the rest 19YY.
+func expandTwoDigitYear(yy, pivot int) int {
+	if yy < pivot {
+		return 2000 + yy
+	}
+	return 1900 + yy
+}
+
+// csvRead is the result of one csv.Reader.Read call.
+type csvRead struct {
+	row []string
+	err error
+}
+
+// truncationError inspects a csv.Reader error and, when it looks like the
+// input was cut off mid-stream, wraps it in errIncompleteUpload. An
+// unterminated quoted field immediately followed by EOF is treated as
+// truncation; parseRecords handles a short last record itself.
+func truncationError(reader *csv.Reader, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", errIncompleteUpload, err)
+	}
+	var parseErr *csv.ParseError
+	if !errors.As(err, &parseErr) {
+		return err
+	}
+	if errors.Is(parseErr.Err, csv.ErrQuote) {
+		if _, next := reader.Read(); next == io.EOF {
+			return fmt.Errorf("%w: %v", errIncompleteUpload, err)
+		}
+	}
+	return err
+}
+
+// scrapeTaxRates looks up the rate schedule for one address and period.
+// The rate API only accepts a single address per call; there is no batch
+// endpoint, so call volume is reduced instead by the resolver's cache and
+// shared in-flight lookups, and latency by looking up rows concurrently.
+func scrapeTaxRates(ctx context.Context, client *http.Client, cfg Config, street, city, state, zip string, quarter, year int) ([]jurisdictionRate, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.TaxAPITimeout)
+	defer cancel()
+
 	params := url.Values{
 		"state":   {state},
 		"city":    {city},
@@ -306,20 +974,16 @@ func scrapeTaxRates(street, city, state, zip string, quarter, year int) (map[str
 		"year":    {strconv.Itoa(year)},
 	}
 
-	req, err := http.NewRequest("GET", "https://mulesoft.cpa.texas.gov:8088/api/cpa/gis/v1/salestaxrate/salestaxrate?"+params.Encode(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.TaxAPIBaseURL+"?"+params.Encode(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	req.Header.Set("client_id", "7cf772234a1744cfa78840c848e2d121")
-	req.Header.Set("client_secret", "F00Fcb198e944A18A208EF7033C9B219")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko)")
+	setAPIHeaders(req, cfg)
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch tax rates: %v", err)
+		return nil, fmt.Errorf("failed to fetch tax rates: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -332,40 +996,82 @@ func scrapeTaxRates(street, city, state, zip string, quarter, year int) (map[str
 	}
 	log.Printf("Raw API response: %s", string(body))
 
+	var taxData TaxRateResponse
+	parseErr := json.Unmarshal(body, &taxData)
+	upstreamErr := func(cause error) error {
+		return &upstreamError{Err: cause, StatusCode: resp.StatusCode, GisReturnCode: taxData.GisReturnCode, Body: string(body)}
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d - %s", resp.StatusCode, string(body))
+		return nil, upstreamErr(errUnexpectedStatus)
 	}
 
-	var taxData TaxRateResponse
-	if err := json.Unmarshal(body, &taxData); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON: %v - raw response: %s", err, string(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, upstreamErr(errEmptyUpstreamResponse)
+	}
+
+	if parseErr != nil {
+		return nil, upstreamErr(fmt.Errorf("failed to parse JSON: %v", parseErr))
+	}
+
+	taxRates, err := taxData.rates(cfg)
+	if err != nil {
+		return nil, upstreamErr(err)
 	}
+	return taxRates, nil
+}
 
-	taxRates := make(map[string]float64)
+// setAPIHeaders adds the credentials and headers the tax API expects to a
+// lookup request.
+func setAPIHeaders(req *http.Request, cfg Config) {
+	req.Header.Set("client_id", cfg.TaxAPIClientID)
+	req.Header.Set("client_secret", cfg.TaxAPIClientSecret)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko)")
+}
+
+// rates returns the rate schedule of a successful lookup response, or
+// errAddressNotGeocoded or errNoTaxRates when it has none.
+func (taxData TaxRateResponse) rates(cfg Config) ([]jurisdictionRate, error) {
+	var taxRates []jurisdictionRate
 	for _, rate := range taxData.TaxRates {
 		r, err := strconv.ParseFloat(rate.JurisRate, 64)
 		if err != nil {
 			log.Printf("Warning: Failed to parse rate %s for %s: %v", rate.JurisRate, rate.JurisName, err)
 			continue
 		}
-		taxRates[rate.JurisName] = r
+		taxRates = append(taxRates, jurisdictionRate{Name: rate.JurisName, Type: rate.JurisType, Rate: r})
 	}
 
 	log.Printf("Parsed rates: %+v", taxRates)
 
+	if geocodeFailed(taxData.GisReturnCode, taxRates) {
+		return nil, errAddressNotGeocoded
+	}
 	if len(taxRates) == 0 {
-		return nil, fmt.Errorf("no tax rates found in response: %+v", taxData)
+		return nil, errNoTaxRates
+	}
+
+	if cfg.TotalRateSource == "api" {
+		total, err := strconv.ParseFloat(strings.TrimSpace(taxData.TotalTaxRate), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TOTALTAXRATE %q", taxData.TotalTaxRate)
+		}
+		return []jurisdictionRate{{Name: combinedRateName, Type: combinedRateName, Rate: total}}, nil
 	}
 
 	return taxRates, nil
 }
 
-func equal(a, b []string) bool {
-	if len(a) != len(b) {
+// geocodeFailed reports whether a 200 response is the API failing to
+// place the address: a GISRETURNCODE other than "0" with no nonzero rate.
+// A failure code alongside real rates is taken at the rates' word.
+func geocodeFailed(gisReturnCode string, rates []jurisdictionRate) bool {
+	if code := strings.TrimSpace(gisReturnCode); code == "" || code == "0" {
 		return false
 	}
-	for i := range a {
-		if a[i] != b[i] {
+	for _, r := range rates {
+		if r.Rate != 0 {
 			return false
 		}
 	}
@@ -0,0 +1,898 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRates is the schedule served by rateAPI unless a test needs another.
+var testRates = []jurisdictionRate{
+	{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625},
+	{Name: "AUSTIN", Type: "CITY", Rate: 0.01},
+}
+
+// rateAPI is a stub of the tax rate API answering every lookup with rates.
+// It counts the lookups it serves.
+type rateAPI struct {
+	rates []jurisdictionRate
+	calls atomic.Int64
+}
+
+func (a *rateAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.calls.Add(1)
+	writeRates(w, a.rates)
+}
+
+// writeRates writes a successful rate API response listing rates.
+func writeRates(w http.ResponseWriter, rates []jurisdictionRate) {
+	type taxRate struct {
+		JurisName string `json:"JURISNAME"`
+		JurisType string `json:"JURISTYPE"`
+		JurisRate string `json:"JURISRATE"`
+	}
+	resp := struct {
+		TaxRates      []taxRate `json:"TAXRATES"`
+		TotalTaxRate  string    `json:"TOTALTAXRATE"`
+		GisReturnCode string    `json:"GISRETURNCODE"`
+	}{TaxRates: []taxRate{}, GisReturnCode: "0"}
+	total := 0.0
+	for _, r := range rates {
+		resp.TaxRates = append(resp.TaxRates, taxRate{r.Name, r.Type, strconv.FormatFloat(r.Rate, 'f', -1, 64)})
+		total += r.Rate
+	}
+	resp.TotalTaxRate = strconv.FormatFloat(total, 'f', -1, 64)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newTestServer returns a server whose tax API is api, configured from env
+// on top of the defaults.
+func newTestServer(t *testing.T, api http.Handler, env map[string]string) *server {
+	t.Helper()
+	ts := httptest.NewServer(api)
+	t.Cleanup(ts.Close)
+	t.Setenv("TAX_API_BASE_URL", ts.URL)
+	t.Setenv("TAX_API_CLIENT_ID", "test-id")
+	t.Setenv("TAX_API_CLIENT_SECRET", "test-secret")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return &server{cfg: cfg, cache: newRateCache(cfg.RateCacheSize, cfg.RateCacheTTL), upstream: newUpstreamClient(cfg)}
+}
+
+// postCSV uploads body as csvFile to /getTaxRates with the given query
+// string.
+func postCSV(t *testing.T, s *server, query, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postUpload(t, s, query, "upload.csv", []byte(body))
+}
+
+// postUpload uploads data as csvFile, named filename, to /getTaxRates.
+func postUpload(t *testing.T, s *server, query, filename string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("csvFile", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/getTaxRates?"+query, &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	return w
+}
+
+// unzip returns the files of a ZIP archive by name.
+func unzip(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("reading ZIP: %v", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(content)
+	}
+	return files
+}
+
+// readCSV parses a CSV file from the results.
+func readCSV(t *testing.T, data string) [][]string {
+	t.Helper()
+	rows, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("parsing CSV: %v\n%s", err, data)
+	}
+	return rows
+}
+
+const testHeader = "client,date,charge,street address,city,State,zip code\n"
+
+func TestRowWithWrongFieldCountIsReported(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,200,2 Main St,Austin,TX,78701,extra\n"+
+		"Cole,1/17/2024,300,3 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+
+	charges := readCSV(t, files["due_by_charge.csv"])
+	if len(charges) != 3 || charges[1][0] != "Acme" || charges[2][0] != "Cole" {
+		t.Errorf("due_by_charge.csv rows = %v, want Acme and Cole", charges)
+	}
+	errs := readCSV(t, files["errors.csv"])
+	if len(errs) != 2 || errs[1][0] != "3" || errs[1][1] != "Bolt" || !strings.Contains(errs[1][2], "wrong number of fields") {
+		t.Errorf("errors.csv = %v, want line 3 for Bolt", errs)
+	}
+}
+
+func TestMixedRowsGivePartialOutput(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Query().Get("street"), "404") {
+			http.Error(w, "no such street", http.StatusBadRequest)
+			return
+		}
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=charge", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,13/45/2024,200,2 Main St,Austin,TX,78701\n"+
+		"Cole,1/17/2024,lots,3 Main St,Austin,TX,78701\n"+
+		"Dove,1/18/2024,300,404 Nowhere Rd,Austin,TX,78701\n"+
+		"Eddy,1/19/2024,400,5 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+
+	charges := readCSV(t, files["due_by_charge.csv"])
+	var clients []string
+	for _, row := range charges[1:] {
+		clients = append(clients, row[0])
+	}
+	if !slices.Equal(clients, []string{"Acme", "Eddy"}) {
+		t.Errorf("due_by_charge.csv clients = %v, want Acme and Eddy", clients)
+	}
+
+	errs := readCSV(t, files["errors.csv"])
+	want := []struct{ line, client, reason string }{
+		{"3", "Bolt", "date"},
+		{"4", "Cole", "charge"},
+		{"5", "Dove", "status 400"},
+	}
+	if len(errs) != len(want)+1 {
+		t.Fatalf("errors.csv = %v, want %d rows", errs, len(want))
+	}
+	for i, tt := range want {
+		row := errs[i+1]
+		if row[0] != tt.line || row[1] != tt.client || !strings.Contains(row[2], tt.reason) {
+			t.Errorf("errors.csv row %d = %v, want line %s for %s mentioning %q", i+1, row, tt.line, tt.client, tt.reason)
+		}
+	}
+}
+
+func TestParseErrorsNameTheLine(t *testing.T) {
+	cfg, err := loadConfigWith(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := "Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"
+	for _, tt := range []struct {
+		name, bad, want string
+	}{
+		{"charge", "Bolt,1/16/2024,12..5,2 Main St,Austin,TX,78701\n", "line 4: invalid charge for client Bolt"},
+		{"date", "Bolt,1/32/2024,100,2 Main St,Austin,TX,78701\n", "line 4: invalid day in date for client Bolt"},
+		{"field count", "Bolt,1/16/2024,100,2 Main St,Austin,TX\n", "line 4: wrong number of fields"},
+	} {
+		body := testHeader + good + good + tt.bad + good
+		err := parseRecords(strings.NewReader(body), cfg, requestOptions{}, func(TaxRecord) error { return nil }, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("bad %s: error %v, want %q", tt.name, err, tt.want)
+		}
+
+		var skipped []RowError
+		parseRecords(strings.NewReader(body), cfg, requestOptions{}, func(TaxRecord) error { return nil }, func(e RowError) { skipped = append(skipped, e) })
+		if len(skipped) != 1 || skipped[0].Line != 4 || skipped[0].Client != "Bolt" {
+			t.Errorf("bad %s: skipped %+v, want line 4 for Bolt", tt.name, skipped)
+		}
+	}
+}
+
+func TestTruncatedLastRowFailsUpload(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,200,2 Ma")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "incomplete") {
+		t.Errorf("got %d %q, want 400 reporting an incomplete upload", w.Code, w.Body)
+	}
+}
+
+func TestMalformedCSVIsBadRequest(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "", testHeader+
+		"Ac\"me,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,200,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestCurrencyConvertsChargeColumns(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{
+		"CURRENCY_RATES": "EUR:2",
+		"CHARGE_COLUMNS": "services=all",
+	})
+	w := postCSV(t, s, "include=charge", "client,date,charge,street address,city,State,zip code,currency,services\n"+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701,EUR,100\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	got := make(map[string]string)
+	for i, col := range rows[0] {
+		got[col] = rows[1][i]
+	}
+	want := map[string]string{
+		"charge":            "200.00",
+		"original charge":   "100.00",
+		"services":          "200.00",
+		"services tax":      "14.50",
+		"original services": "100.00",
+	}
+	for col, v := range want {
+		if got[col] != v {
+			t.Errorf("%s = %q, want %q", col, got[col], v)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	valid := map[string]float64{
+		"1234.56":     1234.56,
+		" $1,234.56 ": 1234.56,
+		"$ 12":        12,
+		"(50.00)":     -50,
+		"($50.00)":    -50,
+		"-$5":         -5,
+		"-5.5":        -5.5,
+		".5":          0.5,
+		"1,000,000":   1000000,
+	}
+	for in, want := range valid {
+		got, err := parseAmount(in, "$")
+		if err != nil || got != want {
+			t.Errorf("parseAmount(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "abc", "NaN", "Inf", "-Inf", "infinity", "1e3", "1E3", "0x10", "€12", "12,34", "1,2345", "$", "."} {
+		if got, err := parseAmount(in, "$"); err == nil {
+			t.Errorf("parseAmount(%q) = %v, want an error", in, got)
+		}
+	}
+	if got, err := parseAmount("€12", "€"); err != nil || got != 12 {
+		t.Errorf("parseAmount(€12) with base EUR = %v, %v; want 12", got, err)
+	}
+}
+
+func TestTruncatedMultipartUpload(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, _ := mw.CreateFormFile("csvFile", "upload.csv")
+	part.Write([]byte(testHeader + "Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"))
+	mw.Close()
+	// Cut the body before the closing boundary, as a dropped connection
+	// would.
+	body := buf.Bytes()[:buf.Len()-20]
+
+	req := httptest.NewRequest(http.MethodPost, "/getTaxRates", bytes.NewReader(body))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "incomplete") {
+		t.Errorf("got %d %q, want 400 reporting an incomplete upload", w.Code, w.Body)
+	}
+}
+
+func TestEmptyResultStatus(t *testing.T) {
+	for _, tt := range []struct {
+		env  string
+		want int
+	}{{"", http.StatusOK}, {"204", http.StatusNoContent}} {
+		s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"EMPTY_RESULT_STATUS": tt.env})
+		w := postCSV(t, s, "", testHeader)
+		if w.Code != tt.want {
+			t.Errorf("EMPTY_RESULT_STATUS=%q: status = %d, want %d", tt.env, w.Code, tt.want)
+		}
+		if tt.want == http.StatusNoContent && w.Body.Len() != 0 {
+			t.Errorf("204 response has a body: %q", w.Body)
+		}
+	}
+}
+
+func TestParseRowCurrency(t *testing.T) {
+	t.Setenv("TAX_API_CLIENT_ID", "id")
+	t.Setenv("TAX_API_CLIENT_SECRET", "secret")
+	t.Setenv("CURRENCY_RATES", "eur:1.1, CAD:0.75")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := append(strings.Split(strings.TrimSpace(testHeader), ","), "currency")
+	cols, err := resolveColumns(header, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := func(currency string) []string {
+		return []string{"Acme", "1/15/2024", "200", "1 Main St", "Austin", "TX", "78701", currency}
+	}
+
+	tests := []struct {
+		currency, want string
+		charge         float64
+	}{
+		{"", "USD", 200},
+		{"USD", "USD", 200},
+		{"eur", "EUR", 220},
+		{"CAD", "CAD", 150},
+	}
+	for _, tt := range tests {
+		rec, err := parseRow(row(tt.currency), cols, cfg)
+		if err != nil {
+			t.Errorf("%q: %v", tt.currency, err)
+			continue
+		}
+		if rec.Currency != tt.want || rec.OriginalCharge != 200 || math.Abs(rec.Charge-tt.charge) > 1e-9 {
+			t.Errorf("%q: currency %s, charge %v (original %v); want %s, %v (200)", tt.currency, rec.Currency, rec.Charge, rec.OriginalCharge, tt.want, tt.charge)
+		}
+	}
+	if _, err := parseRow(row("GBP"), cols, cfg); err == nil || !strings.Contains(err.Error(), "unknown currency") {
+		t.Errorf("GBP: err = %v, want unknown currency", err)
+	}
+}
+
+func TestMaxChargePolicies(t *testing.T) {
+	upload := testHeader +
+		"Acme,1/15/2024,900,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,\"$5,000\",2 Main St,Austin,TX,78701\n"
+
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"MAX_CHARGE": "1000", "MAX_CHARGE_POLICY": "reject"})
+	files := unzip(t, postCSV(t, s, "include=charge", upload).Body.Bytes())
+	if rows := readCSV(t, files["due_by_charge.csv"]); len(rows) != 2 || rows[1][0] != "Acme" {
+		t.Errorf("reject: due_by_charge.csv = %v, want only Acme", rows)
+	}
+	if rows := readCSV(t, files["errors.csv"]); len(rows) != 2 || !strings.Contains(rows[1][2], "exceeds maximum of 1000.00") {
+		t.Errorf("reject: errors.csv = %v, want Bolt's charge over the maximum", rows)
+	}
+
+	s = newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"MAX_CHARGE": "1000", "MAX_CHARGE_POLICY": "flag"})
+	files = unzip(t, postCSV(t, s, "include=charge", upload).Body.Bytes())
+	rows := readCSV(t, files["due_by_charge.csv"])
+	warnings := slices.Index(rows[0], "warnings")
+	if len(rows) != 3 || warnings < 0 || rows[1][warnings] != "" || !strings.Contains(rows[2][warnings], "exceeds maximum") {
+		t.Errorf("flag: due_by_charge.csv = %v, want Bolt flagged", rows)
+	}
+	if _, ok := files["errors.csv"]; ok {
+		t.Error("flag: errors.csv written")
+	}
+
+	if _, err := loadConfigWith(t, map[string]string{"MAX_CHARGE": "-5"}); err == nil {
+		t.Error("negative MAX_CHARGE accepted")
+	}
+}
+
+// loadConfigWith loads the configuration from env on top of test
+// credentials.
+func loadConfigWith(t *testing.T, env map[string]string) (Config, error) {
+	t.Helper()
+	t.Setenv("TAX_API_CLIENT_ID", "test-id")
+	t.Setenv("TAX_API_CLIENT_SECRET", "test-secret")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return loadConfig()
+}
+
+// parseTestRow parses a data row in the layout of testHeader with the
+// configuration from env.
+func parseTestRow(t *testing.T, env map[string]string, row string) (TaxRecord, error) {
+	t.Helper()
+	cfg, err := loadConfigWith(t, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cols, err := resolveColumns(strings.Split(strings.TrimSpace(testHeader), ","), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseRow(strings.Split(row, ","), cols, cfg)
+}
+
+func TestEmptyClientPolicies(t *testing.T) {
+	const row = " ,1/15/2024,100,1 Main St,Austin,TX,78701"
+	tests := []struct {
+		policy, placeholder string
+		client, warning     string
+		reject              bool
+	}{
+		{policy: "allow"},
+		{policy: "flag", warning: "client name is empty"},
+		{policy: "reject", reject: true},
+		{policy: "placeholder", client: "UNKNOWN"},
+		{policy: "placeholder", placeholder: "Walk-in", client: "Walk-in"},
+	}
+	for _, tt := range tests {
+		env := map[string]string{"EMPTY_CLIENT_POLICY": tt.policy, "EMPTY_CLIENT_PLACEHOLDER": tt.placeholder}
+		rec, err := parseTestRow(t, env, row)
+		if tt.reject {
+			if err == nil || !strings.Contains(err.Error(), "empty client name") {
+				t.Errorf("%s: err = %v, want the row rejected", tt.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.policy, err)
+			continue
+		}
+		if rec.Client != tt.client || strings.Join(rec.Warnings, "; ") != tt.warning {
+			t.Errorf("%s %q: client %q, warnings %q; want %q, %q", tt.policy, tt.placeholder, rec.Client, rec.Warnings, tt.client, tt.warning)
+		}
+	}
+}
+
+func TestTwoDigitYears(t *testing.T) {
+	tests := []struct {
+		pivot int
+		date  string
+		want  string // "" for an error
+	}{
+		{-1, "3/15/24", ""},
+		{50, "3/15/24", "2024-03-15"},
+		{50, "3/15/49", "2049-03-15"},
+		{50, "3/15/50", "1950-03-15"},
+		{0, "3/15/00", "1900-03-15"},
+		{100, "3/15/99", "2099-03-15"},
+		{50, "3/15/2024", "2024-03-15"},
+		{50, "2/29/24", "2024-02-29"},
+		{50, "2/29/00", "2000-02-29"},
+		{100, "2/29/00", "2000-02-29"},
+	}
+	for _, tt := range tests {
+		got, err := parseChargeDate(tt.date, Config{TwoDigitYearPivot: tt.pivot})
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("pivot %d, %s = %s, want an error", tt.pivot, tt.date, got.Format("2006-01-02"))
+		case tt.want != "" && (err != nil || got.Format("2006-01-02") != tt.want):
+			t.Errorf("pivot %d, %s = %s, %v; want %s", tt.pivot, tt.date, got.Format("2006-01-02"), err, tt.want)
+		}
+	}
+	// 1900 was not a leap year.
+	if _, err := parseChargeDate("2/29/00", Config{TwoDigitYearPivot: 0}); !errors.Is(err, errDayOutOfRange) {
+		t.Errorf("2/29/00 as 1900: err = %v, want errDayOutOfRange", err)
+	}
+}
+
+func TestEstimateMakesNoLookups(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "estimate=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Acme,2/15/2024,100,1 MAIN ST ,austin,TX,78701\n"+
+		"Acme,4/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,50,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var got map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	// Q1 and Q2 at 1 Main St, and 2 Main St.
+	if got["rows"] != 4 || got["unique_addresses"] != 3 {
+		t.Errorf("estimate = %v, want 4 rows and 3 unique addresses", got)
+	}
+	if n := api.calls.Load(); n != 0 {
+		t.Errorf("rate API called %d times during an estimate", n)
+	}
+}
+
+func TestJSONEnvelope(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "format=json-envelope&include=client", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var envelope struct {
+		Filename, ContentType string
+		Data                  []byte // base64 in JSON
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Filename != "tax_results.zip" || envelope.ContentType != "application/zip" {
+		t.Errorf("envelope = %s, %s", envelope.Filename, envelope.ContentType)
+	}
+	rows := readCSV(t, unzip(t, envelope.Data)["due_by_client.csv"])
+	if len(rows) != 2 || rows[1][2] != "7.25" {
+		t.Errorf("due_by_client.csv = %v, want Acme's 7.25", rows)
+	}
+}
+
+func TestExpectedTotal(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	upload := testHeader +
+		"Acme,1/15/2024,0.10,1 Main St,Austin,TX,78701\n" +
+		"Acme,1/15/2024,0.20,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,1000,2 Main St,Austin,TX,78701\n"
+	tests := []struct {
+		expected string
+		want     int
+	}{
+		{"1000.30", http.StatusOK},
+		{"1000.304", http.StatusOK},
+		{"1000.31", http.StatusBadRequest},
+		{"1000", http.StatusBadRequest},
+		{"abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := postCSV(t, s, "include=client&expected_total="+tt.expected, upload)
+		if w.Code != tt.want {
+			t.Errorf("expected_total=%s: status = %d, want %d: %s", tt.expected, w.Code, tt.want, w.Body)
+		}
+	}
+	w := postCSV(t, s, "expected_total=1000", upload)
+	if !strings.Contains(w.Body.String(), "charges in 3 rows sum to 1000.30, expected 1000.00") {
+		t.Errorf("mismatch message = %q", w.Body)
+	}
+}
+
+func TestBlankCityPolicies(t *testing.T) {
+	const upload = testHeader + "Acme,1/15/2024,100,1 Main St,,TX,78701\n"
+	tests := []struct {
+		policy  string
+		street  string // sent upstream; "-" for no lookup
+		warning string
+	}{
+		{"", "1 Main St", "city is blank; rates may not match the address"},
+		{"zip", "", "city is blank; rates looked up by ZIP code only"},
+		{"error", "-", ""},
+	}
+	for _, tt := range tests {
+		street := "-"
+		api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			street = r.URL.Query().Get("street")
+			writeRates(w, testRates)
+		})
+		s := newTestServer(t, api, map[string]string{"BLANK_CITY_POLICY": tt.policy})
+		files := unzip(t, postCSV(t, s, "include=charge", upload).Body.Bytes())
+		if street != tt.street {
+			t.Errorf("%q: street sent = %q, want %q", tt.policy, street, tt.street)
+		}
+		if tt.policy == "error" {
+			if rows := readCSV(t, files["errors.csv"]); len(rows) != 2 || !strings.Contains(rows[1][2], "blank city") {
+				t.Errorf("%q: errors.csv = %v", tt.policy, rows)
+			}
+			continue
+		}
+		rows := readCSV(t, files["due_by_charge.csv"])
+		if i := slices.Index(rows[0], "warnings"); i < 0 || rows[1][i] != tt.warning {
+			t.Errorf("%q: due_by_charge.csv = %v, want warning %q", tt.policy, rows, tt.warning)
+		}
+	}
+}
+
+func TestMissingOrEmptyFilePart(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("include", "charge")
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/getTaxRates", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `field named "csvFile"`) {
+		t.Errorf("no file part: got %d %q", w.Code, w.Body)
+	}
+
+	w = postCSV(t, s, "", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Empty file") {
+		t.Errorf("empty file: got %d %q", w.Code, w.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/getTaxRates", strings.NewReader(testHeader))
+	req.Header.Set("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("raw CSV body: status = %d, want 400", w.Code)
+	}
+}
+
+func TestMinYear(t *testing.T) {
+	const row = "Acme,6/30/1998,100,1 Main St,Austin,TX,78701"
+	if _, err := parseTestRow(t, nil, row); err == nil || !strings.Contains(err.Error(), "invalid year") {
+		t.Errorf("default floor: err = %v, want 1998 rejected", err)
+	}
+	rec, err := parseTestRow(t, map[string]string{"MIN_YEAR": "1995"}, row)
+	if err != nil || rec.Year != 1998 || rec.Quarter != 2 {
+		t.Errorf("MIN_YEAR=1995: %+v, %v; want 1998 Q2 accepted", rec, err)
+	}
+
+	next := strconv.Itoa(time.Now().Year() + 1)
+	for _, v := range []string{"1899", next, "nineteen"} {
+		if _, err := loadConfigWith(t, map[string]string{"MIN_YEAR": v}); err == nil {
+			t.Errorf("MIN_YEAR=%s accepted", v)
+		}
+	}
+}
+
+func TestImpossibleDates(t *testing.T) {
+	day := func(offset int) string {
+		return time.Now().UTC().AddDate(0, 0, offset).Format("1/2/2006")
+	}
+	env := map[string]string{"BUSINESS_START_DATE": "2020-03-01", "FUTURE_DATE_GRACE_DAYS": "7"}
+	for _, tt := range []struct {
+		date, want string
+	}{
+		{"2/28/2020", "before the business start date 2020-03-01"},
+		{"3/1/2020", ""},
+		{day(0), ""},
+		{day(7), ""},
+		{day(30), "more than 7 days in the future"},
+	} {
+		_, err := parseTestRow(t, env, "Acme,"+tt.date+",100,1 Main St,Austin,TX,78701")
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: %v", tt.date, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: error %v, want %q", tt.date, err, tt.want)
+		}
+	}
+
+	// Without bounds only the fixed year floor applies.
+	if _, err := parseTestRow(t, map[string]string{"BUSINESS_START_DATE": "", "FUTURE_DATE_GRACE_DAYS": ""}, "Acme,"+day(3650)+",100,1 Main St,Austin,TX,78701"); err != nil {
+		t.Errorf("far future date rejected with no grace configured: %v", err)
+	}
+}
+
+func TestDateFormats(t *testing.T) {
+	for _, tt := range []struct {
+		date          string
+		quarter, year int
+		ok            bool
+	}{
+		{"7/4/2024", 3, 2024, true},
+		{"07/04/2024", 3, 2024, true},
+		{"2024-07-04", 3, 2024, true},
+		{"12-31-2023", 4, 2023, true},
+		{"2024-13-01", 0, 0, false},
+		{"02-30-2024", 0, 0, false},
+		{"2024/07/04", 0, 0, false},
+		{"July 4, 2024", 0, 0, false},
+	} {
+		rec, err := parseTestRow(t, nil, "Acme,"+tt.date+",100,1 Main St,Austin,TX,78701")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok = %v", tt.date, err, tt.ok)
+			continue
+		}
+		if tt.ok && (rec.Quarter != tt.quarter || rec.Year != tt.year || rec.Date != tt.date) {
+			t.Errorf("%s: Q%d %d with date %q, want Q%d %d and the original string", tt.date, rec.Quarter, rec.Year, rec.Date, tt.quarter, tt.year)
+		}
+	}
+}
+
+func TestDayOfMonthValidation(t *testing.T) {
+	for _, tt := range []struct {
+		date string
+		ok   bool
+	}{
+		{"2/29/2024", true},  // leap year
+		{"2/29/2023", false}, // common year
+		{"2/29/2000", true},  // divisible by 400
+		{"2/29/2100", false}, // divisible by 100 only
+		{"2/30/2024", false},
+		{"4/30/2024", true},
+		{"4/31/2024", false},
+		{"6/31/2024", false},
+		{"9/31/2024", false},
+		{"11/31/2024", false},
+		{"1/31/2024", true},
+		{"12/31/2024", true},
+		{"1/0/2024", false},
+		{"1/32/2024", false},
+	} {
+		rec, err := parseTestRow(t, nil, "Acme,"+tt.date+",100,1 Main St,Austin,TX,78701")
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.date, err)
+		}
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s accepted as Q%d %d", tt.date, rec.Quarter, rec.Year)
+			} else if !strings.Contains(err.Error(), "client Acme") || !strings.Contains(err.Error(), tt.date) {
+				t.Errorf("%s: error %q doesn't name the client and value", tt.date, err)
+			}
+		}
+	}
+}
+
+func TestBlankChargePolicies(t *testing.T) {
+	for _, charge := range []string{"", "   ", "\t"} {
+		row := "Acme,1/15/2024," + charge + ",1 Main St,Austin,TX,78701"
+		t.Run("error", func(t *testing.T) {
+			_, err := parseTestRow(t, nil, row)
+			if err == nil || !strings.Contains(err.Error(), "blank charge for client Acme dated 1/15/2024") {
+				t.Errorf("%q: error %v, want it reported", charge, err)
+			}
+		})
+		t.Run("zero", func(t *testing.T) {
+			rec, err := parseTestRow(t, map[string]string{"BLANK_CHARGE_POLICY": "zero"}, row)
+			if err != nil || rec.Charge != 0 || len(rec.Warnings) != 1 {
+				t.Errorf("%q: charge %v, warnings %v, err %v", charge, rec.Charge, rec.Warnings, err)
+			}
+		})
+		t.Run("skip", func(t *testing.T) {
+			if _, err := parseTestRow(t, map[string]string{"BLANK_CHARGE_POLICY": "skip"}, row); !errors.Is(err, errSkipRow) {
+				t.Errorf("%q: error %v, want errSkipRow", charge, err)
+			}
+		})
+	}
+
+	if _, err := loadConfigWith(t, map[string]string{"BLANK_CHARGE_POLICY": "ignore"}); err == nil {
+		t.Error("unknown BLANK_CHARGE_POLICY accepted")
+	}
+}
+
+func TestReplacementCharacterWarnings(t *testing.T) {
+	for _, tt := range []struct {
+		row  string
+		want []string
+	}{
+		{"Acme,1/15/2024,100,1 Main St,Austin,TX,78701", nil},
+		{"Caf�,1/15/2024,100,1 Main St,Austin,TX,78701", []string{"client"}},
+		{"Acme,1/15/2024,100,1 Main St,San Marcos �,TX,78666", []string{"city"}},
+		{"Caf�,1/15/2024,100,1 Calle Due�a,Austin,TX,78701", []string{"client", "street address"}},
+	} {
+		rec, err := parseTestRow(t, nil, tt.row)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.row, err)
+		}
+		if len(rec.Warnings) != len(tt.want) {
+			t.Errorf("%q: warnings %q, want one each for %v", tt.row, rec.Warnings, tt.want)
+			continue
+		}
+		for i, field := range tt.want {
+			if !strings.HasPrefix(rec.Warnings[i], field+" contains U+FFFD") {
+				t.Errorf("%q: warning %q, want it to name %s", tt.row, rec.Warnings[i], field)
+			}
+		}
+	}
+}
+
+func TestSubCentChargeWarning(t *testing.T) {
+	for _, tt := range []struct {
+		charge string
+		warn   bool
+	}{
+		{"100.999", true},
+		{"$1234.565", true},
+		{"0.001", true},
+		{"100.99", false},
+		{"100.90", false},
+		{"100.900", false}, // trailing zeros add no precision
+		{"100", false},
+	} {
+		rec, err := parseTestRow(t, nil, "Acme,1/15/2024,"+tt.charge+",1 Main St,Austin,TX,78701")
+		if err != nil {
+			t.Errorf("%s: %v", tt.charge, err)
+			continue
+		}
+		warned := slices.ContainsFunc(rec.Warnings, func(w string) bool { return strings.Contains(w, "more precise than a cent") })
+		if warned != tt.warn {
+			t.Errorf("%s: warned = %v, want %v (warnings %q)", tt.charge, warned, tt.warn, rec.Warnings)
+		}
+	}
+
+	// The row is still priced.
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	rows := readCSV(t, unzip(t, postCSV(t, s, "include=charge", testHeader+"Acme,1/15/2024,100.999,1 Main St,Austin,TX,78701\n").Body.Bytes())["due_by_charge.csv"])
+	if len(rows) != 2 || !slices.Contains(rows[1], "6.31") {
+		t.Errorf("due_by_charge.csv = %v, want the row taxed", rows)
+	}
+}
+
+// Invoice-style charges need quoting in a CSV when they have thousands
+// separators; they reach parseAmount intact.
+func TestInvoiceStyleChargesInUpload(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=charge", testHeader+
+		`Acme,1/15/2024,"$1,234.56",1 Main St,Austin,TX,78701`+"\n"+
+		"Bolt,1/16/2024,1234.56,1 Main St,Austin,TX,78701\n"+
+		"Cole,1/17/2024,(50.00),1 Main St,Austin,TX,78701\n"+
+		"Dove,1/18/2024,abc,1 Main St,Austin,TX,78701\n")
+	files := unzip(t, w.Body.Bytes())
+
+	want := map[string]string{"Acme": "77.16", "Bolt": "77.16", "Cole": "-3.13"}
+	rows := readCSV(t, files["due_by_charge.csv"])
+	state := slices.Index(rows[0], "TEXAS STATE")
+	for _, row := range rows[1:] {
+		if row[state] != want[row[0]] {
+			t.Errorf("%s: state tax %s, want %s", row[0], row[state], want[row[0]])
+		}
+		delete(want, row[0])
+	}
+	if len(want) > 0 {
+		t.Errorf("rows missing for %v", want)
+	}
+	if errs := readCSV(t, files["errors.csv"]); len(errs) != 2 || errs[1][1] != "Dove" {
+		t.Errorf("errors.csv = %v, want only Dove's abc", errs)
+	}
+}
+
+func TestSummaryHeaderCountsRows(t *testing.T) {
+	var calls atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first lookup fails once, costing an extra call.
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Acme,1/16/2024,abc,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/17/2024,50,1 Main St,Austin,TX,78701\n"+
+		"Cole,1/18/2024,75,2 Main St,Austin,TX,78702\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	header := w.Header().Get("X-Tax-Summary")
+	var got jobSummary
+	if err := json.Unmarshal([]byte(header), &got); err != nil {
+		t.Fatalf("X-Tax-Summary %q: %v", header, err)
+	}
+	want := jobSummary{Rows: 4, Succeeded: 3, Skipped: 1, Addresses: 2, APICalls: 3}
+	if got != want {
+		t.Errorf("X-Tax-Summary = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// jurisdictionAbbreviations expands tokens commonly abbreviated in
+// jurisdiction names so that e.g. "HARRIS CO" and "Harris County" compare
+// equal.
+var jurisdictionAbbreviations = map[string]string{
+	"CO":   "COUNTY",
+	"CNTY": "COUNTY",
+	"CTY":  "CITY",
+	"DIST": "DISTRICT",
+	"MTA":  "METROPOLITAN TRANSIT AUTHORITY",
+}
+
+// similarityKey reduces a jurisdiction name to a form that ignores case,
+// punctuation, repeated whitespace and common abbreviations.
+func similarityKey(name string) string {
+	fields := strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, f := range fields {
+		if full, ok := jurisdictionAbbreviations[f]; ok {
+			fields[i] = full
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// mergeSimilarJurisdictions folds jurisdictions whose names differ only in
+// formatting into a single column, summing their amounts. The
+// alphabetically first spelling is kept. It returns the merges performed as
+// a map from the dropped name to the name it was merged into.
+func mergeSimilarJurisdictions(records []TaxRecord) map[string]string {
+	byKey := make(map[string][]string)
+	for _, name := range getAllJurisNames(records) {
+		key := similarityKey(name)
+		byKey[key] = append(byKey[key], name)
+	}
+
+	merges := make(map[string]string)
+	for _, names := range byKey {
+		if len(names) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		for _, name := range names[1:] {
+			merges[name] = names[0]
+			log.Printf("Merging jurisdiction %q into %q", name, names[0])
+		}
+	}
+	if len(merges) == 0 {
+		return merges
+	}
+
+	for i := range records {
+		rec := &records[i]
+		for from, to := range merges {
+			if tax, ok := rec.Taxes[from]; ok {
+				rec.Taxes[to] += tax
+				delete(rec.Taxes, from)
+			}
+			if base, ok := rec.Bases[from]; ok {
+				rec.Bases[to] += base
+				delete(rec.Bases, from)
+			}
+		}
+		for k, base := range rec.RateBases {
+			if to, ok := merges[k.Name]; ok {
+				delete(rec.RateBases, k)
+				rec.RateBases[aggregateKey{to, k.Rate}] += base
+			}
+		}
+		// Rates may be shared with other records through the cache, so
+		// rename on a copy.
+		rates := make([]jurisdictionRate, len(rec.Rates))
+		for j, rate := range rec.Rates {
+			if to, ok := merges[rate.Name]; ok {
+				rate.Name = to
+			}
+			rates[j] = rate
+		}
+		rec.Rates = rates
+	}
+	return merges
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestSimilarityKey(t *testing.T) {
+	for _, names := range [][]string{
+		{"HARRIS CO", "Harris County", "harris  cnty."},
+		{"Houston MTA", "HOUSTON METROPOLITAN TRANSIT AUTHORITY"},
+		{"SPD #2", "SPD 2"},
+	} {
+		for _, name := range names[1:] {
+			if similarityKey(name) != similarityKey(names[0]) {
+				t.Errorf("%q and %q have different keys: %q, %q", name, names[0], similarityKey(name), similarityKey(names[0]))
+			}
+		}
+	}
+	if similarityKey("HARRIS CO") == similarityKey("HARRIS CITY") {
+		t.Error("county and city share a key")
+	}
+}
+
+func TestMergeSimilarJurisdictions(t *testing.T) {
+	shared := []jurisdictionRate{{Name: "Harris County", Type: "COUNTY", Rate: 0.01}}
+	records := []TaxRecord{
+		{Taxes: map[string]float64{"HARRIS CO": 1, "TEXAS STATE": 6.25}, Bases: map[string]float64{"HARRIS CO": 100}},
+		{Taxes: map[string]float64{"Harris County": 2}, Bases: map[string]float64{"Harris County": 200}, Rates: shared},
+	}
+	merges := mergeSimilarJurisdictions(records)
+	if want := map[string]string{"Harris County": "HARRIS CO"}; !maps.Equal(merges, want) {
+		t.Fatalf("merges = %v, want %v", merges, want)
+	}
+	if want := map[string]float64{"HARRIS CO": 2}; !maps.Equal(records[1].Taxes, want) {
+		t.Errorf("second record taxes = %v, want %v", records[1].Taxes, want)
+	}
+	if records[1].Rates[0].Name != "HARRIS CO" {
+		t.Errorf("record rate still named %q", records[1].Rates[0].Name)
+	}
+	if shared[0].Name != "Harris County" {
+		t.Error("merge renamed a rate schedule shared through the cache")
+	}
+}
+
+func TestMergeSimilarJurisdictionsAddsBasesWithinRecord(t *testing.T) {
+	records := []TaxRecord{{
+		Taxes: map[string]float64{"HARRIS CO": 1, "Harris County": 2},
+		Bases: map[string]float64{"HARRIS CO": 100, "Harris County": 200},
+	}}
+	mergeSimilarJurisdictions(records)
+	if want := map[string]float64{"HARRIS CO": 3}; !maps.Equal(records[0].Taxes, want) {
+		t.Errorf("taxes = %v, want %v", records[0].Taxes, want)
+	}
+	if want := map[string]float64{"HARRIS CO": 300}; !maps.Equal(records[0].Bases, want) {
+		t.Errorf("bases = %v, want %v", records[0].Bases, want)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // for timezone; the alpine runtime image has no zoneinfo
+
+	"golang.org/x/text/language"
+)
+
+// requestOptions holds the per-request knobs clients can pass as query
+// parameters or multipart form fields alongside the uploaded CSV.
+type requestOptions struct {
+	// NumberFormat controls how monetary amounts are rendered in output
+	// files: "fixed" (default, always two decimals) or "trim" (drop ".00").
+	NumberFormat string
+
+	// Locale, when set, formats amounts with that language's grouping,
+	// decimal separator and currency symbol, overriding NumberFormat.
+	Locale *language.Tag
+
+	// TimeZone is the zone timestamps in reports are rendered in, chosen
+	// by an IANA name such as America/Chicago. It defaults to UTC.
+	TimeZone *time.Location
+
+	// QuoteColumns names output columns (e.g. "client", "zip code") whose
+	// values are always quoted, preserving leading zeros in spreadsheets.
+	QuoteColumns map[string]bool
+
+	// Basis says whether the charge column is the pre-tax amount ("net",
+	// the default) or already includes tax ("gross"). On the gross basis
+	// due_by_charge.csv gains a net charge column.
+	Basis string
+
+	// Rounding selects how due_by_jurisdiction.csv totals are computed:
+	// "row" (default) or "aggregate". See jurisdictionTotals.
+	Rounding string
+
+	// Include is the set of reports to put in the ZIP, chosen with a
+	// comma-separated include parameter (see reportNames). It defaults to
+	// charge, jurisdiction, client, quarter and refunds, the last only
+	// written when there are negative charges; rate_schedule=true and
+	// rate_reference=true add schedule and reference to whatever set is
+	// selected.
+	Include map[string]bool
+
+	// SplitQuarters writes due_by_charge.csv and due_by_jurisdiction.csv
+	// once per reporting quarter under Q1/, Q2/, ... directories.
+	SplitQuarters bool
+
+	// ArchiveOutput selects how a ZIP upload of several CSVs is reported:
+	// "combined" (default) as one set of files, or "per_file" with each
+	// CSV's reports under a directory named after it.
+	ArchiveOutput string
+
+	// PeriodNames appends the reporting period to output filenames (e.g.
+	// due_by_charge_2024Q1.csv) when every row falls in the same quarter.
+	PeriodNames bool
+
+	// PeriodLabel adds a "period" column such as "Q1 2024" to
+	// due_by_charge.csv.
+	PeriodLabel bool
+
+	// MergeSimilar folds jurisdiction columns whose names differ only in
+	// case, punctuation or common abbreviations, and adds
+	// merged_jurisdictions.csv listing what was merged.
+	MergeSimilar bool
+
+	// StrictColumns rejects uploads whose header has columns beyond the
+	// required and known optional ones instead of ignoring them.
+	StrictColumns bool
+
+	// Preview, when positive, processes only the first Preview data rows
+	// and returns them as JSON instead of the ZIP.
+	Preview int
+
+	// Estimate parses and validates the file without calling the upstream
+	// API and reports how many rows and unique lookups it contains.
+	Estimate bool
+
+	// Stream processes the upload in two passes and writes the ZIP directly
+	// to the response so memory does not grow with the number of rows. See
+	// streamResults for what is supported in this mode.
+	Stream bool
+
+	// IncludeTiming adds a "lookup ms" column to due_by_charge.csv with the
+	// time spent resolving each row's rates, and logs each lookup.
+	IncludeTiming bool
+
+	// ExactTotals adds the full-precision, unrounded total next to each
+	// rounded total in due_by_jurisdiction.csv.
+	ExactTotals bool
+
+	// IncludeRates follows each jurisdiction column of due_by_charge.csv
+	// with a "<jurisdiction> rate" column holding the rate its amount was
+	// computed at.
+	IncludeRates bool
+
+	// IncludeBase adds the taxable base each jurisdiction's total was
+	// computed on to due_by_jurisdiction.csv, which differs from the
+	// charges where a taxable cap or exemption applied.
+	IncludeBase bool
+
+	// Checksums adds checksums.txt to the ZIP with the SHA-256 of every
+	// other file in it.
+	Checksums bool
+
+	// MaxNameLength, when positive, truncates jurisdiction names in output
+	// to that many characters for fixed-width importers, keeping them
+	// unique (see reporter.shortenNames).
+	MaxNameLength int
+
+	// ExcelBOM prefixes each CSV with a UTF-8 byte order mark so Excel
+	// displays non-ASCII text correctly.
+	ExcelBOM bool
+
+	// PeriodFallback lets rows whose quarter has no published rates use
+	// the most recent earlier quarter's rates, flagging the row.
+	PeriodFallback bool
+
+	// Format selects how results are delivered: "zip" (default, a binary
+	// download), "json-envelope" (base64 inside a JSON object) or "xlsx"
+	// (a workbook with the charge and jurisdiction reports as sheets).
+	Format string
+
+	// Template, when set, names an entry of outputTemplates whose files
+	// replace the standard reports.
+	Template string
+
+	// ExpectedTotal, when set, is the sum the parsed charges must match;
+	// the upload is rejected if they differ by more than half a cent.
+	ExpectedTotal *float64
+}
+
+// reportNames are the values accepted by the include parameter.
+var reportNames = []string{"charge", "jurisdiction", "client", "quarter", "refunds", "schedule", "reference", "stats", "compliance"}
+
+func parseRequestOptions(r *http.Request) (requestOptions, error) {
+	opts := requestOptions{
+		NumberFormat: "fixed",
+		Basis:        "net",
+		Format:       "zip",
+		Rounding:     "row",
+		TimeZone:     time.UTC,
+	}
+
+	if v := r.FormValue("number_format"); v != "" {
+		switch v {
+		case "fixed", "trim":
+			opts.NumberFormat = v
+		default:
+			return opts, fmt.Errorf("invalid number_format %q: expected fixed or trim", v)
+		}
+	}
+
+	if v := r.FormValue("format"); v != "" {
+		if v != "zip" && v != "json-envelope" && v != "xlsx" {
+			return opts, fmt.Errorf("invalid format %q: expected zip, json-envelope or xlsx", v)
+		}
+		opts.Format = v
+	}
+
+	if v := r.FormValue("template"); v != "" {
+		if _, ok := outputTemplates[v]; !ok {
+			return opts, fmt.Errorf("invalid template %q: expected one of %s", v, templateNames())
+		}
+		opts.Template = v
+	}
+
+	if v := r.FormValue("basis"); v != "" {
+		if v != "net" && v != "gross" {
+			return opts, fmt.Errorf("invalid basis %q: expected net or gross", v)
+		}
+		opts.Basis = v
+	}
+
+	if v := r.FormValue("rounding"); v != "" {
+		if v != "row" && v != "aggregate" {
+			return opts, fmt.Errorf("invalid rounding %q: expected row or aggregate", v)
+		}
+		opts.Rounding = v
+	}
+
+	if v := r.FormValue("locale"); v != "" {
+		tag, err := language.Parse(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid locale %q: %v", v, err)
+		}
+		opts.Locale = &tag
+	}
+
+	if v := r.FormValue("timezone"); v != "" {
+		loc, err := time.LoadLocation(v)
+		if err != nil || v == "Local" {
+			return opts, fmt.Errorf("invalid timezone %q: expected an IANA time zone such as America/Chicago", v)
+		}
+		opts.TimeZone = loc
+	}
+
+	if v := r.FormValue("quote_columns"); v != "" {
+		opts.QuoteColumns = make(map[string]bool)
+		for _, col := range strings.Split(v, ",") {
+			opts.QuoteColumns[strings.TrimSpace(col)] = true
+		}
+	}
+
+	opts.Include = map[string]bool{"charge": true, "jurisdiction": true, "client": true, "quarter": true, "refunds": true}
+	if v := r.FormValue("include"); v != "" {
+		opts.Include = make(map[string]bool)
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if !slices.Contains(reportNames, name) {
+				return opts, fmt.Errorf("invalid include %q: expected a comma-separated list of %s", name, strings.Join(reportNames, ", "))
+			}
+			opts.Include[name] = true
+		}
+	}
+	if r.FormValue("rate_schedule") == "true" {
+		opts.Include["schedule"] = true
+	}
+	if r.FormValue("rate_reference") == "true" {
+		opts.Include["reference"] = true
+	}
+
+	opts.SplitQuarters = r.FormValue("split_quarters") == "true"
+
+	opts.ArchiveOutput = "combined"
+	if v := r.FormValue("archive_output"); v != "" {
+		switch v {
+		case "combined", "per_file":
+			opts.ArchiveOutput = v
+		default:
+			return opts, fmt.Errorf("invalid archive_output %q: expected combined or per_file", v)
+		}
+	}
+	opts.PeriodNames = r.FormValue("period_names") == "true"
+	opts.PeriodLabel = r.FormValue("include_period_label") == "true"
+	opts.MergeSimilar = r.FormValue("merge_similar") == "true"
+	opts.Estimate = r.FormValue("estimate") == "true"
+	opts.Stream = r.FormValue("stream") == "true"
+	opts.IncludeTiming = r.FormValue("include_timing") == "true"
+	opts.PeriodFallback = r.FormValue("allow_period_fallback") == "true"
+	opts.ExcelBOM = r.FormValue("excel_bom") == "true"
+	opts.Checksums = r.FormValue("checksums") == "true"
+	opts.ExactTotals = r.FormValue("exact_totals") == "true"
+	opts.IncludeBase = r.FormValue("include_base") == "true"
+	opts.IncludeRates = r.FormValue("include_rates") == "true"
+	opts.StrictColumns = r.FormValue("strict_columns") == "true"
+
+	if v := r.FormValue("max_name_length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 3 {
+			return opts, fmt.Errorf("invalid max_name_length %q: expected a length of at least 3", v)
+		}
+		opts.MaxNameLength = n
+	}
+
+	if v := r.FormValue("preview"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("invalid preview %q: expected a positive row count", v)
+		}
+		opts.Preview = n
+	}
+
+	if v := r.FormValue("expected_total"); v != "" {
+		total, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid expected_total %q: %v", v, err)
+		}
+		opts.ExpectedTotal = &total
+	}
+
+	if opts.Stream {
+		if unsupported := streamUnsupported(r, opts); len(unsupported) > 0 {
+			return opts, fmt.Errorf("stream=true does not support %s", strings.Join(unsupported, ", "))
+		}
+	}
+
+	return opts, nil
+}
+
+// streamUnsupported lists the options of a stream=true request that
+// streamResults would not honor, so the request can be rejected rather
+// than answered with different output than was asked for.
+func streamUnsupported(r *http.Request, opts requestOptions) []string {
+	var unsupported []string
+	if opts.Format != "zip" {
+		unsupported = append(unsupported, "format="+opts.Format)
+	}
+	if acceptsJSON(r) {
+		unsupported = append(unsupported, "Accept: application/json")
+	}
+	if opts.Template != "" {
+		unsupported = append(unsupported, "template")
+	}
+	// Only due_by_charge.csv and due_by_jurisdiction.csv are streamed.
+	explicit := r.FormValue("include") != "" || opts.Include["schedule"] || opts.Include["reference"]
+	if explicit && !maps.Equal(opts.Include, map[string]bool{"charge": true, "jurisdiction": true}) {
+		unsupported = append(unsupported, "include")
+	}
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"split_quarters", opts.SplitQuarters},
+		{"period_names", opts.PeriodNames},
+		{"merge_similar", opts.MergeSimilar},
+		{"checksums", opts.Checksums},
+		{"preview", opts.Preview > 0},
+		{"estimate", opts.Estimate},
+	} {
+		if o.set {
+			unsupported = append(unsupported, o.name)
+		}
+	}
+	return unsupported
+}
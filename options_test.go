@@ -0,0 +1,87 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// optionsFor parses the request options of a request with the given query.
+func optionsFor(t *testing.T, query string) (requestOptions, error) {
+	t.Helper()
+	return parseRequestOptions(httptest.NewRequest("POST", "/getTaxRates?"+query, nil))
+}
+
+func TestIncludeSelectsReports(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"charge", "jurisdiction", "client", "quarter", "refunds"}},
+		{"include=jurisdiction", []string{"jurisdiction"}},
+		{"include=charge,+stats", []string{"charge", "stats"}},
+		{"include=client&rate_schedule=true&rate_reference=true", []string{"client", "schedule", "reference"}},
+	}
+	for _, tt := range tests {
+		opts, err := optionsFor(t, tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, name := range tt.want {
+			want[name] = true
+		}
+		if !maps.Equal(opts.Include, want) {
+			t.Errorf("%q: Include = %v, want %v", tt.query, opts.Include, want)
+		}
+	}
+
+	_, err := optionsFor(t, "include=charge,totals")
+	if err == nil || !strings.Contains(err.Error(), `invalid include "totals"`) {
+		t.Errorf("unknown report: err = %v", err)
+	}
+}
+
+func TestTimeZoneRendersTimestamps(t *testing.T) {
+	generated := time.Date(2024, 7, 1, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "2024-07-01T15:04:05Z"},
+		{"timezone=America/Chicago", "2024-07-01T10:04:05-05:00"},
+		{"timezone=Asia/Kolkata", "2024-07-01T20:34:05+05:30"},
+	}
+	for _, tt := range tests {
+		opts, err := optionsFor(t, tt.query)
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if got := (reporter{opts: opts}).timestamp(generated); got != tt.want {
+			t.Errorf("%q: timestamp = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := optionsFor(t, "timezone=Central"); err == nil || !strings.Contains(err.Error(), "invalid timezone") {
+		t.Errorf("unknown zone: err = %v", err)
+	}
+}
+
+// The zone reaches the timestamps written to the compliance report.
+func TestTimeZoneAppliesToComplianceReport(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=compliance&timezone=Asia/Kolkata", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())[complianceReportName])
+	if len(rows) < 2 || !strings.HasSuffix(rows[1][0], "+05:30") {
+		t.Errorf("%s = %v, want generated at in +05:30", complianceReportName, rows)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rateOverride replaces upstream rates for one address. When Complete is
+// set the override is treated as the full schedule and the upstream API is
+// never called for that address; otherwise the listed jurisdictions replace
+// (or are added to) whatever the API returns.
+type rateOverride struct {
+	Street   string         `json:"street"`
+	City     string         `json:"city"`
+	State    string         `json:"state"`
+	Zip      string         `json:"zip"`
+	Complete bool           `json:"complete"`
+	Rates    []overrideRate `json:"rates"`
+}
+
+type overrideRate struct {
+	Name string  `json:"name"`
+	Type string  `json:"type"`
+	Rate float64 `json:"rate"`
+}
+
+// loadRateOverrides reads the JSON override list at path.
+func loadRateOverrides(path string) ([]rateOverride, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate overrides: %v", err)
+	}
+	var overrides []rateOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("failed to parse rate overrides: %v", err)
+	}
+	for i, ov := range overrides {
+		if len(ov.Rates) == 0 {
+			return nil, fmt.Errorf("rate override %d for %s has no rates", i, ov.Street)
+		}
+	}
+	return overrides, nil
+}
+
+// matches reports whether the override is for rec's address, compared
+// under the same normalization as the rate cache, so case and spacing
+// variants of the address match.
+func (ov rateOverride) matches(rec TaxRecord) bool {
+	want := rateKey{Street: ov.Street, City: ov.City, State: ov.State, Zip: ov.Zip}.normalized()
+	got := rateKey{Street: rec.Street, City: rec.City, State: rec.State, Zip: rec.Zip}.normalized()
+	return want == got
+}
+
+// jurisdictionKey folds a jurisdiction name for comparison, ignoring case
+// and spacing.
+func jurisdictionKey(name string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(name), " "))
+}
+
+// apply merges the override into rates scraped from the API. A replaced
+// jurisdiction keeps the name the API gave it, so its column lines up with
+// other addresses' rows.
+func (ov rateOverride) apply(rates []jurisdictionRate) []jurisdictionRate {
+	upstream := make(map[string]string)
+	for _, r := range rates {
+		upstream[jurisdictionKey(r.Name)] = r.Name
+	}
+	var merged []jurisdictionRate
+	if !ov.Complete {
+		overridden := make(map[string]bool)
+		for _, r := range ov.Rates {
+			overridden[jurisdictionKey(r.Name)] = true
+		}
+		for _, r := range rates {
+			if !overridden[jurisdictionKey(r.Name)] {
+				merged = append(merged, r)
+			}
+		}
+	}
+	for _, r := range ov.Rates {
+		name := r.Name
+		if canonical, ok := upstream[jurisdictionKey(r.Name)]; ok && !ov.Complete {
+			name = canonical
+		}
+		merged = append(merged, jurisdictionRate{Name: name, Type: r.Type, Rate: r.Rate})
+	}
+	return merged
+}
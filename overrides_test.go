@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCompleteOverrideSkipsUpstream(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	os.WriteFile(path, []byte(`[
+		{"street": "1 main st", "city": "AUSTIN", "state": "TX", "zip": "78701", "complete": true,
+		 "rates": [{"name": "TEXAS STATE", "type": "STATE", "rate": 0.05}]},
+		{"street": "2 Main St", "city": "Austin", "state": "TX", "zip": "78701",
+		 "rates": [{"name": "AUSTIN", "type": "CITY", "rate": 0.02}]}
+	]`), 0o600)
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"RATE_OVERRIDES_FILE": path})
+
+	w := postCSV(t, s, "include=charge", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,100,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if n := api.calls.Load(); n != 1 {
+		t.Errorf("rate API called %d times, want 1 (for the partial override only)", n)
+	}
+
+	// Columns: charge fields, then AUSTIN and TEXAS STATE in name order.
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	got := map[string][]string{}
+	for _, row := range rows[1:] {
+		got[row[0]] = row[len(row)-2:]
+	}
+	if a := got["Acme"]; a[0] != "0.00" || a[1] != "5.00" {
+		t.Errorf("Acme AUSTIN, TEXAS STATE = %v, want only the overridden 5.00 state tax", a)
+	}
+	if b := got["Bolt"]; b[0] != "2.00" || b[1] != "6.25" {
+		t.Errorf("Bolt AUSTIN, TEXAS STATE = %v, want 2.00 and 6.25", b)
+	}
+}
+
+func TestOverrideMatchesNormalizedAddress(t *testing.T) {
+	ov := rateOverride{Street: "12  Main St ", City: "austin", State: " tx", Zip: "78701",
+		Rates: []overrideRate{{Name: "austin ", Type: "CITY", Rate: 0.02}}}
+	rec := TaxRecord{Street: "12 MAIN ST", City: "Austin", State: "TX", Zip: " 78701"}
+	if !ov.matches(rec) {
+		t.Errorf("override for %q did not match %q", ov.Street, rec.Street)
+	}
+	if rec.Zip = "78702"; ov.matches(rec) {
+		t.Error("override matched a different zip")
+	}
+
+	got := ov.apply(testRates)
+	want := []jurisdictionRate{{"TEXAS STATE", "STATE", 0.0625}, {"AUSTIN", "CITY", 0.02}}
+	if !slices.Equal(got, want) {
+		t.Errorf("apply = %v, want AUSTIN replaced under its upstream name: %v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// flagChargeOutliers warns on rows whose charge differs from the file's
+// median charge by more than factor in either direction, which usually
+// means a unit error such as cents entered as dollars. Zero charges are
+// ignored.
+func flagChargeOutliers(records []TaxRecord, factor float64) {
+	var charges []float64
+	for _, rec := range records {
+		if rec.Charge != 0 {
+			charges = append(charges, math.Abs(rec.Charge))
+		}
+	}
+	if len(charges) < 3 {
+		return
+	}
+	sort.Float64s(charges)
+	median := charges[len(charges)/2]
+	if len(charges)%2 == 0 {
+		median = (charges[len(charges)/2-1] + median) / 2
+	}
+
+	for i := range records {
+		charge := math.Abs(records[i].Charge)
+		if charge == 0 {
+			continue
+		}
+		if charge > median*factor || charge < median/factor {
+			records[i].warn("charge %.2f differs from the median charge %.2f by more than %gx; check units", records[i].Charge, median, factor)
+		}
+	}
+}
+
+// flagUnexpectedStates warns on rows outside the state a single-state filer
+// expects: expected itself, or with "auto" the state most rows are in
+// (ties going to the alphabetically first).
+func flagUnexpectedStates(records []TaxRecord, expected string) {
+	if expected == "auto" {
+		counts := make(map[string]int)
+		for _, rec := range records {
+			counts[strings.ToUpper(rec.State)]++
+		}
+		expected = mostCommonState(counts)
+	}
+	for i := range records {
+		records[i].checkState(expected)
+	}
+}
+
+// mostCommonState returns the state with the most rows in counts, which
+// is keyed by upper-cased state, ties going to the alphabetically first.
+func mostCommonState(counts map[string]int) string {
+	expected := ""
+	for state, n := range counts {
+		if n > counts[expected] || (n == counts[expected] && state < expected) {
+			expected = state
+		}
+	}
+	return expected
+}
+
+// checkState warns when the row is outside the expected state.
+func (rec *TaxRecord) checkState(expected string) {
+	if state := strings.ToUpper(rec.State); state != expected {
+		rec.warn("state %s differs from the expected state %s", rec.State, expected)
+	}
+}
+
+// chargeRange is a client's typical range of charges, from
+// CLIENT_CHARGE_RANGES_FILE. Either bound may be omitted.
+type chargeRange struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// flagClientChargeRanges warns on rows whose charge falls outside their
+// client's configured range. Clients without a range aren't checked.
+func flagClientChargeRanges(records []TaxRecord, ranges map[string]chargeRange) {
+	for i := range records {
+		if msg := chargeRangeViolation(records[i], ranges); msg != "" {
+			records[i].warn("%s", msg)
+		}
+	}
+}
+
+// chargeRangeViolation describes how rec's charge falls outside its
+// client's range, or returns "" when it is within it or unchecked.
+func chargeRangeViolation(rec TaxRecord, ranges map[string]chargeRange) string {
+	r, ok := ranges[rec.Client]
+	if !ok {
+		return ""
+	}
+	if r.Min != nil && rec.Charge < *r.Min {
+		return fmt.Sprintf("charge %.2f is below %s's usual minimum of %.2f", rec.Charge, rec.Client, *r.Min)
+	}
+	if r.Max != nil && rec.Charge > *r.Max {
+		return fmt.Sprintf("charge %.2f is above %s's usual maximum of %.2f", rec.Charge, rec.Client, *r.Max)
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// charged returns records with the given charges, for the quality checks.
+func charged(charges ...float64) []TaxRecord {
+	records := make([]TaxRecord, len(charges))
+	for i, c := range charges {
+		records[i] = TaxRecord{Client: "Acme", Charge: c}
+	}
+	return records
+}
+
+// flagged returns the indexes of records with warnings.
+func flagged(records []TaxRecord) []int {
+	var idx []int
+	for i, rec := range records {
+		if len(rec.Warnings) > 0 {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+func TestFlagChargeOutliers(t *testing.T) {
+	// Median 102.50: 12000 was likely entered in cents, 0.9 in hundreds.
+	records := charged(100, 95, 0, 12000, 110, -105, 0.9)
+	flagChargeOutliers(records, 10)
+	if got := flagged(records); len(got) != 2 || got[0] != 3 || got[1] != 6 {
+		t.Errorf("flagged rows %v, want 3 and 6", got)
+	}
+	if w := records[3].Warnings[0]; !strings.Contains(w, "median charge 102.50 by more than 10x") {
+		t.Errorf("warning = %q", w)
+	}
+
+	// Too few charges to have a meaningful median.
+	records = charged(1, 1000)
+	flagChargeOutliers(records, 10)
+	if got := flagged(records); got != nil {
+		t.Errorf("flagged rows %v in a two-row file", got)
+	}
+}
+
+func TestFlagUnexpectedStates(t *testing.T) {
+	inStates := func(states ...string) []TaxRecord {
+		records := make([]TaxRecord, len(states))
+		for i, s := range states {
+			records[i] = TaxRecord{State: s}
+		}
+		return records
+	}
+
+	records := inStates("TX", "tx", "OK", "TX", "NM")
+	flagUnexpectedStates(records, "TX")
+	if got := flagged(records); !slices.Equal(got, []int{2, 4}) {
+		t.Errorf("expecting TX: flagged rows %v, want 2 and 4", got)
+	}
+	if w := records[2].Warnings[0]; w != "state OK differs from the expected state TX" {
+		t.Errorf("warning = %q", w)
+	}
+
+	// auto expects the majority state.
+	records = inStates("OK", "TX", "OK", "OK")
+	flagUnexpectedStates(records, "auto")
+	if got := flagged(records); !slices.Equal(got, []int{1}) {
+		t.Errorf("auto: flagged rows %v, want 1", got)
+	}
+
+	records = inStates("TX", "TX")
+	flagUnexpectedStates(records, "auto")
+	if got := flagged(records); got != nil {
+		t.Errorf("single-state file: flagged rows %v", got)
+	}
+}
+
+// The warning reaches the output when EXPECTED_STATE is configured.
+func TestMixedStateUploadWarns(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"EXPECTED_STATE": "TX"})
+	w := postCSV(t, s, "include=charge", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,100,2 Main St,Tulsa,OK,74103\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	col := slices.Index(rows[0], "warnings")
+	if col < 0 || rows[1][col] != "" || !strings.Contains(rows[2][col], "differs from the expected state TX") {
+		t.Errorf("due_by_charge.csv = %v, want only Bolt warned", rows)
+	}
+}
+
+func TestClientChargeRangesFlagOutliers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.json")
+	ranges := `{"Acme": {"min": 50, "max": 500}, "Bolt": {"max": 20}}`
+	if err := os.WriteFile(path, []byte(ranges), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"CLIENT_CHARGE_RANGES_FILE": path})
+	w := postCSV(t, s, "include=charge", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Acme,1/16/2024,5000,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/17/2024,10,2 Main St,Austin,TX,78701\n"+
+		"Bolt,1/18/2024,25,2 Main St,Austin,TX,78701\n"+
+		"Cole,1/19/2024,99999,3 Main St,Austin,TX,78701\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	col := slices.Index(rows[0], "warnings")
+	if col < 0 {
+		t.Fatalf("no warnings column in %v", rows[0])
+	}
+	want := []string{
+		"",
+		"charge 5000.00 is above Acme's usual maximum of 500.00",
+		"",
+		"charge 25.00 is above Bolt's usual maximum of 20.00",
+		"", // Cole has no configured range
+	}
+	for i, row := range rows[1:] {
+		if row[col] != want[i] {
+			t.Errorf("%s %s: warnings = %q, want %q", row[0], row[2], row[col], want[i])
+		}
+	}
+
+	records := charged(10)
+	flagClientChargeRanges(records, map[string]chargeRange{"Acme": {Min: new(float64)}})
+	if got := flagged(records); got != nil {
+		t.Errorf("charge above a min-only range flagged: %v", records[0].Warnings)
+	}
+}
+
+func TestClientChargeRangesRejectInvertedRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.json")
+	if err := os.WriteFile(path, []byte(`{"Acme": {"min": 500, "max": 50}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigWith(t, map[string]string{"CLIENT_CHARGE_RANGES_FILE": path}); err == nil || !strings.Contains(err.Error(), "Acme") {
+		t.Errorf("loadConfig error = %v, want the inverted range for Acme rejected", err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// csvRowWriter is the subset of *csv.Writer used to emit report rows.
+type csvRowWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// newCSVWriter returns a writer for a report with the given header. Columns
+// named in opts.QuoteColumns are always wrapped in quotes, which csv.Writer
+// never does on its own; otherwise a plain csv.Writer is used. With
+// opts.ExcelBOM the output starts with a UTF-8 byte order mark.
+func newCSVWriter(w io.Writer, header []string, opts requestOptions) csvRowWriter {
+	if opts.ExcelBOM {
+		w = &bomWriter{w: w}
+	}
+	forced := make([]bool, len(header))
+	hasForced := false
+	for i, col := range header {
+		if opts.QuoteColumns[col] {
+			forced[i] = true
+			hasForced = true
+		}
+	}
+	if !hasForced {
+		return csv.NewWriter(w)
+	}
+	return &quotingWriter{w: bufio.NewWriter(w), forced: forced}
+}
+
+// utf8BOM lets Excel detect that a CSV is UTF-8 rather than the system
+// code page.
+const utf8BOM = "\ufeff"
+
+// bomWriter prepends utf8BOM to the first write.
+type bomWriter struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (b *bomWriter) Write(p []byte) (int, error) {
+	if !b.wrote {
+		b.wrote = true
+		if _, err := io.WriteString(b.w, utf8BOM); err != nil {
+			return 0, err
+		}
+	}
+	return b.w.Write(p)
+}
+
+// quotingWriter writes CSV using the same rules as csv.Writer, except that
+// fields in forced positions are always quoted.
+type quotingWriter struct {
+	w      *bufio.Writer
+	forced []bool
+	err    error
+}
+
+func (q *quotingWriter) Write(record []string) error {
+	if q.err != nil {
+		return q.err
+	}
+	for i, field := range record {
+		if i > 0 {
+			q.w.WriteByte(',')
+		}
+		if (i < len(q.forced) && q.forced[i]) || fieldNeedsQuotes(field) {
+			q.w.WriteByte('"')
+			q.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+			q.w.WriteByte('"')
+		} else {
+			q.w.WriteString(field)
+		}
+	}
+	_, q.err = q.w.WriteString("\n")
+	return q.err
+}
+
+func (q *quotingWriter) Flush() {
+	if err := q.w.Flush(); err != nil && q.err == nil {
+		q.err = err
+	}
+}
+
+func (q *quotingWriter) Error() error {
+	return q.err
+}
+
+// fieldNeedsQuotes mirrors the rule csv.Writer uses for a comma delimiter.
+func fieldNeedsQuotes(field string) bool {
+	if field == "" {
+		return false
+	}
+	if field == `\.` {
+		return true
+	}
+	if strings.ContainsAny(field, ",\"\r\n") {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(r)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+)
+
+func TestQuoteColumns(t *testing.T) {
+	header := []string{"client", "zip code", "total"}
+	rows := [][]string{header, {"Smith, Jones", "01234", "5.00"}, {`Say "hi"`, "", " 7"}}
+
+	var buf bytes.Buffer
+	w := newCSVWriter(&buf, header, requestOptions{QuoteColumns: map[string]bool{"zip code": true}})
+	for _, row := range rows {
+		w.Write(row)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+	want := "client,\"zip code\",total\n" +
+		"\"Smith, Jones\",\"01234\",5.00\n" +
+		"\"Say \"\"hi\"\"\",\"\",\" 7\"\n"
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// Apart from the forced quotes, the output is what csv.Writer writes.
+	var plain bytes.Buffer
+	cw := csv.NewWriter(&plain)
+	cw.WriteAll(rows)
+	got, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRows, _ := csv.NewReader(&plain).ReadAll()
+	for i := range wantRows {
+		for j := range wantRows[i] {
+			if got[i][j] != wantRows[i][j] {
+				t.Errorf("row %d field %d = %q, want %q", i, j, got[i][j], wantRows[i][j])
+			}
+		}
+	}
+}
+
+func TestExcelBOM(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	body := testHeader + "Café Olé,1/15/2024,100,1 Main St,Austin,TX,78701\n"
+	for _, query := range []string{"include=client,charge&excel_bom=true", "include=client,charge&quote_columns=client&excel_bom=true", "include=client,charge"} {
+		want := strings.Contains(query, "excel_bom=true")
+		files := unzip(t, postCSV(t, s, query, body).Body.Bytes())
+		for name, data := range files {
+			if !strings.HasSuffix(name, ".csv") {
+				continue
+			}
+			if strings.HasPrefix(data, utf8BOM) != want {
+				t.Errorf("%s: %s starts with a BOM = %v, want %v", query, name, !want, want)
+			}
+			if strings.Count(data, utf8BOM) > 1 {
+				t.Errorf("%s: %s has more than one BOM", query, name)
+			}
+		}
+		if !strings.Contains(files["due_by_client.csv"], "Café Olé") {
+			t.Errorf("%s: client name not written as UTF-8: %q", query, files["due_by_client.csv"])
+		}
+	}
+}
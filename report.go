@@ -0,0 +1,966 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// outputFile is one CSV in the result archive. Build produces its rows and
+// may run concurrently with the other files' builders.
+type outputFile struct {
+	Name  string
+	Build func() [][]string
+}
+
+// outputFiles assembles every CSV requested for records, in archive order.
+func (rp reporter) outputFiles(records []TaxRecord) []outputFile {
+	if tmpl, ok := outputTemplates[rp.opts.Template]; ok {
+		return append(tmpl(rp, records), rp.errorFiles()...)
+	}
+
+	groups := []recordGroup{{records: records}}
+	if rp.opts.ArchiveOutput == "per_file" {
+		groups = splitBySource(records)
+	}
+	if rp.opts.SplitQuarters {
+		var byQuarter []recordGroup
+		for _, g := range groups {
+			for _, q := range splitByQuarter(g.records) {
+				byQuarter = append(byQuarter, recordGroup{prefix: g.prefix + q.prefix, records: q.records})
+			}
+		}
+		groups = byQuarter
+	}
+
+	var files []outputFile
+	for _, g := range groups {
+		if rp.opts.Include["charge"] {
+			jurisNames := getAllJurisNames(g.records)
+			files = append(files, outputFile{g.prefix + "due_by_charge.csv", func() [][]string {
+				return rp.dueByChargeRows(g.records, jurisNames)
+			}})
+		}
+		if rp.opts.Include["jurisdiction"] {
+			files = append(files, outputFile{g.prefix + "due_by_jurisdiction.csv", func() [][]string {
+				return rp.dueByJurisdictionRows(g.records)
+			}})
+		}
+		if rp.opts.Include["client"] {
+			files = append(files, outputFile{g.prefix + "due_by_client.csv", func() [][]string {
+				return rp.dueByClientRows(g.records)
+			}})
+		}
+		if rp.opts.Include["quarter"] {
+			files = append(files, outputFile{g.prefix + "due_by_quarter.csv", func() [][]string {
+				return rp.dueByQuarterRows(g.records)
+			}})
+		}
+		if refunds := negativeCharges(g.records); rp.opts.Include["refunds"] && len(refunds) > 0 {
+			files = append(files, outputFile{g.prefix + "refunds.csv", func() [][]string {
+				return rp.dueByChargeRows(refunds, getAllJurisNames(refunds))
+			}})
+		}
+	}
+	if rp.opts.Include["schedule"] {
+		files = append(files, outputFile{"rate_schedule.csv", func() [][]string {
+			return rp.rateScheduleRows(records)
+		}})
+	}
+	if rp.opts.Include["reference"] {
+		files = append(files, outputFile{"rate_reference.csv", func() [][]string {
+			return rp.rateReferenceRows(records)
+		}})
+	}
+	if rp.opts.MergeSimilar {
+		files = append(files, outputFile{"merged_jurisdictions.csv", rp.mergeRows})
+	}
+	if rp.opts.Include["compliance"] {
+		generated := time.Now()
+		files = append(files, outputFile{complianceReportName, func() [][]string {
+			return rp.complianceRows(records, generated)
+		}})
+	}
+	if rp.opts.Include["stats"] {
+		files = append(files, outputFile{"stats.csv", func() [][]string {
+			return rp.statsRows(records)
+		}})
+	}
+
+	if rp.opts.PeriodNames {
+		if suffix, ok := singlePeriod(records); ok {
+			for i := range files {
+				files[i].Name = strings.TrimSuffix(files[i].Name, ".csv") + "_" + suffix + ".csv"
+			}
+		}
+	}
+	return append(files, rp.errorFiles()...)
+}
+
+// errorFiles returns errors.csv when any rows were skipped.
+func (rp reporter) errorFiles() []outputFile {
+	if len(rp.rowErrors) == 0 {
+		return nil
+	}
+	return []outputFile{{"errors.csv", func() [][]string {
+		return rowErrorRows(rp.rowErrors)
+	}}}
+}
+
+// negativeCharges returns the refund and credit rows among records, which
+// are also listed in refunds.csv for review. Their taxes are negative and
+// offset the other rows' in every total.
+func negativeCharges(records []TaxRecord) []TaxRecord {
+	var refunds []TaxRecord
+	for _, rec := range records {
+		if rec.Charge < 0 {
+			refunds = append(refunds, rec)
+		}
+	}
+	return refunds
+}
+
+// singlePeriod returns the reporting period shared by every record, as
+// e.g. "2024Q1", or false when the records span several periods.
+func singlePeriod(records []TaxRecord) (string, bool) {
+	if len(records) == 0 {
+		return "", false
+	}
+	year, quarter := records[0].Year, records[0].Quarter
+	for _, rec := range records[1:] {
+		if rec.Year != year || rec.Quarter != quarter {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%dQ%d", year, quarter), true
+}
+
+// recordGroup is a subset of records written under a common ZIP directory.
+type recordGroup struct {
+	prefix  string
+	records []TaxRecord
+}
+
+// splitByQuarter groups records by reporting period, in chronological
+// order. Directories are named "Q1/" etc., or "2024Q1/" when the records
+// span more than one year.
+func splitByQuarter(records []TaxRecord) []recordGroup {
+	type period struct{ year, quarter int }
+	byPeriod := make(map[period][]TaxRecord)
+	years := make(map[int]bool)
+	for _, rec := range records {
+		p := period{rec.Year, rec.Quarter}
+		byPeriod[p] = append(byPeriod[p], rec)
+		years[rec.Year] = true
+	}
+
+	periods := make([]period, 0, len(byPeriod))
+	for p := range byPeriod {
+		periods = append(periods, p)
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		if periods[i].year != periods[j].year {
+			return periods[i].year < periods[j].year
+		}
+		return periods[i].quarter < periods[j].quarter
+	})
+
+	groups := make([]recordGroup, 0, len(periods))
+	for _, p := range periods {
+		prefix := fmt.Sprintf("Q%d/", p.quarter)
+		if len(years) > 1 {
+			prefix = fmt.Sprintf("%dQ%d/", p.year, p.quarter)
+		}
+		groups = append(groups, recordGroup{prefix: prefix, records: byPeriod[p]})
+	}
+	return groups
+}
+
+// buildFiles runs the files' Build functions on up to cfg.OutputWorkers
+// goroutines, delivering each file's rows on the channel at the same index.
+// A worker slot is taken from sem before each build starts and must be
+// returned by the consumer once it has written that file, so no more than
+// OutputWorkers tables are held in memory at once. Closing done stops
+// files from being started.
+func (rp reporter) buildFiles(files []outputFile, sem chan struct{}, done <-chan struct{}) []chan [][]string {
+	built := make([]chan [][]string, len(files))
+	for i := range built {
+		built[i] = make(chan [][]string, 1)
+	}
+	go func() {
+		for i, f := range files {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func() { built[i] <- f.Build() }()
+		}
+	}()
+	return built
+}
+
+// writeCSV renders rows as CSV to w, honoring the request's quoting
+// options.
+func (rp reporter) writeCSV(w io.Writer, rows [][]string) error {
+	var header []string
+	if len(rows) > 0 {
+		header = rows[0]
+	}
+	csvWriter := newCSVWriter(w, header, rp.opts)
+	for _, row := range rows {
+		if err := csvWriter.Write(row); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+// encodeCSV renders rows as CSV, honoring the request's quoting options.
+func (rp reporter) encodeCSV(rows [][]string) ([]byte, error) {
+	csvBuf := new(bytes.Buffer)
+	if err := rp.writeCSV(csvBuf, rows); err != nil {
+		return nil, err
+	}
+	return csvBuf.Bytes(), nil
+}
+
+// writeZip builds files, plus checksums.txt when requested, and writes them
+// as a ZIP archive to dst. Each file is encoded straight into its ZIP entry
+// as soon as it is built; only the compliance report is also kept in
+// memory, since its signature needs the whole encoded file.
+func (rp reporter) writeZip(dst io.Writer, files []outputFile) error {
+	zipWriter := zip.NewWriter(dst)
+	sem := make(chan struct{}, max(rp.cfg.OutputWorkers, 1))
+	done := make(chan struct{})
+	defer close(done)
+	built := rp.buildFiles(files, sem, done)
+
+	type signature struct {
+		name string
+		data []byte
+	}
+	var (
+		sigs     []signature
+		manifest bytes.Buffer
+	)
+	for i, f := range files {
+		rows := <-built[i]
+		var tee []io.Writer
+		hash := sha256.New()
+		if rp.opts.Checksums {
+			tee = append(tee, hash)
+		}
+		// period_names may have added a suffix to the name.
+		var report *bytes.Buffer
+		if rp.cfg.ComplianceKey != nil && strings.HasPrefix(f.Name, strings.TrimSuffix(complianceReportName, ".csv")) {
+			report = new(bytes.Buffer)
+			tee = append(tee, report)
+		}
+		err := rp.writeCSVEntry(zipWriter, f.Name, rows, tee...)
+		<-sem
+		if err != nil {
+			return err
+		}
+		if report != nil {
+			sigs = append(sigs, signature{f.Name + ".sig", complianceSignature(rp.cfg.ComplianceKey, report.Bytes())})
+		}
+		if rp.opts.Checksums {
+			fmt.Fprintf(&manifest, "%x  %s\n", hash.Sum(nil), f.Name)
+		}
+	}
+	for _, sig := range sigs {
+		if err := writeZipEntry(zipWriter, sig.name, sig.data); err != nil {
+			return err
+		}
+	}
+	if rp.opts.Checksums {
+		if err := writeZipEntry(zipWriter, "checksums.txt", manifest.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("error closing ZIP writer: %v", err)
+	}
+	return nil
+}
+
+// writeZipEntry stores data in the ZIP under name.
+func writeZipEntry(zipWriter *zip.Writer, name string, data []byte) error {
+	log.Printf("%s content length: %d bytes", name, len(data))
+	f, err := zipWriter.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s ZIP entry: %v", name, err)
+	}
+	n, err := f.Write(data)
+	if err != nil {
+		return fmt.Errorf("error writing %s to ZIP: %v", name, err)
+	}
+	log.Printf("%s written to ZIP: %d bytes", name, n)
+	return nil
+}
+
+// writeCSVEntry encodes rows as CSV straight into a new ZIP entry under
+// name, also copying the encoded bytes to each of tee.
+func (rp reporter) writeCSVEntry(zipWriter *zip.Writer, name string, rows [][]string, tee ...io.Writer) error {
+	f, err := zipWriter.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s ZIP entry: %v", name, err)
+	}
+	if err := rp.writeCSV(io.MultiWriter(append([]io.Writer{f}, tee...)...), rows); err != nil {
+		return fmt.Errorf("error writing %s: %v", name, err)
+	}
+	log.Printf("%s written to ZIP: %d rows", name, len(rows))
+	return nil
+}
+
+// reporter builds the output tables for one request, applying both the
+// process-wide configuration and the request's options.
+type reporter struct {
+	cfg  Config
+	opts requestOptions
+
+	// merges maps jurisdiction names folded by merge_similar to the name
+	// they were merged into.
+	merges map[string]string
+
+	// rowErrors are the rows left out of the records, listed in
+	// errors.csv and counted in stats.csv.
+	rowErrors []RowError
+
+	// shortNames maps jurisdiction labels longer than max_name_length to
+	// their truncated form; see shortenNames.
+	shortNames map[string]string
+}
+
+// amount formats a monetary value per the request's locale or number
+// format. The value is first rounded to cents with toCents, the same
+// rounding jurisdictionTotals applies, so a total always equals the sum of
+// the amounts displayed for its rows; formatting the float directly would
+// round binary halves like 0.125 the other way.
+func (rp reporter) amount(v float64) string {
+	v = float64(toCents(v)) / 100
+	if rp.opts.Locale != nil {
+		return formatLocalized(v, rp.opts, rp.cfg.BaseCurrency)
+	}
+	return formatAmount(v, rp.opts)
+}
+
+// timestamp renders t for a report in the request's time zone.
+func (rp reporter) timestamp(t time.Time) string {
+	loc := rp.opts.TimeZone
+	if loc == nil {
+		loc = time.UTC
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// displayName returns the label used for a jurisdiction in output. Totals
+// are always keyed by the canonical API name; only the rendering changes.
+func (rp reporter) displayName(juris string) string {
+	label := juris
+	if alias, ok := rp.cfg.JurisdictionAliases[juris]; ok {
+		label = alias
+	}
+	if short, ok := rp.shortNames[label]; ok {
+		return short
+	}
+	return label
+}
+
+// shortenNames returns the shortNames for jurisNames under the request's
+// max_name_length, or nil when there is no limit. A label whose truncation
+// is already taken ends in "~2", "~3", ... instead, so columns stay
+// distinct. Labels are shortened in sorted order, so the same set of names
+// always comes out the same way.
+func (rp reporter) shortenNames(jurisNames []string) map[string]string {
+	limit := rp.opts.MaxNameLength
+	if limit <= 0 {
+		return nil
+	}
+	var labels []string
+	taken := make(map[string]bool)
+	for _, juris := range jurisNames {
+		label := rp.displayName(juris)
+		if utf8.RuneCountInString(label) <= limit {
+			taken[label] = true
+		} else if !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	short := make(map[string]string, len(labels))
+	for _, label := range labels {
+		name := truncateRunes(label, limit)
+		for n := 2; taken[name]; n++ {
+			suffix := "~" + strconv.Itoa(n)
+			name = truncateRunes(label, max(limit-len(suffix), 0)) + suffix
+		}
+		taken[name] = true
+		short[label] = name
+	}
+	return short
+}
+
+// truncateRunes returns the first n runes of s, without trailing spaces.
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return strings.TrimRight(s[:i], " ")
+		}
+		n--
+	}
+	return s
+}
+
+// recordJurisNames returns every jurisdiction named in records' rate
+// schedules or taxes, including those that taxed nothing.
+func recordJurisNames(records []TaxRecord) []string {
+	var names []string
+	for _, rec := range records {
+		for _, rate := range rec.Rates {
+			names = append(names, rate.Name)
+		}
+		for juris := range rec.Taxes {
+			names = append(names, juris)
+		}
+	}
+	return names
+}
+
+// chargeLayout describes the optional columns of due_by_charge.csv, which
+// depend on what the records contain.
+type chargeLayout struct {
+	currency      bool
+	exemption     bool
+	warnings      bool
+	chargeColumns []string
+	jurisNames    []string
+}
+
+// observe widens the layout to fit rec. Charge columns stay in the order
+// of columns, whatever order the rows using them arrive in. jurisNames is
+// not touched.
+func (l *chargeLayout) observe(rec TaxRecord, columns []chargeColumn) {
+	l.currency = l.currency || rec.Currency != ""
+	l.exemption = l.exemption || rec.Exemption != ""
+	l.warnings = l.warnings || len(rec.Warnings) > 0
+	var present []string
+	for _, col := range columns {
+		if _, ok := rec.ColumnCharges[col.Name]; ok || slices.Contains(l.chargeColumns, col.Name) {
+			present = append(present, col.Name)
+		}
+	}
+	l.chargeColumns = present
+}
+
+func (rp reporter) dueByChargeRows(records []TaxRecord, jurisNames []string) [][]string {
+	layout := chargeLayout{jurisNames: jurisNames}
+	for _, rec := range records {
+		layout.observe(rec, rp.cfg.ChargeColumns)
+	}
+	rows := [][]string{rp.chargeHeader(layout)}
+	for _, rec := range records {
+		rows = append(rows, rp.chargeRow(rec, layout))
+	}
+	return rows
+}
+
+func (rp reporter) chargeHeader(layout chargeLayout) []string {
+	headers := append([]string{}, requiredColumns...)
+	if rp.opts.PeriodLabel {
+		headers = append(headers, "period")
+	}
+	if layout.currency {
+		headers = append(headers, "currency", "original charge")
+	}
+	if rp.opts.Basis == "gross" {
+		headers = append(headers, "net charge")
+	}
+	for _, col := range layout.chargeColumns {
+		headers = append(headers, col, col+" tax")
+		if layout.currency {
+			headers = append(headers, "original "+col)
+		}
+	}
+	if layout.exemption {
+		headers = append(headers, "exemption")
+	}
+	if layout.warnings {
+		headers = append(headers, "warnings")
+	}
+	if rp.opts.IncludeTiming {
+		headers = append(headers, "lookup ms")
+	}
+	for _, juris := range layout.jurisNames {
+		headers = append(headers, rp.displayName(juris))
+		if rp.opts.IncludeRates {
+			headers = append(headers, rp.displayName(juris)+" rate")
+		}
+	}
+	return headers
+}
+
+func (rp reporter) chargeRow(rec TaxRecord, layout chargeLayout) []string {
+	row := []string{
+		rec.Client,
+		rec.Date,
+		rp.amount(rec.Charge),
+		rec.Street,
+		rec.City,
+		rec.State,
+		rec.Zip,
+	}
+	if rp.opts.PeriodLabel {
+		row = append(row, periodLabel(rec))
+	}
+	if layout.currency {
+		row = append(row, rec.Currency, rp.amount(rec.OriginalCharge))
+	}
+	if rp.opts.Basis == "gross" {
+		row = append(row, rp.amount(rec.NetCharge))
+	}
+	for _, col := range layout.chargeColumns {
+		row = append(row, rp.amount(rec.ColumnCharges[col]), rp.amount(rec.ColumnTaxes[col]))
+		if layout.currency {
+			row = append(row, rp.amount(rec.OriginalColumnCharges[col]))
+		}
+	}
+	if layout.exemption {
+		row = append(row, rec.Exemption)
+	}
+	if layout.warnings {
+		row = append(row, strings.Join(rec.Warnings, "; "))
+	}
+	if rp.opts.IncludeTiming {
+		row = append(row, strconv.FormatFloat(float64(rec.LookupDuration.Microseconds())/1000, 'f', 3, 64))
+	}
+	for _, juris := range layout.jurisNames {
+		tax := rec.Taxes[juris]
+		row = append(row, rp.amount(tax))
+		if rp.opts.IncludeRates {
+			row = append(row, jurisdictionRateOf(rec, juris))
+		}
+	}
+	return row
+}
+
+// jurisdictionRateOf returns the rate rec's rate schedule gives juris, or
+// "" when juris isn't in it, e.g. for the minimum tax bucket.
+func jurisdictionRateOf(rec TaxRecord, juris string) string {
+	total, found := 0.0, false
+	for _, rate := range rec.Rates {
+		if rate.Name == juris {
+			total += rate.Rate
+			found = true
+		}
+	}
+	if !found {
+		return ""
+	}
+	return strconv.FormatFloat(total, 'f', -1, 64)
+}
+
+// periodLabel returns the human-readable filing period of rec, e.g.
+// "Q1 2024".
+func periodLabel(rec TaxRecord) string {
+	return fmt.Sprintf("Q%d %d", rec.Quarter, rec.Year)
+}
+
+func (rp reporter) dueByJurisdictionRows(records []TaxRecord) [][]string {
+	totals := newJurisdictionTotals(rp.opts.Rounding)
+	for _, rec := range records {
+		totals.add(rec)
+	}
+	return rp.jurisdictionTotalRows(totals)
+}
+
+// dueByClientRows totals each client's charges and taxes over all of its
+// rows, sorted by client. Like the row rounding of due_by_jurisdiction.csv,
+// each amount is rounded to cents before it is summed, so a client's total
+// tax equals the sum of its amounts in due_by_charge.csv.
+func (rp reporter) dueByClientRows(records []TaxRecord) [][]string {
+	type clientTotal struct{ charge, tax int64 }
+	totals := make(map[string]*clientTotal)
+	for _, rec := range records {
+		t, ok := totals[rec.Client]
+		if !ok {
+			t = &clientTotal{}
+			totals[rec.Client] = t
+		}
+		t.charge += toCents(rec.Charge)
+		for _, tax := range rec.Taxes {
+			t.tax += toCents(tax)
+		}
+	}
+	clients := make([]string, 0, len(totals))
+	for client := range totals {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	rows := [][]string{{"client", "total charge", "total tax"}}
+	for _, client := range clients {
+		t := totals[client]
+		rows = append(rows, []string{client, rp.amount(float64(t.charge) / 100), rp.amount(float64(t.tax) / 100)})
+	}
+	return rows
+}
+
+// dueByQuarterRows totals the tax of each reporting period, in
+// chronological order. A row's period is that of its charge date, also
+// when a period fallback priced it with an earlier quarter's rates. As in
+// dueByClientRows, amounts are rounded to cents before they are summed.
+func (rp reporter) dueByQuarterRows(records []TaxRecord) [][]string {
+	type period struct{ year, quarter int }
+	totals := make(map[period]int64)
+	for _, rec := range records {
+		p := period{rec.Year, rec.Quarter}
+		totals[p] += 0
+		for _, tax := range rec.Taxes {
+			totals[p] += toCents(tax)
+		}
+	}
+	periods := make([]period, 0, len(totals))
+	for p := range totals {
+		periods = append(periods, p)
+	}
+	sort.Slice(periods, func(i, j int) bool {
+		if periods[i].year != periods[j].year {
+			return periods[i].year < periods[j].year
+		}
+		return periods[i].quarter < periods[j].quarter
+	})
+
+	rows := [][]string{{"year", "quarter", "total tax"}}
+	for _, p := range periods {
+		rows = append(rows, []string{strconv.Itoa(p.year), strconv.Itoa(p.quarter), rp.amount(float64(totals[p]) / 100)})
+	}
+	return rows
+}
+
+// jurisdictionTotalRows renders totals sorted by jurisdiction name, so the
+// file is identical however the input rows were ordered. With exact_totals
+// an "unrounded total" column carries the full-precision amount the
+// displayed total was rounded from, and with include_base a "taxable base"
+// column the amount the jurisdiction's tax was computed on.
+func (rp reporter) jurisdictionTotalRows(totals *jurisdictionTotals) [][]string {
+	jurisTotals := totals.totals()
+	names := make([]string, 0, len(jurisTotals))
+	for juris := range jurisTotals {
+		names = append(names, juris)
+	}
+	sort.Strings(names)
+
+	header := []string{"Jurisdiction", "total"}
+	var unrounded map[string]float64
+	if rp.opts.ExactTotals {
+		header = append(header, "unrounded total")
+		unrounded = totals.unrounded()
+	}
+	var bases map[string]float64
+	if rp.opts.IncludeBase {
+		header = append(header, "taxable base")
+		bases = totals.taxableBases()
+	}
+	rows := [][]string{header}
+	for _, juris := range names {
+		row := []string{rp.displayName(juris), rp.amount(jurisTotals[juris])}
+		if unrounded != nil {
+			row = append(row, strconv.FormatFloat(unrounded[juris], 'f', 6, 64))
+		}
+		if bases != nil {
+			row = append(row, rp.amount(bases[juris]))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// statsRows summarizes the job for reviewers. The effective rate is total
+// tax over the total taxable (net) charge.
+func (rp reporter) statsRows(records []TaxRecord) [][]string {
+	var totalCharge, totalNet, totalTax float64
+	addresses := make(map[rateKey]bool)
+	jurisdictions := make(map[string]bool)
+	for _, rec := range records {
+		totalCharge += rec.Charge
+		totalNet += rec.NetCharge
+		key := rec.rateKey().normalized()
+		key.Quarter, key.Year = 0, 0
+		addresses[key] = true
+		for juris, tax := range rec.Taxes {
+			totalTax += tax
+			jurisdictions[juris] = true
+		}
+	}
+	effectiveRate := 0.0
+	if totalNet != 0 {
+		effectiveRate = totalTax / totalNet
+	}
+	return [][]string{
+		{"statistic", "value"},
+		{"rows", strconv.Itoa(len(records))},
+		{"total charge", rp.amount(totalCharge)},
+		{"total tax", rp.amount(totalTax)},
+		{"effective rate", strconv.FormatFloat(effectiveRate, 'f', 6, 64)},
+		{"unique addresses", strconv.Itoa(len(addresses))},
+		{"jurisdictions", strconv.Itoa(len(jurisdictions))},
+		{"failed rows", strconv.Itoa(len(rp.rowErrors))},
+	}
+}
+
+// rowErrorRows lists the rows skipped by processCSV and why.
+func rowErrorRows(rowErrors []RowError) [][]string {
+	withFile := slices.ContainsFunc(rowErrors, func(e RowError) bool { return e.File != "" })
+	header := []string{"line", "client", "reason"}
+	if withFile {
+		header = append([]string{"file"}, header...)
+	}
+	rows := [][]string{header}
+	for _, e := range rowErrors {
+		row := []string{strconv.Itoa(e.Line), e.Client, e.Reason}
+		if withFile {
+			row = append([]string{e.File}, row...)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// rateScheduleRows lists the full jurisdiction rate schedule returned for
+// each unique address and period, independent of any charge amount. With
+// a FIPS resolver configured, each jurisdiction's FIPS code is added.
+func (rp reporter) rateScheduleRows(records []TaxRecord) [][]string {
+	header := []string{"street address", "city", "State", "zip code", "quarter", "year", "jurisdiction", "type", "rate"}
+	if rp.cfg.FIPS != nil {
+		header = append(header, "fips")
+	}
+	rows := [][]string{header}
+	seen := make(map[rateKey]bool)
+	for _, rec := range records {
+		key := rec.rateKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, rate := range rec.Rates {
+			row := []string{
+				rec.Street,
+				rec.City,
+				rec.State,
+				rec.Zip,
+				strconv.Itoa(rec.Quarter),
+				strconv.Itoa(rec.Year),
+				rp.displayName(rate.Name),
+				rate.Type,
+				strconv.FormatFloat(rate.Rate, 'f', -1, 64),
+			}
+			if rp.cfg.FIPS != nil {
+				row = append(row, rp.cfg.FIPS.fipsCode(key, rate))
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// rateReferenceRows lists each jurisdiction encountered with the rate used.
+// A jurisdiction that was returned with different rates at different
+// addresses gets one row per distinct rate, with the number of addresses.
+// Rows are ordered by name, rate and then type, so none are left tied.
+func (rp reporter) rateReferenceRows(records []TaxRecord) [][]string {
+	type refKey struct {
+		Name string
+		Type string
+		Rate float64
+	}
+	counts := make(map[refKey]int)
+	seen := make(map[rateKey]bool)
+	for _, rec := range records {
+		key := rec.rateKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for _, rate := range rec.Rates {
+			counts[refKey{rate.Name, rate.Type, rate.Rate}]++
+		}
+	}
+
+	keys := make([]refKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate < keys[j].Rate
+		}
+		return keys[i].Type < keys[j].Type
+	})
+
+	rows := [][]string{{"jurisdiction", "type", "rate", "addresses"}}
+	for _, k := range keys {
+		rows = append(rows, []string{
+			rp.displayName(k.Name),
+			k.Type,
+			strconv.FormatFloat(k.Rate, 'f', -1, 64),
+			strconv.Itoa(counts[k]),
+		})
+	}
+	return rows
+}
+
+// mergeRows reports the jurisdiction columns folded by merge_similar.
+func (rp reporter) mergeRows() [][]string {
+	from := make([]string, 0, len(rp.merges))
+	for name := range rp.merges {
+		from = append(from, name)
+	}
+	sort.Strings(from)
+
+	rows := [][]string{{"jurisdiction", "merged into"}}
+	for _, name := range from {
+		rows = append(rows, []string{name, rp.merges[name]})
+	}
+	return rows
+}
+
+// recordJSON is the JSON representation of a processed row.
+type recordJSON struct {
+	Client string             `json:"client"`
+	Date   string             `json:"date"`
+	Charge float64            `json:"charge"`
+	Street string             `json:"street"`
+	City   string             `json:"city"`
+	State  string             `json:"state"`
+	Zip    string             `json:"zip"`
+	Taxes  map[string]float64 `json:"taxes"`
+
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (rp reporter) recordJSON(rec TaxRecord) recordJSON {
+	taxes := make(map[string]float64, len(rec.Taxes))
+	for juris, tax := range rec.Taxes {
+		taxes[rp.displayName(juris)] += tax
+	}
+	return recordJSON{
+		Client: rec.Client,
+		Date:   rec.Date,
+		Charge: rec.Charge,
+		Street: rec.Street,
+		City:   rec.City,
+		State:  rec.State,
+		Zip:    rec.Zip,
+		Taxes:  taxes,
+
+		Warnings: rec.Warnings,
+	}
+}
+
+// writePreview responds with the first processed rows as JSON.
+func (rp reporter) writePreview(w http.ResponseWriter, records []TaxRecord) {
+	rows := make([]recordJSON, 0, len(records))
+	for _, rec := range records {
+		rows = append(rows, rp.recordJSON(rec))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"rows": rows}); err != nil {
+		log.Printf("Error writing preview response: %v", err)
+		return
+	}
+	log.Printf("Wrote preview of %d rows", len(rows))
+}
+
+// writeJSONResults responds with the processed records, the total due per
+// jurisdiction and any skipped rows as one JSON document.
+func (rp reporter) writeJSONResults(w http.ResponseWriter, result taxResult) {
+	rows := make([]recordJSON, 0, len(result.Records))
+	totals := newJurisdictionTotals(rp.opts.Rounding)
+	for _, rec := range result.Records {
+		rows = append(rows, rp.recordJSON(rec))
+		totals.add(rec)
+	}
+	jurisTotals := make(map[string]float64)
+	for juris, total := range totals.totals() {
+		jurisTotals[rp.displayName(juris)] += total
+	}
+	rowErrors := make([]rowErrorJSON, 0, len(result.RowErrors))
+	for _, e := range result.RowErrors {
+		rowErrors = append(rowErrors, rowErrorJSON(e))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"records": rows,
+		"totals":  jurisTotals,
+		"errors":  rowErrors,
+	}); err != nil {
+		log.Printf("Error writing JSON results: %v", err)
+	}
+}
+
+// rowErrorJSON is the JSON representation of a skipped row.
+type rowErrorJSON struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line"`
+	Client string `json:"client"`
+	Reason string `json:"reason"`
+}
+
+// writeEstimate responds with the number of rows and the number of distinct
+// upstream lookups (unique address and period) the file would require.
+func writeEstimate(w http.ResponseWriter, records []TaxRecord) {
+	unique := make(map[rateKey]bool)
+	for _, rec := range records {
+		unique[rec.rateKey().normalized()] = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{
+		"rows":             len(records),
+		"unique_addresses": len(unique),
+	}); err != nil {
+		log.Printf("Error writing estimate response: %v", err)
+	}
+}
+
+// writeEnvelope responds with the file embedded as base64 in a JSON object,
+// for clients that cannot easily handle a binary download.
+func writeEnvelope(w http.ResponseWriter, filename, contentType string, data []byte) {
+	envelope := struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+		Data        string `json:"data"`
+	}{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        base64.StdEncoding.EncodeToString(data),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(envelope); err != nil {
+		log.Printf("Error writing JSON envelope: %v", err)
+		return
+	}
+	log.Printf("Wrote %s as JSON envelope (%d bytes before encoding)", filename, len(data))
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fileNames returns the sorted names of files.
+func fileNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+const refundUpload = testHeader +
+	"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+	"Acme,4/15/2024,(40.00),1 Main St,Austin,TX,78701\n" +
+	"Bolt,4/16/2024,50,2 Main St,Austin,TX,78701\n"
+
+func TestRefundsFollowInclude(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"due_by_charge.csv", "due_by_client.csv", "due_by_jurisdiction.csv", "due_by_quarter.csv", "refunds.csv"}},
+		{"include=client", []string{"due_by_client.csv"}},
+		{"include=refunds", []string{"refunds.csv"}},
+		{"include=charge,refunds&split_quarters=true", []string{"Q1/due_by_charge.csv", "Q2/due_by_charge.csv", "Q2/refunds.csv"}},
+	}
+	for _, tt := range tests {
+		w := postCSV(t, s, tt.query, refundUpload)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tt.query, w.Code, w.Body)
+		}
+		files := unzip(t, w.Body.Bytes())
+		if got := fileNames(files); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: files = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	w := postCSV(t, s, "include=refunds", refundUpload)
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["refunds.csv"])
+	if len(rows) != 2 || rows[1][2] != "-40.00" {
+		t.Errorf("refunds.csv = %v, want the one -40.00 row", rows)
+	}
+}
+
+func TestRateScheduleListsEachAddressOnce(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=charge&rate_schedule=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Acme,2/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,50,2 Main St,Austin,TX,78702\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["rate_schedule.csv"])
+	want := [][]string{
+		{"street address", "city", "State", "zip code", "quarter", "year", "jurisdiction", "type", "rate"},
+		{"1 Main St", "Austin", "TX", "78701", "1", "2024", "TEXAS STATE", "STATE", "0.0625"},
+		{"1 Main St", "Austin", "TX", "78701", "1", "2024", "AUSTIN", "CITY", "0.01"},
+		{"2 Main St", "Austin", "TX", "78702", "1", "2024", "TEXAS STATE", "STATE", "0.0625"},
+		{"2 Main St", "Austin", "TX", "78702", "1", "2024", "AUSTIN", "CITY", "0.01"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("rate_schedule.csv = %v, want %v", rows, want)
+	}
+}
+
+func TestPreviewProcessesFirstRows(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, nil)
+	var body strings.Builder
+	body.WriteString(testHeader)
+	for i := range 5 {
+		fmt.Fprintf(&body, "C%d,1/15/2024,100,%d Main St,Austin,TX,78701\n", i, i)
+	}
+	w := postCSV(t, s, "preview=2", body.String())
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var resp struct{ Rows []recordJSON }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rows) != 2 || resp.Rows[0].Client != "C0" || resp.Rows[1].Client != "C1" {
+		t.Fatalf("preview rows = %+v, want C0 and C1", resp.Rows)
+	}
+	if tax := resp.Rows[0].Taxes["TEXAS STATE"]; tax != 6.25 {
+		t.Errorf("C0 TEXAS STATE = %v, want 6.25", tax)
+	}
+	if n := api.calls.Load(); n != 2 {
+		t.Errorf("rate API called %d times, want 2", n)
+	}
+}
+
+func TestJurisdictionAliasesRelabelOutput(t *testing.T) {
+	rp := reporter{
+		cfg:  Config{JurisdictionAliases: map[string]string{"TEXAS STATE": "Texas", "AUSTIN": "City of Austin"}},
+		opts: requestOptions{NumberFormat: "fixed", Rounding: "row"},
+	}
+	records := []TaxRecord{
+		{Client: "Acme", Charge: 100, Taxes: map[string]float64{"TEXAS STATE": 6.25, "AUSTIN": 1}},
+		{Client: "Bolt", Charge: 200, Taxes: map[string]float64{"TEXAS STATE": 12.5, "AUSTIN": 2}},
+	}
+	got := rp.dueByJurisdictionRows(records)
+	want := [][]string{{"Jurisdiction", "total"}, {"City of Austin", "3.00"}, {"Texas", "18.75"}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("due_by_jurisdiction.csv = %v, want %v", got, want)
+	}
+	if got := rp.displayName("TRAVIS COUNTY"); got != "TRAVIS COUNTY" {
+		t.Errorf("unaliased name rendered as %q", got)
+	}
+}
+
+func TestJurisdictionAliasesRejectSharedLabel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.json")
+	aliases := `{"HARRIS CO": "Harris County", "HARRIS COUNTY": "Harris County", "AUSTIN": "City of Austin"}`
+	if err := os.WriteFile(path, []byte(aliases), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadConfigWith(t, map[string]string{"JURISDICTION_ALIASES_FILE": path})
+	if err == nil || !strings.Contains(err.Error(), `HARRIS CO and HARRIS COUNTY are both labeled "Harris County"`) {
+		t.Errorf("loadConfig error = %v, want the shared label rejected", err)
+	}
+}
+
+func TestRateReferenceSplitsDistinctRates(t *testing.T) {
+	// 78702 is outside the city, which taxes at a different rate there.
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		city := 0.01
+		if r.URL.Query().Get("zipcode") == "78702" {
+			city = 0.02
+		}
+		writeRates(w, []jurisdictionRate{{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625}, {Name: "AUSTIN", Type: "CITY", Rate: city}})
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=charge&rate_reference=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,100,2 Main St,Austin,TX,78701\n"+
+		"Cole,1/17/2024,100,3 Main St,Austin,TX,78702\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["rate_reference.csv"])
+	want := [][]string{
+		{"jurisdiction", "type", "rate", "addresses"},
+		{"AUSTIN", "CITY", "0.01", "2"},
+		{"AUSTIN", "CITY", "0.02", "1"},
+		{"TEXAS STATE", "STATE", "0.0625", "3"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("rate_reference.csv = %v, want %v", rows, want)
+	}
+}
+
+func TestSplitByQuarter(t *testing.T) {
+	rec := func(client string, year, quarter int) TaxRecord {
+		return TaxRecord{Client: client, Year: year, Quarter: quarter}
+	}
+	type group struct {
+		prefix  string
+		clients []string
+	}
+	summarize := func(groups []recordGroup) []group {
+		var out []group
+		for _, g := range groups {
+			var clients []string
+			for _, r := range g.records {
+				clients = append(clients, r.Client)
+			}
+			out = append(out, group{g.prefix, clients})
+		}
+		return out
+	}
+	equal := func(a, b group) bool { return a.prefix == b.prefix && slices.Equal(a.clients, b.clients) }
+
+	oneYear := []TaxRecord{rec("a", 2024, 3), rec("b", 2024, 1), rec("c", 2024, 3)}
+	want := []group{{"Q1/", []string{"b"}}, {"Q3/", []string{"a", "c"}}}
+	if got := summarize(splitByQuarter(oneYear)); !slices.EqualFunc(got, want, equal) {
+		t.Errorf("one year: %v, want %v", got, want)
+	}
+
+	twoYears := []TaxRecord{rec("a", 2024, 1), rec("b", 2023, 4)}
+	want = []group{{"2023Q4/", []string{"b"}}, {"2024Q1/", []string{"a"}}}
+	if got := summarize(splitByQuarter(twoYears)); !slices.EqualFunc(got, want, equal) {
+		t.Errorf("two years: %v, want %v", got, want)
+	}
+}
+
+func TestPeriodNames(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	oneQuarter := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,3/31/2024,100,2 Main St,Austin,TX,78701\n"
+	w := postCSV(t, s, "include=charge,jurisdiction&period_names=true", oneQuarter)
+	want := []string{"due_by_charge_2024Q1.csv", "due_by_jurisdiction_2024Q1.csv"}
+	if got := fileNames(unzip(t, w.Body.Bytes())); !slices.Equal(got, want) {
+		t.Errorf("one quarter: files = %v, want %v", got, want)
+	}
+
+	// Files spanning quarters keep the plain names.
+	w = postCSV(t, s, "include=charge,jurisdiction&period_names=true", oneQuarter+"Cole,4/1/2024,100,3 Main St,Austin,TX,78701\n")
+	want = []string{"due_by_charge.csv", "due_by_jurisdiction.csv"}
+	if got := fileNames(unzip(t, w.Body.Bytes())); !slices.Equal(got, want) {
+		t.Errorf("two quarters: files = %v, want %v", got, want)
+	}
+}
+
+func TestWriteZipKeepsOrderWithinWorkerLimit(t *testing.T) {
+	var running, peak atomic.Int32
+	files := make([]outputFile, 20)
+	for i := range files {
+		files[i] = outputFile{fmt.Sprintf("f%d.csv", i), func() [][]string {
+			n := running.Add(1)
+			for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+			}
+			time.Sleep(time.Duration(20-i) * time.Millisecond / 4)
+			running.Add(-1)
+			return [][]string{{"n"}, {strconv.Itoa(i)}}
+		}}
+	}
+
+	rp := reporter{cfg: Config{OutputWorkers: 3}}
+	var buf bytes.Buffer
+	if err := rp.writeZip(&buf, files); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := unzip(t, buf.Bytes())
+	for i, f := range zr.File {
+		if want := fmt.Sprintf("f%d.csv", i); f.Name != want {
+			t.Errorf("entry %d = %s, want %s", i, f.Name, want)
+		}
+		if want := fmt.Sprintf("n\n%d\n", i); got[f.Name] != want {
+			t.Errorf("%s = %q, want %q", f.Name, got[f.Name], want)
+		}
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d files built at once, want at most 3", p)
+	}
+}
+
+func TestWriteZipStreamsEntriesAsBuilt(t *testing.T) {
+	var dst bytes.Buffer
+	big := [][]string{{"n"}}
+	for i := range 2000 {
+		big = append(big, []string{fmt.Sprintf("%x", sha256.Sum256([]byte(strconv.Itoa(i))))})
+	}
+	files := []outputFile{
+		{"big.csv", func() [][]string { return big }},
+		{"last.csv", func() [][]string {
+			if dst.Len() == 0 {
+				t.Errorf("nothing written before the last file was built")
+			}
+			return [][]string{{"n"}}
+		}},
+	}
+
+	rp := reporter{cfg: Config{OutputWorkers: 1}}
+	if err := rp.writeZip(&dst, files); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCSV(t, unzip(t, dst.Bytes())["big.csv"]); len(got) != len(big) {
+		t.Errorf("big.csv has %d rows, want %d", len(got), len(big))
+	}
+}
+
+func TestReorderedInputGivesSameReports(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rates := []jurisdictionRate{{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625}}
+		switch r.URL.Query().Get("zipcode") {
+		case "78701":
+			rates = append(rates, jurisdictionRate{Name: "AUSTIN", Type: "CITY", Rate: 0.01})
+		case "77002":
+			rates = append(rates, jurisdictionRate{Name: "HOUSTON", Type: "CITY", Rate: 0.01}, jurisdictionRate{Name: "HARRIS CO", Type: "COUNTY", Rate: 0.005})
+		}
+		writeRates(w, rates)
+	})
+	s := newTestServer(t, api, nil)
+	lines := []string{
+		"Acme,1/15/2024,100.125,1 Main St,Austin,TX,78701\n",
+		"Bolt,4/16/2024,33.33,2 Main St,Houston,TX,77002\n",
+		"Acme,2/15/2024,0.07,1 Main St,Austin,TX,78701\n",
+		"Cole,1/17/2024,19.99,3 Elm St,Waco,TX,76701\n",
+	}
+	query := "include=charge,jurisdiction,client,quarter&rate_reference=true&exact_totals=true"
+	forward := unzip(t, postCSV(t, s, query, testHeader+strings.Join(lines, "")).Body.Bytes())
+	slices.Reverse(lines)
+	reversed := unzip(t, postCSV(t, s, query, testHeader+strings.Join(lines, "")).Body.Bytes())
+
+	for _, name := range []string{"due_by_jurisdiction.csv", "due_by_client.csv", "due_by_quarter.csv", "rate_reference.csv"} {
+		if forward[name] != reversed[name] {
+			t.Errorf("%s differs:\n%s\nvs\n%s", name, forward[name], reversed[name])
+		}
+	}
+	// due_by_charge.csv keeps the input's row order, but not its columns.
+	if a, b := readCSV(t, forward["due_by_charge.csv"])[0], readCSV(t, reversed["due_by_charge.csv"])[0]; !slices.Equal(a, b) {
+		t.Errorf("due_by_charge.csv headers differ: %v vs %v", a, b)
+	}
+}
+
+func TestChargeColumnOrderIgnoresRowOrder(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"CHARGE_COLUMNS": "goods=all;services=STATE"})
+	header := strings.TrimSuffix(testHeader, "\n") + ",goods,services\n"
+	lines := []string{
+		"Acme,1/15/2024,0,1 Main St,Austin,TX,78701,,50\n",
+		"Bolt,1/16/2024,0,2 Main St,Austin,TX,78701,20,\n",
+	}
+	for range 2 {
+		rows := readCSV(t, unzip(t, postCSV(t, s, "include=charge", header+strings.Join(lines, "")).Body.Bytes())["due_by_charge.csv"])
+		if got := rows[0][7:11]; !slices.Equal(got, []string{"goods", "goods tax", "services", "services tax"}) {
+			t.Errorf("charge columns = %v, want goods before services", got)
+		}
+		slices.Reverse(lines)
+	}
+}
+
+func TestPeriodLabelColumn(t *testing.T) {
+	rp := reporter{opts: requestOptions{NumberFormat: "fixed", PeriodLabel: true}}
+	rows := rp.dueByChargeRows([]TaxRecord{
+		{Client: "Acme", Quarter: 4, Year: 2023},
+		{Client: "Bolt", Quarter: 1, Year: 2024},
+	}, nil)
+	col := slices.Index(rows[0], "period")
+	if col != len(requiredColumns) {
+		t.Fatalf("header = %v, want period after the input columns", rows[0])
+	}
+	if rows[1][col] != "Q4 2023" || rows[2][col] != "Q1 2024" {
+		t.Errorf("periods = %q, %q", rows[1][col], rows[2][col])
+	}
+	if rows := (reporter{}).dueByChargeRows([]TaxRecord{{Client: "Acme"}}, nil); slices.Contains(rows[0], "period") {
+		t.Error("period column written without include_period_label")
+	}
+}
+
+func TestChecksumManifest(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	body := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,oops,2 Main St,Austin,TX,78701\n"
+
+	if files := unzip(t, postCSV(t, s, "", body).Body.Bytes()); files["checksums.txt"] != "" {
+		t.Errorf("checksums.txt written without checksums=true")
+	}
+
+	files := unzip(t, postCSV(t, s, "include=client,charge&checksums=true", body).Body.Bytes())
+	manifest, ok := files["checksums.txt"]
+	if !ok {
+		t.Fatalf("no checksums.txt in %v", fileNames(files))
+	}
+	listed := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(manifest, "\n"), "\n") {
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			t.Fatalf("malformed manifest line %q", line)
+		}
+		listed[name] = sum
+	}
+	for name, data := range files {
+		if name == "checksums.txt" {
+			continue
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256([]byte(data))); listed[name] != want {
+			t.Errorf("%s: manifest lists %q, want %s", name, listed[name], want)
+		}
+		delete(listed, name)
+	}
+	if len(listed) > 0 {
+		t.Errorf("manifest lists files not in the ZIP: %v", listed)
+	}
+}
+
+func TestStatsFile(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=stats", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,4/15/2024,300,1 MAIN ST,Austin,TX,78701\n"+
+		"Cole,1/17/2024,100,2 Elm St,Austin,TX,78701\n"+
+		"Dove,1/18/2024,n/a,3 Elm St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	want := [][]string{
+		{"statistic", "value"},
+		{"rows", "3"},
+		{"total charge", "500.00"},
+		{"total tax", "36.25"},
+		{"effective rate", "0.072500"},
+		{"unique addresses", "2"},
+		{"jurisdictions", "2"},
+		{"failed rows", "1"},
+	}
+	if rows := readCSV(t, unzip(t, w.Body.Bytes())["stats.csv"]); !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("stats.csv = %v, want %v", rows, want)
+	}
+}
+
+func TestIdenticalRunsGiveIdenticalOutput(t *testing.T) {
+	var rates []jurisdictionRate
+	for _, name := range []string{"TEXAS STATE", "TRAVIS CO", "AUSTIN", "AUSTIN MTA", "CAPITAL METRO", "ESD 4", "HOSPITAL DIST", "ZEBRA SPD"} {
+		rates = append(rates, jurisdictionRate{Name: name, Type: "SPD", Rate: 0.001})
+	}
+	body := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,250,2 Main St,Austin,TX,78701\n"
+
+	var first map[string]string
+	for run := range 5 {
+		s := newTestServer(t, &rateAPI{rates: rates}, nil)
+		files := unzip(t, postCSV(t, s, "include=charge,jurisdiction", body).Body.Bytes())
+		if run == 0 {
+			first = files
+			continue
+		}
+		for _, name := range []string{"due_by_charge.csv", "due_by_jurisdiction.csv"} {
+			if files[name] != first[name] {
+				t.Fatalf("run %d: %s differs:\n%s\nvs\n%s", run, name, files[name], first[name])
+			}
+		}
+	}
+
+	header := readCSV(t, first["due_by_charge.csv"])[0]
+	columns := header[len(requiredColumns):]
+	var rows []string
+	for _, row := range readCSV(t, first["due_by_jurisdiction.csv"])[1:] {
+		if slices.Contains(columns, row[0]) {
+			rows = append(rows, row[0])
+		}
+	}
+	if len(columns) != len(rates) || !slices.IsSorted(columns) || !slices.Equal(rows, columns) {
+		t.Errorf("due_by_charge.csv columns %v and due_by_jurisdiction.csv rows %v, want both sorted alike", columns, rows)
+	}
+}
+
+func TestExactTotalsColumn(t *testing.T) {
+	state := []jurisdictionRate{{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625}}
+	s := newTestServer(t, &rateAPI{rates: state}, nil)
+	body := testHeader +
+		"Acme,1/15/2024,1,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,1,1 Main St,Austin,TX,78701\n" +
+		"Cole,1/17/2024,1,1 Main St,Austin,TX,78701\n"
+
+	rows := readCSV(t, unzip(t, postCSV(t, s, "include=jurisdiction", body).Body.Bytes())["due_by_jurisdiction.csv"])
+	if !slices.Equal(rows[0], []string{"Jurisdiction", "total"}) {
+		t.Errorf("header without exact_totals = %v", rows[0])
+	}
+
+	// Displayed totals stay rounded, and add up the rounded row amounts;
+	// the unrounded column keeps what they were rounded from.
+	rows = readCSV(t, unzip(t, postCSV(t, s, "include=jurisdiction&exact_totals=true", body).Body.Bytes())["due_by_jurisdiction.csv"])
+	want := [][]string{{"Jurisdiction", "total", "unrounded total"}, {"TEXAS STATE", "0.18", "0.187500"}}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("due_by_jurisdiction.csv = %v, want %v", rows, want)
+	}
+}
+
+func TestAcceptJSONResults(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	body := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,??,2 Main St,Austin,TX,78701\n" +
+		"Cole,1/17/2024,200,3 Main St,Austin,TX,78701\n"
+
+	var buf strings.Builder
+	mw := multipart.NewWriter(&buf)
+	part, _ := mw.CreateFormFile("csvFile", "upload.csv")
+	part.Write([]byte(body))
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/getTaxRates", strings.NewReader(buf.String()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "text/html, application/json;q=0.9")
+	w := httptest.NewRecorder()
+	s.taxRatesHandler(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	var got struct {
+		Records []recordJSON
+		Totals  map[string]float64
+		Errors  []rowErrorJSON
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Records) != 2 || got.Records[0].Client != "Acme" || got.Records[1].Client != "Cole" {
+		t.Fatalf("records = %+v, want Acme and Cole", got.Records)
+	}
+	acme := got.Records[0]
+	if acme.Date != "1/15/2024" || acme.Charge != 100 || acme.Street != "1 Main St" || acme.Zip != "78701" || acme.Taxes["TEXAS STATE"] != 6.25 || acme.Taxes["AUSTIN"] != 1 {
+		t.Errorf("Acme = %+v", acme)
+	}
+	if got.Totals["TEXAS STATE"] != 18.75 || got.Totals["AUSTIN"] != 3 {
+		t.Errorf("totals = %v, want 18.75 state and 3 city", got.Totals)
+	}
+	if len(got.Errors) != 1 || got.Errors[0].Line != 3 || got.Errors[0].Client != "Bolt" {
+		t.Errorf("errors = %+v, want line 3 for Bolt", got.Errors)
+	}
+
+	// Without the header the ZIP is still the default.
+	if w := postCSV(t, s, "", body); w.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("default Content-Type = %q, want application/zip", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestLargeUploadStreamsValidZip(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	ts := httptest.NewServer(s.routes())
+	defer ts.Close()
+
+	const rows = 20000
+	var body bytes.Buffer
+	body.WriteString(testHeader)
+	for i := range rows {
+		fmt.Fprintf(&body, "Client %d,1/15/2024,%d.%02d,%d Main St,Austin,TX,78701\n", i%300, 1+i%500, i%100, i%100)
+	}
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	part, _ := mw.CreateFormFile("csvFile", "large.csv")
+	part.Write(body.Bytes())
+	mw.Close()
+
+	resp, err := http.Post(ts.URL+"/getTaxRates?include=charge,client", mw.FormDataContentType(), &form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, data)
+	}
+	if resp.ContentLength != -1 || !slices.Contains(resp.TransferEncoding, "chunked") {
+		t.Errorf("Content-Length %d, Transfer-Encoding %v; want a chunked response", resp.ContentLength, resp.TransferEncoding)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("response is not a valid ZIP: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "due_by_charge.csv" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := csv.NewReader(rc).ReadAll()
+		rc.Close()
+		if err != nil || len(records) != rows+1 {
+			t.Errorf("due_by_charge.csv has %d rows (%v), want %d", len(records)-1, err, rows)
+		}
+		return
+	}
+	t.Errorf("no due_by_charge.csv in the ZIP")
+}
+
+func TestMaxNameLength(t *testing.T) {
+	rp := reporter{opts: requestOptions{MaxNameLength: 10}}
+	short := rp.shortenNames([]string{
+		"AUSTIN",
+		"TRAVIS COUNTY EMERGENCY SERVICES DISTRICT 4",
+		"TRAVIS COUNTY EMERGENCY SERVICES DISTRICT 11",
+		"TRAVIS COUNTY HEALTHCARE DISTRICT",
+		"SAN MARCOS",
+		"SAN MARCOS CITY",
+		"TRAVIS COUNTY EMERGENCY SERVICES DISTRICT 4", // repeated across rows
+	})
+	names := map[string]string{
+		"TRAVIS COUNTY EMERGENCY SERVICES DISTRICT 11": "TRAVIS COU",
+		"TRAVIS COUNTY EMERGENCY SERVICES DISTRICT 4":  "TRAVIS C~2",
+		"TRAVIS COUNTY HEALTHCARE DISTRICT":            "TRAVIS C~3",
+		"SAN MARCOS CITY":                              "SAN MARC~2", // "SAN MARCOS" is a real name
+	}
+	if !maps.Equal(short, names) {
+		t.Errorf("short names = %v, want %v", short, names)
+	}
+
+	// End to end, every column fits and stays distinct.
+	var rates []jurisdictionRate
+	for name := range names {
+		rates = append(rates, jurisdictionRate{Name: name, Type: "SPD", Rate: 0.001})
+	}
+	s := newTestServer(t, &rateAPI{rates: rates}, nil)
+	w := postCSV(t, s, "include=charge,jurisdiction&max_name_length=10", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	files := unzip(t, w.Body.Bytes())
+	header := readCSV(t, files["due_by_charge.csv"])[0]
+	seen := make(map[string]bool)
+	for _, col := range header[len(requiredColumns):] {
+		if len(col) > 10 || seen[col] {
+			t.Errorf("column %q is too long or repeated in %v", col, header)
+		}
+		seen[col] = true
+	}
+	// Without the real SAN MARCOS, SAN MARCOS CITY takes its truncation.
+	want := map[string]bool{"SAN MARCOS": true, "TRAVIS COU": true, "TRAVIS C~2": true, "TRAVIS C~3": true}
+	for _, row := range readCSV(t, files["due_by_jurisdiction.csv"])[1:] {
+		if !want[row[0]] {
+			t.Errorf("due_by_jurisdiction.csv row %v, want one of %v", row, want)
+		}
+		delete(want, row[0])
+	}
+	if len(want) > 0 {
+		t.Errorf("due_by_jurisdiction.csv lacks %v", want)
+	}
+}
+
+func TestIncludeBaseShowsCappedBase(t *testing.T) {
+	caps := filepath.Join(t.TempDir(), "caps.json")
+	os.WriteFile(caps, []byte(`{"AUSTIN": 500}`), 0o600)
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{"TAXABLE_CAPS_FILE": caps})
+	body := testHeader +
+		"Acme,1/15/2024,2000,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,300,2 Main St,Austin,TX,78701\n"
+
+	rows := readCSV(t, unzip(t, postCSV(t, s, "include=jurisdiction&include_base=true", body).Body.Bytes())["due_by_jurisdiction.csv"])
+	want := [][]string{
+		{"Jurisdiction", "total", "taxable base"},
+		{"AUSTIN", "8.00", "800.00"},
+		{"TEXAS STATE", "143.75", "2300.00"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("due_by_jurisdiction.csv = %v, want %v", rows, want)
+	}
+
+	rows = readCSV(t, unzip(t, postCSV(t, s, "include=jurisdiction", body).Body.Bytes())["due_by_jurisdiction.csv"])
+	if slices.Contains(rows[0], "taxable base") {
+		t.Errorf("taxable base included without include_base: %v", rows[0])
+	}
+}
+
+func TestRateReferenceBreaksTies(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		typ := map[string]string{"78701": "SPD", "78702": "COUNTY", "78703": "CITY"}[r.URL.Query().Get("zipcode")]
+		writeRates(w, []jurisdictionRate{{Name: "ESD 4", Type: typ, Rate: 0.01}})
+	})
+	body := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/15/2024,100,2 Main St,Austin,TX,78702\n" +
+		"Cole,1/15/2024,100,3 Main St,Austin,TX,78703\n"
+	want := [][]string{
+		{"jurisdiction", "type", "rate", "addresses"},
+		{"ESD 4", "CITY", "0.01", "1"},
+		{"ESD 4", "COUNTY", "0.01", "1"},
+		{"ESD 4", "SPD", "0.01", "1"},
+	}
+	for range 5 {
+		s := newTestServer(t, api, nil)
+		rows := readCSV(t, unzip(t, postCSV(t, s, "rate_reference=true", body).Body.Bytes())["rate_reference.csv"])
+		if !slices.EqualFunc(rows, want, slices.Equal) {
+			t.Fatalf("rate_reference.csv = %v, want %v", rows, want)
+		}
+	}
+}
+
+func TestRefundsNetAgainstCharges(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=jurisdiction,refunds", testHeader+
+		"Acme,1/15/2024,200,1 Main St,Austin,TX,78701\n"+
+		"Acme,1/20/2024,-80,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/22/2024,(20.00),2 Main St,Austin,TX,78702\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+
+	totals := readCSV(t, files["due_by_jurisdiction.csv"])
+	wantTotals := [][]string{{"Jurisdiction", "total"}, {"AUSTIN", "1.00"}, {"TEXAS STATE", "6.25"}}
+	if !slices.EqualFunc(totals, wantTotals, slices.Equal) {
+		t.Errorf("due_by_jurisdiction.csv = %v, want %v", totals, wantTotals)
+	}
+
+	refunds := readCSV(t, files["refunds.csv"])
+	wantRefunds := [][]string{
+		{"client", "date", "charge", "street address", "city", "State", "zip code", "AUSTIN", "TEXAS STATE"},
+		{"Acme", "1/20/2024", "-80.00", "1 Main St", "Austin", "TX", "78701", "-0.80", "-5.00"},
+		{"Bolt", "1/22/2024", "-20.00", "2 Main St", "Austin", "TX", "78702", "-0.20", "-1.25"},
+	}
+	if !slices.EqualFunc(refunds, wantRefunds, slices.Equal) {
+		t.Errorf("refunds.csv = %v, want %v", refunds, wantRefunds)
+	}
+}
+
+func TestDueByClientMatchesChargeRows(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "include=charge,client", testHeader+
+		"Cole,1/15/2024,10.10,3 Main St,Austin,TX,78701\n"+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Cole,1/16/2024,10.30,3 Main St,Austin,TX,78701\n"+
+		"Bolt,1/17/2024,40,2 Main St,Austin,TX,78701\n"+
+		"Acme,2/15/2024,60,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+
+	// Total each client's per-row taxes from due_by_charge.csv.
+	charges := readCSV(t, files["due_by_charge.csv"])
+	perRow := make(map[string]int64)
+	for _, row := range charges[1:] {
+		for _, v := range row[7:] {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("tax %q: %v", v, err)
+			}
+			perRow[row[0]] += toCents(f)
+		}
+	}
+
+	got := readCSV(t, files["due_by_client.csv"])
+	want := [][]string{
+		{"client", "total charge", "total tax"},
+		{"Acme", "160.00", "11.60"},
+		{"Bolt", "40.00", "2.90"},
+		{"Cole", "20.40", "1.47"},
+	}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("due_by_client.csv = %v, want %v", got, want)
+	}
+	for _, row := range got[1:] {
+		f, _ := strconv.ParseFloat(row[2], 64)
+		if toCents(f) != perRow[row[0]] {
+			t.Errorf("%s: total tax %s, but its rows sum to %d cents", row[0], row[2], perRow[row[0]])
+		}
+	}
+}
+
+func TestDueByQuarterBucketsTax(t *testing.T) {
+	// The rate follows the quarter looked up, so each bucket's total
+	// shows which period its rows were priced for.
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := strconv.Atoi(r.URL.Query().Get("quarter"))
+		writeRates(w, []jurisdictionRate{{"TEXAS STATE", "STATE", 0.01 * float64(q)}})
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=quarter", testHeader+
+		"Acme,11/30/2023,100,1 Main St,Austin,TX,78701\n"+
+		"Acme,3/31/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,4/01/2024,100,2 Main St,Austin,TX,78701\n"+
+		"Acme,6/15/2024,50,1 Main St,Austin,TX,78701\n"+
+		"Cole,9/30/2024,100,3 Main St,Austin,TX,78701\n"+
+		"Bolt,12/31/2024,100,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	got := readCSV(t, unzip(t, w.Body.Bytes())["due_by_quarter.csv"])
+	want := [][]string{
+		{"year", "quarter", "total tax"},
+		{"2023", "4", "4.00"},
+		{"2024", "1", "1.00"},
+		{"2024", "2", "3.00"},
+		{"2024", "3", "3.00"},
+		{"2024", "4", "4.00"},
+	}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("due_by_quarter.csv = %v, want %v", got, want)
+	}
+}
+
+func TestIncludeRatesPairsEachJurisdiction(t *testing.T) {
+	// 78702 is outside the city and has a special district instead.
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rates := []jurisdictionRate{{"TEXAS STATE", "STATE", 0.0625}, {"AUSTIN", "CITY", 0.01}}
+		if r.URL.Query().Get("zipcode") == "78702" {
+			rates = []jurisdictionRate{{"TEXAS STATE", "STATE", 0.0625}, {"TRAVIS ESD", "SPD", 0.015}}
+		}
+		writeRates(w, rates)
+	})
+	s := newTestServer(t, api, nil)
+	upload := testHeader +
+		"Acme,1/15/2024,200,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,100,2 Oak Rd,Austin,TX,78702\n"
+
+	rows := readCSV(t, unzip(t, postCSV(t, s, "include=charge&include_rates=true", upload).Body.Bytes())["due_by_charge.csv"])
+	want := [][]string{
+		{"client", "date", "charge", "street address", "city", "State", "zip code", "AUSTIN", "AUSTIN rate", "TEXAS STATE", "TEXAS STATE rate", "TRAVIS ESD", "TRAVIS ESD rate"},
+		{"Acme", "1/15/2024", "200.00", "1 Main St", "Austin", "TX", "78701", "2.00", "0.01", "12.50", "0.0625", "0.00", ""},
+		{"Bolt", "1/16/2024", "100.00", "2 Oak Rd", "Austin", "TX", "78702", "0.00", "", "6.25", "0.0625", "1.50", "0.015"},
+	}
+	if !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("due_by_charge.csv = %v, want %v", rows, want)
+	}
+
+	rows = readCSV(t, unzip(t, postCSV(t, s, "include=charge", upload).Body.Bytes())["due_by_charge.csv"])
+	for _, name := range rows[0] {
+		if strings.HasSuffix(name, " rate") {
+			t.Errorf("rate column %q without include_rates", name)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBaseDelay and retryMaxDelay bound the exponential backoff between
+// attempts at one lookup.
+const (
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 5 * time.Second
+)
+
+// resolver turns records into rate schedules for the duration of one job.
+// It shares the server's rate cache and owns the retry budget spent by all
+// of the job's rows.
+type resolver struct {
+	cfg      Config
+	cache    *rateCache
+	upstream *http.Client
+	retries  *retryBudget
+
+	// periodFallback allows rows whose quarter has no published rates to
+	// use the most recent earlier quarter that does. fallbacks remembers
+	// the period substituted for each such lookup within the job.
+	periodFallback bool
+	mu             sync.Mutex
+	fallbacks      map[rateKey]rateKey
+
+	// lookups holds every lookup the job has started, keyed by normalized
+	// address, so rows sharing an address wait for the first row's result
+	// instead of calling upstream again while it is still in flight.
+	lookups map[rateKey]*pendingLookup
+
+	// calls counts the requests made to the tax API, including retries.
+	calls atomic.Int64
+}
+
+// pendingLookup is a lookup shared by the rows of a job; rates and err are
+// set before done is closed.
+type pendingLookup struct {
+	done  chan struct{}
+	rates []jurisdictionRate
+	err   error
+}
+
+func (s *server) newResolver(opts requestOptions) *resolver {
+	return &resolver{
+		cfg:            s.cfg,
+		cache:          s.cache,
+		upstream:       s.upstream,
+		retries:        newRetryBudget(s.cfg.RetryBudget),
+		periodFallback: opts.PeriodFallback,
+		fallbacks:      make(map[rateKey]rateKey),
+		lookups:        make(map[rateKey]*pendingLookup),
+	}
+}
+
+// lookupCount returns how many distinct lookups the job has made rather
+// than finding in the cache.
+func (rv *resolver) lookupCount() int {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return len(rv.lookups)
+}
+
+// maxFallbackQuarters bounds how far back a period fallback may reach.
+const maxFallbackQuarters = 4
+
+// retryBudget is a job-wide allowance of upstream retries. Without it a
+// systemic outage would multiply into a retry storm across every row; once
+// the budget is spent, remaining lookups fail on their first error.
+type retryBudget struct {
+	remaining atomic.Int64
+}
+
+func newRetryBudget(n int) *retryBudget {
+	b := &retryBudget{}
+	b.remaining.Store(int64(n))
+	return b
+}
+
+// take consumes one retry, reporting false when the budget is exhausted.
+func (b *retryBudget) take() bool {
+	return b.remaining.Add(-1) >= 0
+}
+
+// price resolves rec's rates and computes its taxes, for callers handling
+// one row at a time; priceAll prices a whole file.
+func (rv *resolver) price(ctx context.Context, rec *TaxRecord, opts requestOptions) error {
+	started := time.Now()
+	taxRates, err := rv.resolve(ctx, rec)
+	if err != nil {
+		return fmt.Errorf("error scraping tax rates for %s: %v", rec.Client, err)
+	}
+	rec.LookupDuration = time.Since(started)
+	if opts.IncludeTiming {
+		log.Printf("Resolved rates for %s, %s in %s", rec.Street, rec.Zip, rec.LookupDuration)
+	}
+
+	computeTaxes(rec, taxRates, rv.cfg, opts)
+	return nil
+}
+
+// priceAll prices records in place in two phases. First each unique lookup
+// among them, by normalized address and period, is resolved once using up
+// to cfg.MaxConcurrency workers, so a file dominated by a few locations
+// makes a few upstream calls however its rows are ordered. Then every row's
+// taxes are computed from its lookup's rates, preserving row order. A row
+// whose lookup fails is left unpriced and its error returned at the same
+// index of errs; only cancellation of ctx fails the whole call.
+func (rv *resolver) priceAll(ctx context.Context, records []TaxRecord, opts requestOptions) ([]error, error) {
+	// uniqueLookup is resolved for rec, the first row with its key; fallback
+	// is the period used when rec.FallbackPeriod is set.
+	type uniqueLookup struct {
+		rec      TaxRecord
+		rates    []jurisdictionRate
+		err      error
+		fallback rateKey
+		duration time.Duration
+	}
+	var lookups []uniqueLookup
+	rowLookup := make([]int, len(records))
+	index := make(map[rateKey]int)
+	for i, rec := range records {
+		key := rec.rateKey().normalized()
+		n, ok := index[key]
+		if !ok {
+			n = len(lookups)
+			index[key] = n
+			lookups = append(lookups, uniqueLookup{rec: rec})
+		}
+		rowLookup[i] = n
+	}
+	log.Printf("Resolving %d unique lookups for %d rows", len(lookups), len(records))
+
+	jobs := make(chan int, len(lookups))
+	for n := range lookups {
+		jobs <- n
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	for range min(max(rv.cfg.MaxConcurrency, 1), len(lookups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				if ctx.Err() != nil {
+					return
+				}
+				l := &lookups[n]
+				started := time.Now()
+				l.rates, l.err = rv.resolve(ctx, &l.rec)
+				l.duration = time.Since(started)
+				if l.rec.FallbackPeriod != "" {
+					rv.mu.Lock()
+					l.fallback = rv.fallbacks[l.rec.rateKey()]
+					rv.mu.Unlock()
+				}
+				if opts.IncludeTiming {
+					log.Printf("Resolved rates for %s, %s in %s", l.rec.Street, l.rec.Zip, l.duration)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(records))
+	timed := make([]bool, len(lookups))
+	for i := range records {
+		rec, l := &records[i], &lookups[rowLookup[i]]
+		if l.err != nil {
+			errs[i] = fmt.Errorf("error scraping tax rates for %s: %v", rec.Client, l.err)
+			continue
+		}
+		if l.rec.FallbackPeriod != "" {
+			rec.useFallbackPeriod(l.fallback.Quarter, l.fallback.Year)
+		}
+		if !timed[rowLookup[i]] {
+			rec.LookupDuration = l.duration
+			timed[rowLookup[i]] = true
+		}
+		computeTaxes(rec, l.rates, rv.cfg, opts)
+	}
+	return errs, nil
+}
+
+// resolve returns the rate schedule for rec's address and period. When no
+// rates are published for that period and fallback is enabled, the most
+// recent earlier quarter with rates is used and the row is flagged.
+func (rv *resolver) resolve(ctx context.Context, rec *TaxRecord) ([]jurisdictionRate, error) {
+	rv.mu.Lock()
+	fallback, known := rv.fallbacks[rec.rateKey()]
+	rv.mu.Unlock()
+	if known {
+		prev := *rec
+		prev.Quarter, prev.Year = fallback.Quarter, fallback.Year
+		rates, err := rv.resolvePeriod(ctx, prev)
+		if err == nil {
+			rec.useFallbackPeriod(prev.Quarter, prev.Year)
+		}
+		return rates, err
+	}
+
+	rates, err := rv.resolvePeriod(ctx, *rec)
+	if err == nil || !rv.periodFallback || !errors.Is(err, errNoTaxRates) {
+		return rates, err
+	}
+
+	prev := *rec
+	for range maxFallbackQuarters {
+		prev.Quarter--
+		if prev.Quarter == 0 {
+			prev.Quarter = 4
+			prev.Year--
+		}
+		rates, prevErr := rv.resolvePeriod(ctx, prev)
+		if errors.Is(prevErr, errNoTaxRates) {
+			continue
+		}
+		if prevErr != nil {
+			return nil, prevErr
+		}
+		rv.mu.Lock()
+		rv.fallbacks[rec.rateKey()] = prev.rateKey()
+		rv.mu.Unlock()
+		rec.useFallbackPeriod(prev.Quarter, prev.Year)
+		return rates, nil
+	}
+	return nil, err
+}
+
+// resolvePeriod returns the rate schedule for rec's address and period,
+// from the cache when it has already been looked up.
+func (rv *resolver) resolvePeriod(ctx context.Context, rec TaxRecord) ([]jurisdictionRate, error) {
+	key := rec.rateKey().normalized()
+	if rates, ok := rv.cache.get(key); ok {
+		return rates, nil
+	}
+
+	rv.mu.Lock()
+	p, started := rv.lookups[key]
+	if !started {
+		p = &pendingLookup{done: make(chan struct{})}
+		rv.lookups[key] = p
+	}
+	rv.mu.Unlock()
+	if started {
+		select {
+		case <-p.done:
+			return p.rates, p.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	defer close(p.done)
+
+	p.rates, p.err = rv.lookup(ctx, rec)
+	if p.err != nil {
+		return nil, p.err
+	}
+	if rv.cfg.RatePrecision >= 0 {
+		for i := range p.rates {
+			p.rates[i].Rate = quantize(p.rates[i].Rate, rv.cfg.RatePrecision)
+		}
+	}
+	rv.cache.put(key, p.rates)
+	return p.rates, nil
+}
+
+// quantize rounds v half away from zero to the given number of decimals.
+func quantize(v float64, decimals int) float64 {
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
+
+// lookup consults configured overrides before (or instead of) the upstream
+// API.
+func (rv *resolver) lookup(ctx context.Context, rec TaxRecord) ([]jurisdictionRate, error) {
+	override := rv.override(rec)
+	if override != nil && override.Complete {
+		log.Printf("Using complete rate override for %s, %s; skipping upstream", rec.Street, rec.City)
+		return override.apply(nil), nil
+	}
+
+	rates, err := rv.scrape(ctx, rec)
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		rates = override.apply(rates)
+	}
+	return rates, nil
+}
+
+// override returns the first configured rate override matching rec, or
+// nil.
+func (rv *resolver) override(rec TaxRecord) *rateOverride {
+	for i := range rv.cfg.RateOverrides {
+		if rv.cfg.RateOverrides[i].matches(rec) {
+			return &rv.cfg.RateOverrides[i]
+		}
+	}
+	return nil
+}
+
+// scrape calls the upstream API, retrying transient failures up to
+// cfg.MaxAttempts times with jittered exponential backoff while the job's
+// retry budget allows. Cancelling ctx stops any further attempts.
+func (rv *resolver) scrape(ctx context.Context, rec TaxRecord) ([]jurisdictionRate, error) {
+	for attempt := 1; ; attempt++ {
+		key := rec.rateKey()
+		rv.calls.Add(1)
+		rates, err := scrapeTaxRates(ctx, rv.upstream, rv.cfg, key.Street, key.City, key.State, key.Zip, key.Quarter, key.Year)
+		if err == nil || !isTransient(err) || attempt >= rv.cfg.MaxAttempts || ctx.Err() != nil {
+			return rates, err
+		}
+		if !rv.retries.take() {
+			return nil, fmt.Errorf("retry budget exhausted: %w", err)
+		}
+		delay := backoff(attempt)
+		log.Printf("Retrying lookup for %s, %s (attempt %d of %d, status %s) in %s: %v",
+			rec.Street, rec.Zip, attempt+1, rv.cfg.MaxAttempts, failureStatus(err), delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before the retry following the given attempt:
+// a random duration up to retryBaseDelay doubled per attempt, capped at
+// retryMaxDelay ("full jitter").
+func backoff(attempt int) time.Duration {
+	ceiling := retryMaxDelay
+	// Past 20 doublings the cap has long been reached, and larger shifts
+	// would overflow.
+	if attempt <= 20 {
+		ceiling = min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+	}
+	return time.Duration(rand.Int64N(int64(ceiling))) + 1
+}
+
+// failureStatus describes a transient failure for retry logs: the HTTP
+// status code, or "network" when no response was received.
+func failureStatus(err error) string {
+	if errors.Is(err, errEmptyUpstreamResponse) {
+		return "empty"
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return strconv.Itoa(upErr.StatusCode)
+	}
+	return "network"
+}
+
+// maxDiagnosticBody caps how much of an upstream response body is quoted in
+// a lookup error.
+const maxDiagnosticBody = 200
+
+// errUnexpectedStatus is the cause of an upstreamError for a non-200
+// response.
+var errUnexpectedStatus = errors.New("unexpected status code")
+
+// upstreamError is a failed lookup that got a response from the tax API. It
+// carries what users need to diagnose the failure themselves: the status
+// code, the API's GISRETURNCODE when the body had one, and the start of the
+// body. Err is the underlying cause.
+type upstreamError struct {
+	Err           error
+	StatusCode    int
+	GisReturnCode string
+	Body          string
+}
+
+func (e *upstreamError) Error() string {
+	msg := fmt.Sprintf("%v (status %d", e.Err, e.StatusCode)
+	if e.GisReturnCode != "" {
+		msg += ", GISRETURNCODE " + e.GisReturnCode
+	}
+	body := strings.TrimSpace(e.Body)
+	if len(body) > maxDiagnosticBody {
+		body = body[:maxDiagnosticBody] + "..."
+	}
+	return fmt.Sprintf("%s, response %q)", msg, body)
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.Err
+}
+
+// isTransient reports whether a scrape error is worth retrying: network
+// failures, 5xx responses and empty bodies. 4xx responses and lookups
+// missing from replayed fixtures are not.
+func isTransient(err error) bool {
+	if errors.Is(err, errEmptyUpstreamResponse) {
+		return true
+	}
+	if errors.Is(err, errFixtureMissing) {
+		return false
+	}
+	var upErr *upstreamError
+	if errors.As(err, &upErr) {
+		return upErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
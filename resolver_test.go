@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffStaysWithinCap(t *testing.T) {
+	for attempt := 1; attempt <= 100; attempt++ {
+		d := backoff(attempt)
+		if d <= 0 || d > retryMaxDelay {
+			t.Fatalf("backoff(%d) = %s, want within (0, %s]", attempt, d, retryMaxDelay)
+		}
+	}
+	if d := backoff(1); d > retryBaseDelay {
+		t.Errorf("backoff(1) = %s, want at most %s", d, retryBaseDelay)
+	}
+}
+
+// Only the first row of each lookup is charged with its time; the rows
+// sharing it are served from the result.
+func TestSharedLookupTimedOnce(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		api.ServeHTTP(w, r)
+	})
+	s := newTestServer(t, slow, nil)
+	w := postCSV(t, s, "include=charge&include_timing=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,200,1 MAIN ST,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if n := api.calls.Load(); n != 1 {
+		t.Errorf("rate API called %d times, want 1", n)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+	col := -1
+	for i, name := range rows[0] {
+		if name == "lookup ms" {
+			col = i
+		}
+	}
+	if col < 0 {
+		t.Fatalf("no lookup ms column in %v", rows[0])
+	}
+	if rows[1][col] == "0.000" {
+		t.Errorf("first row lookup ms = %s, want the lookup's time", rows[1][col])
+	}
+	if rows[2][col] != "0.000" {
+		t.Errorf("second row lookup ms = %s, want 0.000", rows[2][col])
+	}
+}
+
+func TestRatePrecisionQuantizesBeforeMultiplying(t *testing.T) {
+	rates := []jurisdictionRate{{Name: "TEXAS STATE", Type: "STATE", Rate: 0.062549}}
+	upload := testHeader + "Acme,1/15/2024,1000,1 Main St,Austin,TX,78701\n"
+	for _, tt := range []struct {
+		precision, rate, tax string
+	}{
+		{"", "0.062549", "62.55"},
+		{"4", "0.0625", "62.50"},
+		{"2", "0.06", "60.00"},
+	} {
+		s := newTestServer(t, &rateAPI{rates: rates}, map[string]string{"RATE_PRECISION": tt.precision})
+		w := postCSV(t, s, "include=charge&include_rates=true", upload)
+		rows := readCSV(t, unzip(t, w.Body.Bytes())["due_by_charge.csv"])
+		got := rows[1][len(rows[1])-2:]
+		if got[0] != tt.tax || got[1] != tt.rate {
+			t.Errorf("RATE_PRECISION=%q: tax, rate = %v, want %s, %s", tt.precision, got, tt.tax, tt.rate)
+		}
+	}
+}
+
+func TestEmptyUpstreamResponseIsRetried(t *testing.T) {
+	var calls atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			return // 200 with no body
+		}
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=charge", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	files := unzip(t, w.Body.Bytes())
+	if _, ok := files["errors.csv"]; ok || calls.Load() != 2 {
+		t.Errorf("after %d calls: errors.csv = %q, want the retry to succeed", calls.Load(), files["errors.csv"])
+	}
+
+	empty := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	s = newTestServer(t, empty, map[string]string{"MAX_ATTEMPTS": "1"})
+	w = postCSV(t, s, "include=charge", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["errors.csv"])
+	if len(rows) != 2 || !strings.Contains(rows[1][2], errEmptyUpstreamResponse.Error()) {
+		t.Errorf("errors.csv = %v, want the empty response reported", rows)
+	}
+}
+
+func TestRetryBudgetIsSharedByTheJob(t *testing.T) {
+	var calls atomic.Int64
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	s := newTestServer(t, down, map[string]string{"RETRY_BUDGET": "2", "MAX_ATTEMPTS": "4"})
+	w := postCSV(t, s, "include=charge", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,100,2 Main St,Austin,TX,78701\n"+
+		"Cole,1/17/2024,100,3 Main St,Austin,TX,78701\n")
+
+	// One attempt per address plus the two retries the budget allows.
+	if n := calls.Load(); n != 5 {
+		t.Errorf("rate API called %d times, want 5", n)
+	}
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["errors.csv"])
+	exhausted := 0
+	for _, row := range rows[1:] {
+		if strings.Contains(row[2], "retry budget exhausted") {
+			exhausted++
+		}
+	}
+	if len(rows) != 4 || exhausted == 0 {
+		t.Errorf("errors.csv = %v, want every row failed and the budget reported exhausted", rows)
+	}
+}
+
+func TestPriceRecordsLookupDuration(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(15 * time.Millisecond)
+		api.ServeHTTP(w, r)
+	})
+	s := newTestServer(t, slow, nil)
+	rv := s.newResolver(requestOptions{})
+
+	first, second := newRecord(100, "2024-01-15"), newRecord(100, "2024-01-16")
+	for _, rec := range []*TaxRecord{first, second} {
+		rec.Street, rec.City, rec.State, rec.Zip, rec.Quarter, rec.Year = "1 Main St", "Austin", "TX", "78701", 1, 2024
+		if err := rv.price(context.Background(), rec, requestOptions{IncludeTiming: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.LookupDuration < 15*time.Millisecond {
+		t.Errorf("first lookup took %s, want the upstream call timed", first.LookupDuration)
+	}
+	if second.LookupDuration >= 15*time.Millisecond {
+		t.Errorf("cached lookup took %s", second.LookupDuration)
+	}
+	if first.Taxes["TEXAS STATE"] != 6.25 {
+		t.Errorf("taxes = %v", first.Taxes)
+	}
+}
+
+func TestPeriodFallback(t *testing.T) {
+	// Rates are published through 2024Q1 only.
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("year") == "2024" && q.Get("quarter") == "1" {
+			writeRates(w, testRates)
+			return
+		}
+		writeRates(w, nil)
+	})
+	s := newTestServer(t, api, nil)
+	upload := testHeader +
+		"Acme,8/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/15/2025,100,1 Main St,Austin,TX,78701\n" +
+		"Cole,4/15/2025,100,1 Main St,Austin,TX,78701\n"
+
+	files := unzip(t, postCSV(t, s, "include=charge&allow_period_fallback=true", upload).Body.Bytes())
+	rows := readCSV(t, files["due_by_charge.csv"])
+	warnings := slices.Index(rows[0], "warnings")
+	want := map[string]string{
+		"Acme": "no rates published for 2024Q3; used 2024Q1 rates",
+		"Bolt": "no rates published for 2025Q1; used 2024Q1 rates",
+	}
+	if len(rows) != 3 || warnings < 0 {
+		t.Fatalf("due_by_charge.csv = %v", rows)
+	}
+	for _, row := range rows[1:] {
+		if row[warnings] != want[row[0]] {
+			t.Errorf("%s warning = %q, want %q", row[0], row[warnings], want[row[0]])
+		}
+	}
+	// 2025Q2 is more than four quarters past the last published rates.
+	if errs := readCSV(t, files["errors.csv"]); len(errs) != 2 || errs[1][1] != "Cole" {
+		t.Errorf("errors.csv = %v, want Cole", errs)
+	}
+
+	files = unzip(t, postCSV(t, s, "include=charge", upload).Body.Bytes())
+	if errs := readCSV(t, files["errors.csv"]); len(errs) != 4 || !strings.Contains(errs[1][2], errNoTaxRates.Error()) {
+		t.Errorf("without fallback: errors.csv = %v, want every row", errs)
+	}
+}
+
+// Each address has its own rate, so rows priced from the wrong lookup or
+// put back in the wrong order show up in their taxes.
+func TestPriceAllBoundsConcurrencyAndKeepsOrder(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		num, _ := strconv.Atoi(strings.Fields(r.URL.Query().Get("street"))[0])
+		writeRates(w, []jurisdictionRate{{Name: "LOCAL", Type: "CITY", Rate: float64(num) / 1000}})
+	})
+	s := newTestServer(t, api, map[string]string{"MAX_CONCURRENCY": "4"})
+	rv := s.newResolver(requestOptions{})
+
+	records := make([]TaxRecord, 50)
+	for i := range records {
+		rec := newRecord(1000, "2024-01-15")
+		rec.Client = fmt.Sprintf("C%d", i)
+		rec.Street, rec.City, rec.State, rec.Zip = fmt.Sprintf("%d Main St", i+1), "Austin", "TX", "78701"
+		rec.Quarter, rec.Year = 1, 2024
+		records[i] = *rec
+	}
+	errs, err := rv.priceAll(context.Background(), records, requestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rec := range records {
+		if errs[i] != nil {
+			t.Fatalf("row %d: %v", i, errs[i])
+		}
+		if rec.Client != fmt.Sprintf("C%d", i) || rec.Taxes["LOCAL"] != float64(i+1) {
+			t.Errorf("row %d = %s with taxes %v, want C%d taxed %d", i, rec.Client, rec.Taxes, i, i+1)
+		}
+	}
+	if p := peak.Load(); p > 4 {
+		t.Errorf("%d lookups in flight at once, want at most MAX_CONCURRENCY=4", p)
+	} else if p < 2 {
+		t.Errorf("lookups never overlapped: peak of %d in flight", p)
+	}
+}
+
+func TestPriceAllStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		cancel()
+		writeRates(w, testRates)
+	})
+	s := newTestServer(t, api, map[string]string{"MAX_CONCURRENCY": "1"})
+	records := make([]TaxRecord, 10)
+	for i := range records {
+		rec := newRecord(100, "2024-01-15")
+		rec.Street, rec.Zip, rec.Quarter, rec.Year = fmt.Sprintf("%d Main St", i+1), "78701", 1, 2024
+		records[i] = *rec
+	}
+	if _, err := s.newResolver(requestOptions{}).priceAll(ctx, records, requestOptions{}); err != context.Canceled {
+		t.Errorf("priceAll error = %v, want context.Canceled", err)
+	}
+	if n := calls.Load(); n > 1 {
+		t.Errorf("%d lookups made after cancellation, want none", n-1)
+	}
+}
+
+func TestScrapeRetriesTransientFailures(t *testing.T) {
+	var calls atomic.Int64
+	flaky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		case 2:
+			// Drop the connection without a response.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			writeRates(w, testRates)
+		}
+	})
+	s := newTestServer(t, flaky, nil)
+	rec := newRecord(100, "2024-01-15")
+	rec.Street, rec.Zip, rec.Quarter, rec.Year = "1 Main St", "78701", 1, 2024
+
+	rates, err := s.newResolver(requestOptions{}).scrape(context.Background(), *rec)
+	if err != nil {
+		t.Fatalf("scrape failed after %d calls: %v", calls.Load(), err)
+	}
+	if !slices.Equal(rates, testRates) || calls.Load() != 3 {
+		t.Errorf("after %d calls: rates = %v, want %v", calls.Load(), rates, testRates)
+	}
+
+	calls.Store(0)
+	rejected := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+	s = newTestServer(t, rejected, nil)
+	if _, err := s.newResolver(requestOptions{}).scrape(context.Background(), *rec); err == nil || calls.Load() != 1 {
+		t.Errorf("4xx: %d calls, err %v; want one failed call", calls.Load(), err)
+	}
+}
+
+func TestLookupFailureCarriesUpstreamDiagnostics(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"GISRETURNCODE": "3", "MESSAGE": "address not found%sEND"}`, strings.Repeat(".", 300))
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=charge", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["errors.csv"])
+	if len(rows) != 2 {
+		t.Fatalf("errors.csv = %v, want one failed row", rows)
+	}
+	msg := rows[1][2]
+	for _, want := range []string{"status 400", "GISRETURNCODE 3", "address not found", `..."`} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q doesn't mention %q", msg, want)
+		}
+	}
+	if strings.Contains(msg, "END") {
+		t.Errorf("error %q quotes the body past %d bytes", msg, maxDiagnosticBody)
+	}
+}
+
+func TestGisReturnCode(t *testing.T) {
+	for _, tt := range []struct {
+		name, body string
+		want       error
+		rates      int
+	}{
+		{"geocoded", `{"GISRETURNCODE": "0", "TAXRATES": [{"JURISNAME": "TEXAS STATE", "JURISTYPE": "STATE", "JURISRATE": "0.0625"}]}`, nil, 1},
+		{"not found", `{"GISRETURNCODE": "1", "TAXRATES": []}`, errAddressNotGeocoded, 0},
+		{"zero rates", `{"GISRETURNCODE": "3", "TAXRATES": [{"JURISNAME": "TEXAS STATE", "JURISTYPE": "STATE", "JURISRATE": "0"}]}`, errAddressNotGeocoded, 0},
+		{"no rates published", `{"GISRETURNCODE": "0", "TAXRATES": []}`, errNoTaxRates, 0},
+		{"code with real rates", `{"GISRETURNCODE": "2", "TAXRATES": [{"JURISNAME": "TEXAS STATE", "JURISTYPE": "STATE", "JURISRATE": "0.0625"}]}`, nil, 1},
+	} {
+		var resp TaxRateResponse
+		if err := json.Unmarshal([]byte(tt.body), &resp); err != nil {
+			t.Fatal(err)
+		}
+		rates, err := resp.rates(Config{})
+		if !errors.Is(err, tt.want) || len(rates) != tt.rates {
+			t.Errorf("%s: %d rates, err %v; want %d, %v", tt.name, len(rates), err, tt.rates, tt.want)
+		}
+	}
+}
+
+func TestUngeocodedAddressIsReportedNotRetried(t *testing.T) {
+	var calls atomic.Int64
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		fmt.Fprint(w, `{"GISRETURNCODE": "1", "TAXRATES": []}`)
+	})
+	s := newTestServer(t, api, nil)
+	w := postCSV(t, s, "include=charge", testHeader+"Acme,1/15/2024,100,1 Mian St,Austin,TX,78701\n")
+	rows := readCSV(t, unzip(t, w.Body.Bytes())["errors.csv"])
+	if len(rows) != 2 || !strings.Contains(rows[1][2], "check the street, city and zip code") {
+		t.Errorf("errors.csv = %v, want the address reported as not geocoded", rows)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("rate API called %d times, want 1", n)
+	}
+}
+
+func TestTotalRateSourceAPI(t *testing.T) {
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"GISRETURNCODE": "0", "TOTALTAXRATE": "0.0825", "TAXRATES": [
+			{"JURISNAME": "TEXAS STATE", "JURISTYPE": "STATE", "JURISRATE": "0.0625"},
+			{"JURISNAME": "AUSTIN", "JURISTYPE": "CITY", "JURISRATE": "0.01"},
+			{"JURISNAME": "AUSTIN MTA", "JURISTYPE": "SPD", "JURISRATE": "0.01"}]}`)
+	})
+	s := newTestServer(t, api, map[string]string{"TOTAL_RATE_SOURCE": "api"})
+	w := postCSV(t, s, "include=charge,jurisdiction", testHeader+
+		"Acme,1/15/2024,123.45,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,1000,1 Main St,Austin,TX,78701\n")
+	files := unzip(t, w.Body.Bytes())
+
+	rows := readCSV(t, files["due_by_charge.csv"])
+	if want := append(slices.Clone(requiredColumns), combinedRateName); !slices.Equal(rows[0], want) {
+		t.Fatalf("due_by_charge.csv header = %v, want %v", rows[0], want)
+	}
+	for i, want := range []string{"10.18", "82.50"} { // 123.45 * 0.0825 = 10.184625
+		if got := rows[i+1][len(rows[0])-1]; got != want {
+			t.Errorf("row %d TOTAL = %s, want %s", i+1, got, want)
+		}
+	}
+	if rows := readCSV(t, files["due_by_jurisdiction.csv"]); len(rows) != 2 || rows[1][0] != combinedRateName || rows[1][1] != "92.68" {
+		t.Errorf("due_by_jurisdiction.csv = %v, want only TOTAL of 92.68", rows)
+	}
+
+	if _, err := loadConfigWith(t, map[string]string{"TOTAL_RATE_SOURCE": "sum"}); err == nil {
+		t.Error("unknown TOTAL_RATE_SOURCE accepted")
+	}
+}
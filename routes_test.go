@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutePrefix(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, map[string]string{
+		"ROUTE_PREFIX":         "/api/tax/",
+		"CORS_ALLOWED_ORIGINS": "http://localhost:3000",
+	})
+	mux := s.routes()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Origin", "http://localhost:3000")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/api/tax/healthz"); w.Code != http.StatusOK {
+		t.Errorf("GET /api/tax/healthz: status %d", w.Code)
+	}
+	w := serve(http.MethodOptions, "/api/tax/getTaxRates")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" {
+		t.Errorf("preflight under the prefix: status %d, allowed origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	for _, path := range []string{"/healthz", "/getTaxRates", "/api/healthz"} {
+		if w := serve(http.MethodGet, path); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s outside the prefix: status %d, want 404", path, w.Code)
+		}
+	}
+
+	if _, err := loadConfigWith(t, map[string]string{"ROUTE_PREFIX": "api/tax"}); err == nil {
+		t.Error("ROUTE_PREFIX without a leading slash accepted")
+	}
+}
+
+func TestCORSAllowedOrigins(t *testing.T) {
+	var reached int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached++ })
+	serve := func(allowed []string, method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/getTaxRates", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		corsMiddleware(allowed, next).ServeHTTP(w, req)
+		return w
+	}
+	allowed := []string{"https://skeen0711.github.io", "http://localhost:3000"}
+
+	for _, tt := range []struct {
+		allowed      []string
+		origin, want string
+	}{
+		{allowed, "http://localhost:3000", "http://localhost:3000"},
+		{allowed, "https://skeen0711.github.io", "https://skeen0711.github.io"},
+		{allowed, "https://evil.example", ""},
+		{allowed, "", ""},
+		{[]string{"*"}, "https://anything.example", "*"},
+	} {
+		w := serve(tt.allowed, http.MethodPost, tt.origin)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("origin %q with %v: allowed origin %q, want %q", tt.origin, tt.allowed, got, tt.want)
+		}
+		if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("origin %q: credentials allowed", tt.origin)
+		}
+		if w.Header().Get("Access-Control-Allow-Methods") != "POST, GET, OPTIONS" {
+			t.Errorf("origin %q: methods %q", tt.origin, w.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+	if reached != 5 {
+		t.Errorf("handler reached %d times, want 5", reached)
+	}
+
+	if w := serve(allowed, http.MethodOptions, "http://localhost:3000"); w.Code != http.StatusOK || reached != 5 {
+		t.Errorf("preflight: status %d, handler reached %d times; want 200 without reaching it", w.Code, reached-5)
+	}
+
+	cfg, err := loadConfigWith(t, map[string]string{"CORS_ALLOWED_ORIGINS": "http://localhost:3000, https://app.example"})
+	if err != nil || len(cfg.CORSAllowedOrigins) != 2 || cfg.CORSAllowedOrigins[1] != "https://app.example" {
+		t.Errorf("CORS_ALLOWED_ORIGINS parsed as %v, %v", cfg.CORSAllowedOrigins, err)
+	}
+	if _, err := loadConfigWith(t, map[string]string{"CORS_ALLOWED_ORIGINS": "https://app.example/path"}); err == nil {
+		t.Error("origin with a path accepted")
+	}
+}
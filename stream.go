@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// streamResults is the bounded-memory path used for stream=true. Because
+// the jurisdiction columns of due_by_charge.csv are only known once every
+// address has been resolved, the upload is read twice:
+//
+//  1. The first pass resolves rates for every row, looking each unique
+//     address up once and caching it, and records which jurisdictions and
+//     optional columns appear without keeping the rows themselves.
+//  2. The second pass re-reads the file, recomputes each row from the cache
+//     and writes it straight into a ZIP on the response, accumulating only
+//     the per-jurisdiction totals.
+//
+// Memory is therefore bounded by the number of unique addresses and
+// jurisdictions rather than by the number of rows. Only due_by_charge.csv
+// and due_by_jurisdiction.csv are produced; parseRequestOptions rejects
+// the options that would need anything else. The expected state and client
+// charge range checks are applied, but outlier flagging, which needs the
+// median of every charge, is refused. The expected_total control total is
+// checked at the end of the first pass, before any output is written.
+// Unlike the buffered path
+// an invalid row fails the job instead of going to errors.csv, since the
+// passes must agree on the rows. Errors during the second pass
+// happen after the response has started, so they can only be logged and
+// the client receives a truncated ZIP.
+func (s *server) streamResults(ctx context.Context, w http.ResponseWriter, file multipart.File, opts requestOptions) {
+	if s.cfg.OutlierFactor > 0 {
+		// The median charge would take every row's charge in memory.
+		http.Error(w, "stream=true is not supported with CHARGE_OUTLIER_FACTOR set", http.StatusBadRequest)
+		return
+	}
+	rv := s.newResolver(opts)
+	rp := reporter{cfg: s.cfg, opts: opts}
+
+	var layout chargeLayout
+	seen := make(map[string]bool)
+	states := make(map[string]int)
+	rows := 0
+	chargeSum := 0.0
+	err := forEachRecord(ctx, file, s.cfg, opts, rv, func(rec TaxRecord) error {
+		layout.observe(rec, s.cfg.ChargeColumns)
+		if chargeRangeViolation(rec, s.cfg.ClientChargeRanges) != "" {
+			layout.warnings = true
+		}
+		states[strings.ToUpper(rec.State)]++
+		chargeSum += rec.Charge
+		for juris := range rec.Taxes {
+			if !seen[juris] {
+				seen[juris] = true
+				layout.jurisNames = append(layout.jurisNames, juris)
+			}
+		}
+		rows++
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error processing CSV: %v", err), processingErrorStatus(err))
+		return
+	}
+	if opts.ExpectedTotal != nil {
+		if err := checkChargeSum(chargeSum, rows, *opts.ExpectedTotal); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, fmt.Sprintf("Error rewinding upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	expectedState := s.cfg.ExpectedState
+	if expectedState == "auto" {
+		expectedState = mostCommonState(states)
+	}
+	for state := range states {
+		if expectedState != "" && state != expectedState {
+			layout.warnings = true
+		}
+	}
+	sort.Strings(layout.jurisNames)
+	rp.shortNames = rp.shortenNames(layout.jurisNames)
+	log.Printf("Streaming %d rows across %d jurisdictions", rows, len(layout.jurisNames))
+
+	summary, _ := json.Marshal(jobSummary{
+		Rows:      rows,
+		Succeeded: rows,
+		Addresses: rv.lookupCount(),
+		APICalls:  rv.calls.Load(),
+	})
+	log.Printf("Job summary: %s", summary)
+	w.Header().Set("X-Tax-Summary", string(summary))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"tax_results.zip\"")
+	zipWriter := zip.NewWriter(w)
+
+	f, err := zipWriter.Create("due_by_charge.csv")
+	if err != nil {
+		log.Printf("Error creating due_by_charge.csv ZIP entry: %v", err)
+		return
+	}
+	header := rp.chargeHeader(layout)
+	csvWriter := newCSVWriter(f, header, opts)
+	if err := csvWriter.Write(header); err != nil {
+		log.Printf("Error writing due_by_charge.csv header: %v", err)
+		return
+	}
+
+	totals := newJurisdictionTotals(opts.Rounding)
+	err = forEachRecord(ctx, file, s.cfg, opts, rv, func(rec TaxRecord) error {
+		if expectedState != "" {
+			rec.checkState(expectedState)
+		}
+		if msg := chargeRangeViolation(rec, s.cfg.ClientChargeRanges); msg != "" {
+			rec.warn("%s", msg)
+		}
+		totals.add(rec)
+		return csvWriter.Write(rp.chargeRow(rec, layout))
+	})
+	if err != nil {
+		log.Printf("Error streaming due_by_charge.csv: %v", err)
+		return
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		log.Printf("Error flushing due_by_charge.csv: %v", err)
+		return
+	}
+
+	if err := rp.writeCSVEntry(zipWriter, "due_by_jurisdiction.csv", rp.jurisdictionTotalRows(totals)); err != nil {
+		log.Printf("Error streaming results: %v", err)
+		return
+	}
+	if err := zipWriter.Close(); err != nil {
+		log.Printf("Error closing ZIP writer: %v", err)
+		return
+	}
+	log.Printf("Finished streaming %d rows", rows)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamMatchesBufferedOutput(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, nil)
+	upload := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,33.33,2 Main St,Austin,TX,78701\n" +
+		"Acme,2/15/2024,250,1 Main St,Austin,TX,78701\n"
+
+	buffered := unzip(t, postCSV(t, s, "include=charge,jurisdiction", upload).Body.Bytes())
+	s.cache.purge(func(rateKey) bool { return true })
+	api.calls.Store(0)
+
+	w := postCSV(t, s, "stream=true", upload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	streamed := unzip(t, w.Body.Bytes())
+	if got := fileNames(streamed); len(got) != 2 {
+		t.Errorf("streamed files = %v, want due_by_charge.csv and due_by_jurisdiction.csv", got)
+	}
+	for _, name := range []string{"due_by_charge.csv", "due_by_jurisdiction.csv"} {
+		if streamed[name] != buffered[name] {
+			t.Errorf("%s differs:\nstreamed:\n%s\nbuffered:\n%s", name, streamed[name], buffered[name])
+		}
+	}
+	// The second pass is served from the cache.
+	if n := api.calls.Load(); n != 2 {
+		t.Errorf("rate API called %d times, want 2", n)
+	}
+}
+
+func TestStreamFailsOnInvalidRow(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "stream=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,13/45/2024,100,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+	}
+}
+
+func TestStreamRejectsUnsupportedOptions(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	upload := testHeader + "Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"
+	for _, query := range []string{
+		"format=xlsx",
+		"format=json-envelope",
+		"template=quickbooks",
+		"include=charge",
+		"include=charge,jurisdiction,client",
+		"rate_schedule=true",
+		"split_quarters=true",
+		"period_names=true",
+		"merge_similar=true",
+		"checksums=true",
+		"preview=1",
+		"estimate=true",
+	} {
+		w := postCSV(t, s, "stream=true&"+query, upload)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "stream=true does not support") {
+			t.Errorf("%s: status = %d, want 400: %s", query, w.Code, w.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/getTaxRates?stream=true", nil)
+	req.Header.Set("Accept", "application/json")
+	if _, err := parseRequestOptions(req); err == nil {
+		t.Error("Accept: application/json accepted with stream=true")
+	}
+
+	if w := postCSV(t, s, "stream=true&include=jurisdiction,charge&exact_totals=true", upload); w.Code != http.StatusOK {
+		t.Errorf("supported options: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestStreamAppliesQualityChecks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.json")
+	if err := os.WriteFile(path, []byte(`{"Acme": {"max": 500}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"CLIENT_CHARGE_RANGES_FILE": path, "EXPECTED_STATE": "auto"})
+	upload := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Acme,1/16/2024,900,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/17/2024,50,2 Main St,Tulsa,OK,74103\n"
+
+	buffered := unzip(t, postCSV(t, s, "include=charge,jurisdiction", upload).Body.Bytes())
+	s.cache.purge(func(rateKey) bool { return true })
+	api.calls.Store(0)
+
+	w := postCSV(t, s, "stream=true", upload)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	streamed := unzip(t, w.Body.Bytes())
+	if streamed["due_by_charge.csv"] != buffered["due_by_charge.csv"] {
+		t.Errorf("due_by_charge.csv differs:\nstreamed:\n%s\nbuffered:\n%s", streamed["due_by_charge.csv"], buffered["due_by_charge.csv"])
+	}
+	if !strings.Contains(streamed["due_by_charge.csv"], "above Acme's usual maximum") {
+		t.Errorf("streamed due_by_charge.csv lacks the range warning:\n%s", streamed["due_by_charge.csv"])
+	}
+
+	var summary jobSummary
+	if err := json.Unmarshal([]byte(w.Header().Get("X-Tax-Summary")), &summary); err != nil {
+		t.Fatalf("X-Tax-Summary: %v", err)
+	}
+	if want := (jobSummary{Rows: 3, Succeeded: 3, Addresses: 2, APICalls: 2}); summary != want {
+		t.Errorf("X-Tax-Summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestStreamRefusesOutlierFlagging(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"CHARGE_OUTLIER_FACTOR": "10"})
+	w := postCSV(t, s, "stream=true", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400: %s", w.Code, w.Body)
+	}
+	if n := api.calls.Load(); n != 0 {
+		t.Errorf("rate API called %d times", n)
+	}
+}
+
+func TestStreamChecksControlTotal(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	upload := testHeader +
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n" +
+		"Bolt,1/16/2024,33.33,2 Main St,Austin,TX,78701\n"
+
+	w := postCSV(t, s, "stream=true&expected_total=150", upload)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "sum to 133.33, expected 150.00") {
+		t.Errorf("mismatch: status = %d, want 400: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct == "application/zip" {
+		t.Error("output started before the control total failed")
+	}
+
+	if w := postCSV(t, s, "stream=true&expected_total=133.33", upload); w.Code != http.StatusOK {
+		t.Errorf("match: status = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import "math"
+
+// computeTaxes fills rec.Taxes from the jurisdiction rates resolved for its
+// address. Jurisdictions exempted by a tax holiday are kept as zero-amount
+// columns. With the gross basis the charge is treated as tax-inclusive and
+// taxed on the net amount charge / (1 + combined rate); with the default net
+// basis the charge itself is the taxable amount. A jurisdiction with a cap
+// in cfg.TaxableCaps taxes at most that much of the charge.
+//
+// Any additional charge columns configured with CHARGE_COLUMNS are taxed the
+// same way, but only by the jurisdiction types their rule allows; their tax
+// is added to the jurisdiction amounts and totalled per column in
+// rec.ColumnTaxes.
+func computeTaxes(rec *TaxRecord, rates []jurisdictionRate, cfg Config, opts requestOptions) {
+	rec.Rates = rates
+	rec.RateBases = make(map[aggregateKey]float64)
+
+	var applicable []jurisdictionRate
+	totalRate := 0.0
+	for _, rate := range rates {
+		if holiday := holidayFor(cfg.TaxHolidays, rec.ChargeDate, rate.Type); holiday != nil {
+			rec.Taxes[rate.Name] += 0
+			rec.Exemption = holiday.Name
+			continue
+		}
+		applicable = append(applicable, rate)
+		totalRate += rate.Rate
+	}
+
+	rec.NetCharge = rec.Charge
+	if opts.Basis == "gross" {
+		rec.NetCharge = rec.Charge / (1 + totalRate)
+	}
+
+	for _, rate := range applicable {
+		taxable := rec.NetCharge
+		if limit, ok := cfg.TaxableCaps[rate.Name]; ok && math.Abs(taxable) > limit {
+			taxable = math.Copysign(limit, taxable)
+		}
+		rec.Taxes[rate.Name] += taxable * rate.Rate
+		rec.Bases[rate.Name] += taxable
+		rec.RateBases[aggregateKey{rate.Name, rate.Rate}] += taxable
+	}
+
+	for _, col := range cfg.ChargeColumns {
+		amount, ok := rec.ColumnCharges[col.Name]
+		if !ok {
+			continue
+		}
+		colRate := 0.0
+		for _, rate := range applicable {
+			if col.taxes(rate.Type) {
+				colRate += rate.Rate
+			}
+		}
+		if opts.Basis == "gross" {
+			amount /= 1 + colRate
+		}
+		for _, rate := range applicable {
+			if !col.taxes(rate.Type) {
+				continue
+			}
+			tax := amount * rate.Rate
+			rec.Taxes[rate.Name] += tax
+			rec.Bases[rate.Name] += amount
+			rec.RateBases[aggregateKey{rate.Name, rate.Rate}] += amount
+			rec.ColumnTaxes[col.Name] += tax
+		}
+	}
+
+	applyMinimumTax(rec, cfg)
+}
+
+// applyMinimumTax zeroes per-jurisdiction amounts smaller in magnitude than
+// cfg.MinTaxAmount. When cfg.MinTaxBucket is set the zeroed amounts are
+// moved into a jurisdiction column of that name instead of being dropped.
+func applyMinimumTax(rec *TaxRecord, cfg Config) {
+	if cfg.MinTaxAmount <= 0 {
+		return
+	}
+	for juris, tax := range rec.Taxes {
+		if tax == 0 || math.Abs(tax) >= cfg.MinTaxAmount {
+			continue
+		}
+		rec.Taxes[juris] = 0
+		for k := range rec.RateBases {
+			if k.Name == juris {
+				delete(rec.RateBases, k)
+			}
+		}
+		if cfg.MinTaxBucket != "" {
+			rec.Taxes[cfg.MinTaxBucket] += tax
+		}
+	}
+}
+
+// toCents rounds v half away from zero to a whole number of cents.
+func toCents(v float64) int64 {
+	return int64(math.Round(v * 100))
+}
+
+// jurisdictionTotals accumulates the per-jurisdiction totals reported in
+// due_by_jurisdiction.csv. Two rounding modes are supported:
+//
+//   - "row" (default): each row's amount is rounded to cents first and the
+//     rounded amounts are summed, so every total equals the sum of the
+//     values shown in due_by_charge.csv.
+//   - "aggregate": the taxable bases are summed per jurisdiction and rate,
+//     and tax is computed and rounded once on that aggregate, as some
+//     periodic filings require. Totals can then differ from the row sums
+//     by a few cents. Amounts not computed from a rate, such as the
+//     MIN_TAX_BUCKET column, are summed unrounded and rounded once.
+//
+// Amounts are accumulated as integer cents so the totals do not depend on
+// the order the rows arrive in. The unrounded amounts are kept alongside in
+// exact for callers that chain further computation on the totals, and the
+// taxable base of every jurisdiction in taxable.
+type jurisdictionTotals struct {
+	mode     string
+	cents    map[string]int64
+	bases    map[aggregateKey]float64
+	residual map[string]float64
+	exact    map[string]float64
+	taxable  map[string]float64
+}
+
+type aggregateKey struct {
+	Name string
+	Rate float64
+}
+
+func newJurisdictionTotals(mode string) *jurisdictionTotals {
+	return &jurisdictionTotals{
+		mode:     mode,
+		cents:    make(map[string]int64),
+		bases:    make(map[aggregateKey]float64),
+		residual: make(map[string]float64),
+		exact:    make(map[string]float64),
+		taxable:  make(map[string]float64),
+	}
+}
+
+func (t *jurisdictionTotals) add(rec TaxRecord) {
+	for juris, tax := range rec.Taxes {
+		t.exact[juris] += tax
+		if t.mode == "aggregate" {
+			t.cents[juris] += 0
+			continue
+		}
+		t.cents[juris] += toCents(tax)
+	}
+	for juris, base := range rec.Bases {
+		t.taxable[juris] += base
+	}
+	if t.mode == "aggregate" {
+		// Whatever part of a jurisdiction's amount its rates don't account
+		// for was moved there by MIN_TAX_BUCKET.
+		residual := make(map[string]float64, len(rec.Taxes))
+		for juris, tax := range rec.Taxes {
+			residual[juris] = tax
+		}
+		for k, base := range rec.RateBases {
+			t.bases[k] += base
+			residual[k.Name] -= base * k.Rate
+		}
+		for juris, v := range residual {
+			t.residual[juris] += v
+		}
+	}
+}
+
+// totals returns the total due per jurisdiction.
+func (t *jurisdictionTotals) totals() map[string]float64 {
+	cents := make(map[string]int64, len(t.cents))
+	for juris, c := range t.cents {
+		cents[juris] = c
+	}
+	for k, base := range t.bases {
+		cents[k.Name] += toCents(base * k.Rate)
+	}
+	for juris, v := range t.residual {
+		cents[juris] += toCents(v)
+	}
+
+	totals := make(map[string]float64, len(cents))
+	for juris, c := range cents {
+		totals[juris] = float64(c) / 100
+	}
+	return totals
+}
+
+// unrounded returns the full-precision tax per jurisdiction, before any
+// rounding to cents.
+func (t *jurisdictionTotals) unrounded() map[string]float64 {
+	exact := make(map[string]float64, len(t.exact))
+	for juris, v := range t.exact {
+		exact[juris] = v
+	}
+	return exact
+}
+
+// taxableBases returns the total amount each jurisdiction taxed. It equals
+// the charges' sum unless a cap, holiday or charge column rule applied.
+func (t *jurisdictionTotals) taxableBases() map[string]float64 {
+	bases := make(map[string]float64, len(t.taxable))
+	for juris, v := range t.taxable {
+		bases[juris] = v
+	}
+	return bases
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRecord returns a record charged amount on date, ready for
+// computeTaxes.
+func newRecord(amount float64, date string) *TaxRecord {
+	d, _ := time.Parse("2006-01-02", date)
+	return &TaxRecord{Charge: amount, ChargeDate: d, Taxes: map[string]float64{}, Bases: map[string]float64{}}
+}
+
+func TestTaxHolidayExemptsTypesInRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.json")
+	os.WriteFile(path, []byte(`[{"name": "Back to school", "start": "2024-08-09", "end": "2024-08-11", "types": ["state"]}]`), 0o600)
+	holidays, err := loadTaxHolidays(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{TaxHolidays: holidays}
+
+	tests := []struct {
+		date             string
+		state, exemption string
+	}{
+		{"2024-08-08", "6.25", ""},
+		{"2024-08-09", "0.00", "Back to school"},
+		{"2024-08-11", "0.00", "Back to school"},
+		{"2024-08-12", "6.25", ""},
+	}
+	for _, tt := range tests {
+		rec := newRecord(100, tt.date)
+		computeTaxes(rec, testRates, cfg, requestOptions{})
+		if got := formatAmount(rec.Taxes["TEXAS STATE"], requestOptions{}); got != tt.state || rec.Exemption != tt.exemption {
+			t.Errorf("%s: state tax %s, exemption %q; want %s, %q", tt.date, got, rec.Exemption, tt.state, tt.exemption)
+		}
+		if rec.Taxes["AUSTIN"] != 1 {
+			t.Errorf("%s: city tax %v, want 1 (holiday is state only)", tt.date, rec.Taxes["AUSTIN"])
+		}
+	}
+}
+
+func TestLoadTaxHolidaysRejectsBackwardsRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.json")
+	os.WriteFile(path, []byte(`[{"name": "Oops", "start": "2024-08-11", "end": "2024-08-09"}]`), 0o600)
+	if _, err := loadTaxHolidays(path); err == nil {
+		t.Error("holiday ending before it starts was accepted")
+	}
+}
+
+func TestGrossBasisTaxesNetAmount(t *testing.T) {
+	net := newRecord(100, "2024-01-15")
+	computeTaxes(net, testRates, Config{}, requestOptions{Basis: "net"})
+	gross := newRecord(107.25, "2024-01-15")
+	computeTaxes(gross, testRates, Config{}, requestOptions{Basis: "gross"})
+
+	if math.Abs(gross.NetCharge-100) > 1e-9 {
+		t.Errorf("gross NetCharge = %v, want 100", gross.NetCharge)
+	}
+	for _, juris := range []string{"TEXAS STATE", "AUSTIN"} {
+		if math.Abs(gross.Taxes[juris]-net.Taxes[juris]) > 1e-9 {
+			t.Errorf("%s: gross tax %v, net tax %v; want equal", juris, gross.Taxes[juris], net.Taxes[juris])
+		}
+	}
+	if net.NetCharge != 100 {
+		t.Errorf("net NetCharge = %v, want the charge itself", net.NetCharge)
+	}
+}
+
+func TestJurisdictionTotalsRounding(t *testing.T) {
+	state := []jurisdictionRate{{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625}}
+	totalsFor := func(mode string) *jurisdictionTotals {
+		totals := newJurisdictionTotals(mode)
+		for range 3 {
+			rec := newRecord(1, "2024-01-15")
+			computeTaxes(rec, state, Config{}, requestOptions{})
+			totals.add(*rec)
+		}
+		return totals
+	}
+
+	// Each row's 0.0625 shows as 0.06, and row totals add up what's shown.
+	if got := totalsFor("row").totals()["TEXAS STATE"]; got != 0.18 {
+		t.Errorf("row total = %v, want 0.18", got)
+	}
+	// Aggregate taxes the 3.00 base once: 0.1875 rounds to 0.19.
+	agg := totalsFor("aggregate")
+	if got := agg.totals()["TEXAS STATE"]; got != 0.19 {
+		t.Errorf("aggregate total = %v, want 0.19", got)
+	}
+	if got := agg.unrounded()["TEXAS STATE"]; math.Abs(got-0.1875) > 1e-12 {
+		t.Errorf("unrounded total = %v, want 0.1875", got)
+	}
+	if got := agg.taxableBases()["TEXAS STATE"]; got != 3 {
+		t.Errorf("taxable base = %v, want 3", got)
+	}
+}
+
+func TestMinimumTax(t *testing.T) {
+	rates := []jurisdictionRate{
+		{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625},
+		{Name: "AUSTIN MTA", Type: "SPD", Rate: 0.001},
+		{Name: "AUSTIN", Type: "CITY", Rate: 0.002},
+	}
+	for _, tt := range []struct {
+		bucket string
+		charge float64
+	}{{"", 10}, {"OTHER", 10}, {"OTHER", -10}} {
+		rec := newRecord(tt.charge, "2024-01-15")
+		computeTaxes(rec, rates, Config{MinTaxAmount: 0.05, MinTaxBucket: tt.bucket}, requestOptions{})
+
+		if rec.Taxes["TEXAS STATE"] != tt.charge*0.0625 {
+			t.Errorf("%+v: state tax = %v, want it kept", tt, rec.Taxes["TEXAS STATE"])
+		}
+		if rec.Taxes["AUSTIN MTA"] != 0 || rec.Taxes["AUSTIN"] != 0 {
+			t.Errorf("%+v: small amounts = %v, %v; want zeroed", tt, rec.Taxes["AUSTIN MTA"], rec.Taxes["AUSTIN"])
+		}
+		bucket, ok := rec.Taxes["OTHER"]
+		if tt.bucket == "" && ok {
+			t.Errorf("%+v: bucket created without MIN_TAX_BUCKET", tt)
+		}
+		if want := tt.charge * 0.003; tt.bucket != "" && math.Abs(bucket-want) > 1e-12 {
+			t.Errorf("%+v: bucket = %v, want %v", tt, bucket, want)
+		}
+	}
+}
+
+func TestTaxableCapLimitsOnlyCappedJurisdiction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "caps.json")
+	os.WriteFile(path, []byte(`{"AUSTIN": 500}`), 0o600)
+	cfg, err := loadConfigWith(t, map[string]string{"TAXABLE_CAPS_FILE": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		charge, state, city float64
+	}{
+		{400, 25, 4},
+		{2000, 125, 5},
+		{-2000, -125, -5}, // a refund is capped the same way
+	} {
+		rec := newRecord(tt.charge, "2024-01-15")
+		computeTaxes(rec, testRates, cfg, requestOptions{})
+		if math.Abs(rec.Taxes["TEXAS STATE"]-tt.state) > 1e-9 || math.Abs(rec.Taxes["AUSTIN"]-tt.city) > 1e-9 {
+			t.Errorf("charge %v: taxes %v, want state %v and city %v", tt.charge, rec.Taxes, tt.state, tt.city)
+		}
+	}
+
+	os.WriteFile(path, []byte(`{"AUSTIN": -1}`), 0o600)
+	if _, err := loadConfigWith(t, map[string]string{"TAXABLE_CAPS_FILE": path}); err == nil {
+		t.Error("negative cap accepted")
+	}
+}
+
+// Rates and charges whose products sit near half a cent: summing the
+// float amounts and rounding once drifts from the sum of the rounded row
+// amounts shown in due_by_charge.csv.
+func TestTotalsReconcileWithDisplayedRows(t *testing.T) {
+	rates := []jurisdictionRate{
+		{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625},
+		{Name: "AUSTIN", Type: "CITY", Rate: 0.01},
+		{Name: "MTA", Type: "SPD", Rate: 0.0075},
+	}
+	s := newTestServer(t, &rateAPI{rates: rates}, nil)
+	var body strings.Builder
+	body.WriteString(testHeader)
+	for i := range 1000 {
+		fmt.Fprintf(&body, "C%d,1/15/2024,%d.%02d,1 Main St,Austin,TX,78701\n", i, 1+i%7, (i*37)%100)
+	}
+	files := unzip(t, postCSV(t, s, "include=charge,jurisdiction", body.String()).Body.Bytes())
+
+	charges := readCSV(t, files["due_by_charge.csv"])
+	shown := make(map[string]int64)
+	naive := make(map[string]float64)
+	for _, row := range charges[1:] {
+		charge, _ := strconv.ParseFloat(row[2], 64)
+		for _, r := range rates {
+			naive[r.Name] += charge * r.Rate
+		}
+		for i, name := range charges[0] {
+			if !slices.ContainsFunc(rates, func(r jurisdictionRate) bool { return r.Name == name }) {
+				continue
+			}
+			cents, _ := strconv.ParseInt(strings.Replace(row[i], ".", "", 1), 10, 64)
+			shown[name] += cents
+		}
+	}
+	for _, row := range readCSV(t, files["due_by_jurisdiction.csv"])[1:] {
+		cents, _ := strconv.ParseInt(strings.Replace(row[1], ".", "", 1), 10, 64)
+		if cents != shown[row[0]] {
+			t.Errorf("%s total %s, but its rows add up to %d cents", row[0], row[1], shown[row[0]])
+		}
+	}
+	if len(shown) != len(rates) {
+		t.Errorf("found amounts for %v, want %d jurisdictions", shown, len(rates))
+	}
+	// Guard against the data no longer exercising the problem.
+	drifted := false
+	for name, v := range naive {
+		drifted = drifted || toCents(v) != shown[name]
+	}
+	if !drifted {
+		t.Error("rounding the float sums matches the row sums; the test data no longer shows drift")
+	}
+}
+
+func TestAggregateTotalsKeepMinimumTaxBucket(t *testing.T) {
+	rates := []jurisdictionRate{
+		{Name: "TEXAS STATE", Type: "STATE", Rate: 0.0625},
+		{Name: "TINY", Type: "SPD", Rate: 0.0001},
+	}
+	cfg := Config{MinTaxAmount: 0.02, MinTaxBucket: "ROUNDING"}
+	totalsFor := func(mode string) map[string]float64 {
+		totals := newJurisdictionTotals(mode)
+		for range 3 {
+			rec := newRecord(100, "2024-01-15")
+			computeTaxes(rec, rates, cfg, requestOptions{})
+			totals.add(*rec)
+		}
+		return totals.totals()
+	}
+
+	// TINY's 0.01 a row is below the minimum, so it moves to ROUNDING in
+	// both modes rather than being recomputed from TINY's rate.
+	want := map[string]float64{"TEXAS STATE": 18.75, "TINY": 0, "ROUNDING": 0.03}
+	for _, mode := range []string{"row", "aggregate"} {
+		if got := totalsFor(mode); !maps.Equal(got, want) {
+			t.Errorf("%s totals = %v, want %v", mode, got, want)
+		}
+	}
+}
+
+func TestAggregateTotalsCountSharedNameOnce(t *testing.T) {
+	// Two districts the API names alike, at different rates.
+	rates := []jurisdictionRate{
+		{Name: "TRANSIT", Type: "SPD", Rate: 0.01},
+		{Name: "TRANSIT", Type: "SPD", Rate: 0.005},
+	}
+	totals := newJurisdictionTotals("aggregate")
+	rec := newRecord(100, "2024-01-15")
+	computeTaxes(rec, rates, Config{}, requestOptions{})
+	totals.add(*rec)
+	if got := totals.totals()["TRANSIT"]; got != 1.5 {
+		t.Errorf("TRANSIT = %v, want 1.50 from 100 at each rate once", got)
+	}
+}
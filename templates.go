@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// outputTemplate reshapes processed records into the files an external
+// system expects to import, replacing the standard reports.
+type outputTemplate func(rp reporter, records []TaxRecord) []outputFile
+
+// outputTemplates is the registry of templates selectable with the
+// template request parameter. Add an entry here to support a new system.
+var outputTemplates = map[string]outputTemplate{
+	"quickbooks": quickBooksTemplate,
+}
+
+func templateNames() string {
+	names := make([]string, 0, len(outputTemplates))
+	for name := range outputTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// quickBooksTemplate writes one line per charge and jurisdiction in the
+// column layout of the QuickBooks sales tax liability import.
+func quickBooksTemplate(rp reporter, records []TaxRecord) []outputFile {
+	return []outputFile{{"quickbooks_import.csv", func() [][]string {
+		return rp.quickBooksRows(records)
+	}}}
+}
+
+func (rp reporter) quickBooksRows(records []TaxRecord) [][]string {
+	rows := [][]string{{"Customer", "Transaction Date", "Description", "Amount", "Tax Agency", "Tax Amount"}}
+	jurisNames := getAllJurisNames(records)
+	for _, rec := range records {
+		description := fmt.Sprintf("%s, %s, %s %s", rec.Street, rec.City, rec.State, rec.Zip)
+		for _, juris := range jurisNames {
+			tax, ok := rec.Taxes[juris]
+			if !ok {
+				continue
+			}
+			rows = append(rows, []string{
+				rec.Client,
+				rec.Date,
+				description,
+				rp.amount(rec.Charge),
+				rp.displayName(juris),
+				rp.amount(tax),
+			})
+		}
+	}
+	return rows
+}
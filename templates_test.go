@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestQuickBooksTemplate(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "template=quickbooks", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n"+
+		"Bolt,1/16/2024,13/45,2 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	files := unzip(t, w.Body.Bytes())
+	// The template replaces the standard reports; skipped rows are still
+	// reported.
+	if got := fileNames(files); !slices.Equal(got, []string{"errors.csv", "quickbooks_import.csv"}) {
+		t.Errorf("files = %v", got)
+	}
+	want := [][]string{
+		{"Customer", "Transaction Date", "Description", "Amount", "Tax Agency", "Tax Amount"},
+		{"Acme", "1/15/2024", "1 Main St, Austin, TX 78701", "100.00", "AUSTIN", "1.00"},
+		{"Acme", "1/15/2024", "1 Main St, Austin, TX 78701", "100.00", "TEXAS STATE", "6.25"},
+	}
+	if rows := readCSV(t, files["quickbooks_import.csv"]); !slices.EqualFunc(rows, want, slices.Equal) {
+		t.Errorf("quickbooks_import.csv = %v, want %v", rows, want)
+	}
+
+	w = postCSV(t, s, "template=xero", testHeader)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "expected one of quickbooks") {
+		t.Errorf("unknown template: got %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newUpstreamClient builds the HTTP client shared by every rate lookup. Its
+// transport routes through TAX_API_PROXY when set, and otherwise honors the
+// standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables. Server
+// certificates are verified against TAX_API_CA_FILE, or the system roots
+// when it is unset, and must match a TAX_API_PINS key when any are given.
+// Each call is abandoned after TAX_API_TIMEOUT. With UPSTREAM_MODE set,
+// responses are recorded to or replayed from UPSTREAM_FIXTURES_DIR. With
+// TAX_API_RPS set, requests that reach the network are spaced out to that
+// rate across all callers.
+func newUpstreamClient(cfg Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if cfg.TaxAPIProxy != nil {
+		transport.Proxy = http.ProxyURL(cfg.TaxAPIProxy)
+	}
+	transport.TLSClientConfig = &tls.Config{RootCAs: cfg.TaxAPIRootCAs}
+	if len(cfg.TaxAPIPins) > 0 {
+		pins := cfg.TaxAPIPins
+		transport.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return checkPinnedKey(cs.PeerCertificates, pins)
+		}
+	}
+	var rt http.RoundTripper = transport
+	if cfg.TaxAPIRPS > 0 {
+		rt = &rateLimitedTransport{interval: time.Duration(float64(time.Second) / cfg.TaxAPIRPS), next: rt}
+	}
+	if cfg.UpstreamMode != "" {
+		rt = &fixtureTransport{mode: cfg.UpstreamMode, dir: cfg.FixturesDir, next: rt}
+	}
+	return &http.Client{Transport: rt, Timeout: cfg.TaxAPITimeout}
+}
+
+// rateLimitedTransport lets one request through per interval, however many
+// goroutines are calling it. A request waits for its slot, or until its
+// context is cancelled, rather than failing.
+type rateLimitedTransport struct {
+	interval time.Duration
+	next     http.RoundTripper
+
+	mu   sync.Mutex
+	slot time.Time // when the next request may be sent
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	now := time.Now()
+	at := t.slot
+	if at.Before(now) {
+		at = now
+	}
+	t.slot = at.Add(t.interval)
+	t.mu.Unlock()
+
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// checkPinnedKey succeeds when the SHA-256 hash of any certificate's public
+// key in the verified chain matches one of pins.
+func checkPinnedKey(certs []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("tax API certificate does not match any pinned key")
+}
+
+// loadCAFile reads a PEM bundle of CA certificates for TAX_API_CA_FILE.
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TAX_API_CA_FILE: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("invalid TAX_API_CA_FILE %q: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// parsePins parses TAX_API_PINS, a comma-separated list of base64 SHA-256
+// hashes of certificate public keys (the format used by HPKP and
+// "openssl ... | openssl dgst -sha256 -binary | base64").
+func parsePins(v string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range strings.Split(v, ",") {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(p))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid TAX_API_PINS entry %q: expected a base64 SHA-256 hash", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// parseProxyURL validates TAX_API_PROXY, which must be an absolute http or
+// https URL.
+func parseProxyURL(v string) (*url.URL, bool) {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
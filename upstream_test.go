@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTaxAPIProxy(t *testing.T) {
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute URL of the upstream request.
+		if r.URL.Host != "tax-api.example" {
+			t.Errorf("proxy got a request for %q", r.URL)
+		}
+		proxied.Add(1)
+		writeRates(w, testRates)
+	}))
+	defer proxy.Close()
+
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("rate API reached without going through the proxy")
+	})
+	s := newTestServer(t, api, map[string]string{
+		"TAX_API_BASE_URL": "http://tax-api.example/rates",
+		"TAX_API_PROXY":    proxy.URL,
+	})
+	w := postCSV(t, s, "", testHeader+"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if proxied.Load() == 0 {
+		t.Error("no request went through TAX_API_PROXY")
+	}
+}
+
+func TestTaxAPIProxyMustBeHTTP(t *testing.T) {
+	if _, err := loadConfigWith(t, map[string]string{"TAX_API_PROXY": "socks5://proxy:1080"}); err == nil {
+		t.Error("socks5 proxy accepted")
+	}
+}
+
+func TestTaxAPICustomRootsAndPins(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeRates(w, testRates)
+	}))
+	defer ts.Close()
+	cert := ts.Certificate()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(sum[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"system roots", nil, false},
+		{"CA file", map[string]string{"TAX_API_CA_FILE": caFile}, true},
+		{"matching pin", map[string]string{"TAX_API_CA_FILE": caFile, "TAX_API_PINS": otherPin + "," + goodPin}, true},
+		{"wrong pin", map[string]string{"TAX_API_CA_FILE": caFile, "TAX_API_PINS": otherPin}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadConfigWith(t, tc.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := newUpstreamClient(cfg).Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if ok := err == nil; ok != tc.ok {
+				t.Errorf("request succeeded = %v (err %v), want %v", ok, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestTaxAPIPinsMustBeSHA256(t *testing.T) {
+	if _, err := loadConfigWith(t, map[string]string{"TAX_API_PINS": base64.StdEncoding.EncodeToString([]byte("short"))}); err == nil {
+		t.Error("pin of the wrong length accepted")
+	}
+}
+
+func TestScrapeUsesConfiguredEndpointAndCredentials(t *testing.T) {
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		writeRates(w, testRates)
+	}))
+	defer ts.Close()
+	cfg, err := loadConfigWith(t, map[string]string{
+		"TAX_API_BASE_URL":      ts.URL + "/gis/salestaxrate",
+		"TAX_API_CLIENT_ID":     "rotated-id",
+		"TAX_API_CLIENT_SECRET": "rotated-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates, err := scrapeTaxRates(context.Background(), newUpstreamClient(cfg), cfg, "1 Main St", "Austin", "TX", "78701", 1, 2024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rates, testRates) {
+		t.Errorf("rates = %v, want %v", rates, testRates)
+	}
+	if got.URL.Path != "/gis/salestaxrate" || got.URL.Query().Get("street") != "1 Main St" || got.URL.Query().Get("quarter") != "1" {
+		t.Errorf("request for %s", got.URL)
+	}
+	if got.Header.Get("client_id") != "rotated-id" || got.Header.Get("client_secret") != "rotated-secret" {
+		t.Errorf("credential headers = %q, %q", got.Header.Get("client_id"), got.Header.Get("client_secret"))
+	}
+}
+
+func TestTaxAPIConfigDefaultsAndValidation(t *testing.T) {
+	cfg, err := loadConfigWith(t, nil)
+	if err != nil || cfg.TaxAPIBaseURL != defaultTaxAPIBaseURL {
+		t.Errorf("default base URL = %q, %v", cfg.TaxAPIBaseURL, err)
+	}
+	for _, env := range []map[string]string{
+		{"TAX_API_CLIENT_ID": ""},
+		{"TAX_API_CLIENT_SECRET": ""},
+		{"TAX_API_BASE_URL": "mulesoft.example/rates"},
+	} {
+		t.Run(fmt.Sprint(env), func(t *testing.T) {
+			if _, err := loadConfigWith(t, env); err == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+	// Replaying fixtures never reaches the API, so needs no credentials.
+	if _, err := loadConfigWith(t, map[string]string{"TAX_API_CLIENT_ID": "", "TAX_API_CLIENT_SECRET": "", "UPSTREAM_MODE": "replay", "UPSTREAM_FIXTURES_DIR": t.TempDir()}); err != nil {
+		t.Errorf("replay without credentials: %v", err)
+	}
+}
+
+func TestTaxAPITimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer hung.Close()
+	cfg, err := loadConfigWith(t, map[string]string{"TAX_API_BASE_URL": hung.URL, "TAX_API_TIMEOUT": "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := time.Now()
+	_, err = scrapeTaxRates(context.Background(), newUpstreamClient(cfg), cfg, "1 Main St", "Austin", "TX", "78701", 1, 2024)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want it to wrap context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("lookup gave up after %s, want about 50ms", elapsed)
+	}
+	if !isTransient(err) {
+		t.Errorf("timeout %v is not retried", err)
+	}
+}
+
+func TestTaxAPIRPSLimitsAllWorkers(t *testing.T) {
+	api := &rateAPI{rates: testRates}
+	s := newTestServer(t, api, map[string]string{"TAX_API_RPS": "20", "MAX_CONCURRENCY": "8"})
+	var body strings.Builder
+	body.WriteString(testHeader)
+	for i := range 10 {
+		fmt.Fprintf(&body, "C%d,1/15/2024,100,%d Main St,Austin,TX,78701\n", i, i)
+	}
+
+	started := time.Now()
+	if w := postCSV(t, s, "", body.String()); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	// The first request goes at once and each later one a 50ms slot after.
+	if elapsed := time.Since(started); elapsed < 450*time.Millisecond {
+		t.Errorf("10 lookups at 20 rps took %s, want at least 450ms", elapsed)
+	}
+	if n := api.calls.Load(); n != 10 {
+		t.Errorf("rate API called %d times, want 10", n)
+	}
+}
+
+func TestRateLimitedTransportHonorsCancellation(t *testing.T) {
+	rt := &rateLimitedTransport{interval: time.Hour, next: http.DefaultTransport}
+	rt.slot = time.Now().Add(time.Hour) // every slot is taken
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://tax-api.example", nil)
+
+	started := time.Now()
+	if _, err := rt.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("waited %s for a slot after cancellation", elapsed)
+	}
+}
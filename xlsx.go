@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// xlsxTextColumns are the report columns written to a workbook as text,
+// so Excel keeps leading zeros and doesn't reinterpret dates. Every other
+// column holds an amount, except those in xlsxNumberColumns.
+var xlsxTextColumns = []string{"client", "date", "street address", "city", "State", "zip code", "period", "currency", "exemption", "warnings", "Jurisdiction"}
+
+// xlsxNumberColumns hold plain numbers rather than amounts, as do the
+// "<jurisdiction> rate" columns added by include_rates.
+var xlsxNumberColumns = []string{"lookup ms", "unrounded total"}
+
+// xlsxContentType is the media type of an XLSX workbook.
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+// Cell styles defined by xlsxStyles.
+const (
+	xlsxStyleDefault  = 0
+	xlsxStyleCurrency = 1
+	xlsxStyleText     = 2
+	xlsxStyleHeader   = 3
+)
+
+// xlsxSheet is one worksheet: a header row followed by data rows.
+type xlsxSheet struct {
+	Name string
+	Rows [][]string
+}
+
+// writeXLSX responds with due_by_charge.csv and due_by_jurisdiction.csv as
+// the two sheets of one workbook. Amounts are rendered by Excel, so the
+// rows are built without the request's locale.
+func (rp reporter) writeXLSX(w http.ResponseWriter, records []TaxRecord) {
+	rp.opts.Locale = nil
+	rp.opts.NumberFormat = "fixed"
+	sheets := []xlsxSheet{
+		{"Due By Charge", rp.dueByChargeRows(records, getAllJurisNames(records))},
+		{"Due By Jurisdiction", rp.dueByJurisdictionRows(records)},
+	}
+
+	w.Header().Set("Content-Type", xlsxContentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\"tax_results.xlsx\"")
+	if err := writeWorkbook(w, sheets, rp.cfg.BaseCurrency); err != nil {
+		log.Printf("Error streaming workbook to response: %v", err)
+		return
+	}
+	log.Printf("Streamed workbook with %d sheets to HTTP response", len(sheets))
+}
+
+// writeWorkbook writes sheets as a minimal Office Open XML workbook, with
+// amounts formatted in currency.
+func writeWorkbook(dst io.Writer, sheets []xlsxSheet, currency string) error {
+	zw := zip.NewWriter(dst)
+	parts := []struct {
+		name string
+		body string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes(len(sheets))},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xlsxWorkbook(sheets)},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels(len(sheets))},
+		{"xl/styles.xml", xlsxStyles(currency)},
+	}
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, p.body); err != nil {
+			return err
+		}
+	}
+	for i, sheet := range sheets {
+		f, err := zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1))
+		if err != nil {
+			return err
+		}
+		if err := writeWorksheet(f, sheet.Rows); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func xlsxContentTypes(sheets int) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	b.WriteString(`<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">`)
+	b.WriteString(`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>`)
+	b.WriteString(`<Default Extension="xml" ContentType="application/xml"/>`)
+	b.WriteString(`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>`)
+	b.WriteString(`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i)
+	}
+	b.WriteString(`</Types>`)
+	return b.String()
+}
+
+func xlsxWorkbook(sheets []xlsxSheet) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	b.WriteString(`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	for i, sheet := range sheets {
+		fmt.Fprintf(&b, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheet.Name), i+1, i+1)
+	}
+	b.WriteString(`</sheets></workbook>`)
+	return b.String()
+}
+
+func xlsxWorkbookRels(sheets int) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	b.WriteString(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	for i := 1; i <= sheets; i++ {
+		fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i, i)
+	}
+	fmt.Fprintf(&b, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, sheets+1)
+	b.WriteString(`</Relationships>`)
+	return b.String()
+}
+
+// xlsxStyles defines the cell styles numbered by the xlsxStyle constants.
+// The currency format shows "$" for USD and the currency code otherwise.
+func xlsxStyles(currency string) string {
+	format := `#,##0.00 "` + currency + `"`
+	if currency == "USD" {
+		format = `"$"#,##0.00`
+	}
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` +
+		`<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<numFmts count="1"><numFmt numFmtId="164" formatCode="` + xmlEscape(format) + `"/></numFmts>` +
+		`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+		`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+		`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+		`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+		`<cellXfs count="4">` +
+		`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+		`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="49" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+		`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+		`</cellXfs></styleSheet>`
+}
+
+// writeWorksheet writes rows as a sheet. The first row is the header and
+// decides each column's type: text columns are written as strings, and the
+// rest as numbers when their value parses as a finite one; ParseFloat also
+// accepts "NaN" and "Inf", which a number cell can't hold.
+func writeWorksheet(w io.Writer, rows [][]string) error {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`)
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	var header []string
+	if len(rows) > 0 {
+		header = rows[0]
+	}
+	for r, row := range rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, v := range row {
+			if v == "" {
+				continue
+			}
+			ref := xlsxColumn(c) + strconv.Itoa(r+1)
+			col := ""
+			if c < len(header) {
+				col = header[c]
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			numeric := err == nil && !math.IsNaN(n) && !math.IsInf(n, 0)
+			switch {
+			case r == 0:
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr" s="%d"><is><t>%s</t></is></c>`, ref, xlsxStyleHeader, xmlEscape(v))
+			case slices.Contains(xlsxTextColumns, col) || !numeric:
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr" s="%d"><is><t xml:space="preserve">%s</t></is></c>`, ref, xlsxStyleText, xmlEscape(v))
+			case slices.Contains(xlsxNumberColumns, col) || strings.HasSuffix(col, " rate"):
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxStyleDefault, strconv.FormatFloat(n, 'f', -1, 64))
+			default:
+				fmt.Fprintf(&b, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxStyleCurrency, strconv.FormatFloat(n, 'f', -1, 64))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// xlsxColumn returns the spreadsheet letters of the zero-based column i:
+// A, B, ..., Z, AA, AB, ...
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xmlEscape escapes s for use in XML text and attribute values, dropping
+// characters XML 1.0 doesn't allow, such as control characters other than
+// tab and newlines, that would make Excel reject the file.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !xmlChar(r) {
+			continue
+		}
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&quot;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// xmlChar reports whether r is in XML 1.0's Char production.
+func xmlChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= unicode.MaxRune
+}
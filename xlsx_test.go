@@ -0,0 +1,136 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestXLSXRateColumnsAreNotCurrency(t *testing.T) {
+	s := newTestServer(t, &rateAPI{rates: testRates}, nil)
+	w := postCSV(t, s, "format=xlsx&include_rates=true", testHeader+
+		"Acme,1/15/2024,100,1 Main St,Austin,TX,78701\n")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	sheet := unzip(t, w.Body.Bytes())["xl/worksheets/sheet1.xml"]
+
+	// Row 1 is the header; find the rate column's letter, then its cell.
+	header := regexp.MustCompile(`<c r="([A-Z]+)1"[^>]*><is><t>TEXAS STATE rate</t>`).FindStringSubmatch(sheet)
+	if header == nil {
+		t.Fatalf("no TEXAS STATE rate column in sheet:\n%s", sheet)
+	}
+	cell := regexp.MustCompile(`<c r="` + header[1] + `2" s="(\d)"><v>([^<]*)</v>`).FindStringSubmatch(sheet)
+	if cell == nil || cell[1] != "0" || cell[2] != "0.0625" {
+		t.Errorf("rate cell = %v, want 0.0625 with the default style", cell)
+	}
+
+	amount := regexp.MustCompile(`<c r="[A-Z]+2" s="(\d)"><v>6.25</v>`).FindStringSubmatch(sheet)
+	if amount == nil || amount[1] != "1" {
+		t.Errorf("TEXAS STATE amount cell = %v, want the currency style", amount)
+	}
+}
+
+// xlsxCell is a worksheet cell as read back from its XML.
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Style  int    `xml:"s,attr"`
+	Value  string `xml:"v"`
+	Inline string `xml:"is>t"`
+}
+
+func TestWriteWorkbookReadsBack(t *testing.T) {
+	sheets := []xlsxSheet{
+		{"Due By Charge", [][]string{
+			{"client", "zip code", "charge", "TEXAS STATE"},
+			{"Acme & Co", "01234", "100.00", "6.25"},
+		}},
+		{"Due By Jurisdiction", [][]string{{"Jurisdiction", "total"}, {"TEXAS STATE", "6.25"}}},
+	}
+	var buf bytes.Buffer
+	if err := writeWorkbook(&buf, sheets, "USD"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("workbook is not a zip: %v", err)
+	}
+	parts := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(parts["xl/workbook.xml"], &workbook); err != nil {
+		t.Fatalf("workbook.xml: %v", err)
+	}
+	if len(workbook.Sheets) != 2 || workbook.Sheets[0].Name != "Due By Charge" || workbook.Sheets[1].Name != "Due By Jurisdiction" {
+		t.Errorf("sheets = %+v", workbook.Sheets)
+	}
+
+	var sheet struct {
+		Cells []xlsxCell `xml:"sheetData>row>c"`
+	}
+	if err := xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &sheet); err != nil {
+		t.Fatalf("sheet1.xml: %v", err)
+	}
+	cells := make(map[string]xlsxCell)
+	for _, c := range sheet.Cells {
+		cells[c.Ref] = c
+	}
+	if c := cells["A2"]; c.Type != "inlineStr" || c.Inline != "Acme & Co" {
+		t.Errorf("A2 = %+v, want the client as text", c)
+	}
+	if c := cells["B2"]; c.Type != "inlineStr" || c.Style != xlsxStyleText || c.Inline != "01234" {
+		t.Errorf("B2 = %+v, want the zip as text with its leading zero", c)
+	}
+	if c := cells["C2"]; c.Type != "" || c.Style != xlsxStyleCurrency || c.Value != "100" {
+		t.Errorf("C2 = %+v, want the charge as a currency number", c)
+	}
+	if c := cells["D2"]; c.Style != xlsxStyleCurrency || c.Value != "6.25" {
+		t.Errorf("D2 = %+v, want the tax as a currency number", c)
+	}
+}
+
+func TestWriteWorksheetKeepsXMLValid(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeWorksheet(&buf, [][]string{
+		{"client", "charge", "TEXAS STATE"},
+		{"Acme\x00\x1b Co\tLtd", "NaN", "+Inf"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sheet struct {
+		Cells []xlsxCell `xml:"sheetData>row>c"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &sheet); err != nil {
+		t.Fatalf("worksheet is not valid XML: %v\n%s", err, buf.Bytes())
+	}
+	cells := make(map[string]xlsxCell)
+	for _, c := range sheet.Cells {
+		cells[c.Ref] = c
+	}
+	if c := cells["A2"]; c.Inline != "Acme Co\tLtd" {
+		t.Errorf("A2 = %q, want control characters dropped", c.Inline)
+	}
+	for ref, want := range map[string]string{"B2": "NaN", "C2": "+Inf"} {
+		if c := cells[ref]; c.Type != "inlineStr" || c.Inline != want {
+			t.Errorf("%s = %+v, want %q as text", ref, c, want)
+		}
+	}
+}